@@ -0,0 +1,37 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/sensority-labs/builder/internal/config"
+)
+
+// Store keeps blobs by key. Keys are slash-separated paths, such as bundles/<sha256>.tar.gz.
+type Store interface {
+	// Put stores data under key, replacing any blob stored under it.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the blob stored under key, or an errdefs.NotFound error.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Exists reports whether a blob is stored under key.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes the blob stored under key. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the blob store selected in the config.
+func New(cfg *config.Config) (Store, error) {
+	switch cfg.Blob.Backend {
+	case "fs":
+		dir := cfg.Blob.Dir
+		if dir == "" {
+			dir = filepath.Join(cfg.DataDir, "blobs")
+		}
+		return NewFS(dir)
+	case "s3":
+		return NewS3(cfg.Blob.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q, expected fs or s3", cfg.Blob.Backend)
+	}
+}
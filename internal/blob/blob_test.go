@@ -0,0 +1,76 @@
+package blob
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/minio/minio-go/v7"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	key := "bundles/5d41402abc4b2a76b9719d911017c592.tar.gz"
+
+	exists, err := store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = store.Get(ctx, key)
+	assert.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	require.NoError(t, store.Put(ctx, key, []byte("bundle")))
+	exists, err = store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	data, err := store.Get(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bundle"), data)
+
+	require.NoError(t, store.Delete(ctx, key))
+	exists, err = store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	require.NoError(t, store.Delete(ctx, key), "deleting a missing blob is not an error")
+}
+
+func TestFS(t *testing.T) {
+	store, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	testStore(t, store)
+}
+
+func TestFS_RejectsKeysOutsideDir(t *testing.T) {
+	store, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assert.Error(t, store.Put(context.Background(), "../escape", []byte("x")))
+}
+
+// TestS3 runs against a local MinIO, e.g.
+// docker run -p 9000:9000 minio/minio server /data
+// BLOB_TEST_S3_ENDPOINT=localhost:9000 go test ./internal/blob
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("BLOB_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("BLOB_TEST_S3_ENDPOINT is not set")
+	}
+	store, err := NewS3(config.S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "bot-builder-test",
+		AccessKey: envOr("BLOB_TEST_S3_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("BLOB_TEST_S3_SECRET_KEY", "minioadmin"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.client.RemoveObject(context.Background(), store.bucket, "bundles/5d41402abc4b2a76b9719d911017c592.tar.gz", minio.RemoveObjectOptions{}))
+	testStore(t, store)
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -2,50 +2,185 @@ package bot
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sensority-labs/builder/internal/config"
 )
 
+// maxErrorBody limits how much of a core response body ends up in an error.
+const maxErrorBody = 1024
+
 type Config struct {
 	Envs map[string]string
 }
 
-func GetConfig(cfg *config.Config, userName, botName string) (*Config, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/customers/get-bot-config/%s/%s", cfg.CoreURL, userName, botName), nil)
-	if err != nil {
-		return nil, err
+// Desired states of a bot in core.
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// DesiredBot is core's record of a bot: the container it knows and the state the bot should be in.
+type DesiredBot struct {
+	UserName     string `json:"system_user_name"`
+	BotName      string `json:"bot_name"`
+	ContainerID  string `json:"container_id"`
+	DesiredState string `json:"desired_state"`
+}
+
+// Quota holds the limits core sets for a customer. Nil limits keep the builder's defaults, zero lifts a limit.
+type Quota struct {
+	MaxBots             *int     `json:"max_bots"`
+	MaxConcurrentBuilds *int     `json:"max_concurrent_builds"`
+	BuildsPerHour       *int     `json:"builds_per_hour"`
+	MaxMemory           *int64   `json:"max_memory"` // Bytes across all bots
+	MaxCPUs             *float64 `json:"max_cpus"`   // Across all bots
+	Priority            *string  `json:"priority"`   // Priority class of the customer's builds, e.g. high for paid tiers
+}
+
+// Core is the part of the core API the builder depends on.
+type Core interface {
+	// GetConfig returns the bot config of the customer's bot.
+	GetConfig(ctx context.Context, userName, botName string) (*Config, error)
+	// UpdateID registers the container running the customer's bot.
+	UpdateID(ctx context.Context, userName, botName, containerID string) error
+	// PostEvent sends a bot lifecycle event to the core webhook.
+	PostEvent(ctx context.Context, event any) error
+	// ListBots returns all bots core knows with their desired state.
+	ListBots(ctx context.Context) ([]DesiredBot, error)
+	// GetQuota returns the quota overrides of the customer.
+	GetQuota(ctx context.Context, userName string) (*Quota, error)
+}
+
+// StatusError is returned when core responds with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Token", cfg.ApiAccessToken)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	return fmt.Sprintf("unexpected status code: %d: %s", e.StatusCode, e.Body)
+}
+
+// IsRetryable reports whether a call to core failed transiently and is worth retrying:
+// core couldn't be reached, is overloaded or failed with a server error.
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
 	}
-	defer func(body io.ReadCloser) {
-		if err := body.Close(); err != nil {
-			fmt.Printf("Error closing response body: %v\n", err)
-		}
-	}(resp.Body)
+	// Transport failures such as refused connections and timeouts
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// Client calls the core API. Every attempt is bounded by the configured timeout and
+// idempotent calls are retried with jittered exponential backoff.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	retries int
+	backoff time.Duration
+	webhook string
+
+	// Bot configs are cached per customer/bot and revalidated with their ETag.
+	// A cached config validated within staleIfError is used while core fails transiently.
+	staleIfError time.Duration
+	mu           sync.Mutex
+	configs      map[string]cachedConfig
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+type cachedConfig struct {
+	etag        string
+	envs        map[string]string
+	validatedAt time.Time
+}
+
+var _ Core = (*Client)(nil)
+
+func NewClient(cfg *config.Config) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(cfg.CoreURL, "/"),
+		token:   cfg.ApiAccessToken,
+		http:    &http.Client{Timeout: cfg.Core.Timeout},
+		retries: cfg.Core.Retries,
+		backoff: cfg.Core.RetryBackoff,
+		webhook: cfg.Core.LifecycleWebhook,
+
+		staleIfError: cfg.Core.StaleIfError,
+		configs:      make(map[string]cachedConfig),
+	}
+}
+
+// GetConfig returns the bot config from core. A cached config is revalidated with If-None-Match and,
+// if core fails transiently, returned as long as it was validated within the stale-if-error window.
+func (c *Client) GetConfig(ctx context.Context, userName, botName string) (*Config, error) {
+	key := userName + "/" + botName
+	c.mu.Lock()
+	cached, ok := c.configs[key]
+	c.mu.Unlock()
+
+	header := make(http.Header)
+	if ok && cached.etag != "" {
+		header.Set("If-None-Match", cached.etag)
 	}
 
-	// Decode the response body into the Config struct
 	var botConfig Config
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&botConfig.Envs); err != nil {
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/customers/get-bot-config/%s/%s", userName, botName), nil, header, true, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotModified {
+			cached.validatedAt = time.Now()
+			botConfig.Envs = cached.envs
+			return nil
+		}
+		// Decode the response body into the Config struct
+		if err := json.NewDecoder(resp.Body).Decode(&botConfig.Envs); err != nil {
+			return err
+		}
+		cached = cachedConfig{etag: resp.Header.Get("ETag"), envs: botConfig.Envs, validatedAt: time.Now()}
+		return nil
+	})
+
+	switch {
+	case err == nil:
+		c.mu.Lock()
+		c.configs[key] = cached
+		c.mu.Unlock()
+	case ok && IsRetryable(err) && time.Since(cached.validatedAt) <= c.staleIfError:
+		log.Default().Printf("Core is unavailable, using the bot config of %s validated at %s: %v", key, cached.validatedAt.Format(time.RFC3339), err)
+		botConfig.Envs = cached.envs
+	default:
+		if !IsRetryable(err) {
+			// The bot may be gone from core, its config must not outlive it
+			c.mu.Lock()
+			delete(c.configs, key)
+			c.mu.Unlock()
+		}
 		return nil, err
 	}
 
+	botConfig.Envs = maps.Clone(botConfig.Envs)
 	return &botConfig, nil
 }
 
-func UpdateID(cfg *config.Config, userName, botName, containerID string) error {
+// UpdateID sets the bot's container ID in core. Setting the same ID twice has no further effect,
+// so the call is retried like a read.
+func (c *Client) UpdateID(ctx context.Context, userName, botName, containerID string) error {
 	payload := struct {
 		UserName    string `json:"system_user_name"`
 		BotName     string `json:"bot_name"`
@@ -59,13 +194,92 @@ func UpdateID(cfg *config.Config, userName, botName, containerID string) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/customers/set-bot-container-id/", cfg.CoreURL), bytes.NewReader(payloadBytes))
+	return c.do(ctx, http.MethodPost, "/customers/set-bot-container-id/", payloadBytes, nil, true, nil)
+}
+
+func (c *Client) ListBots(ctx context.Context) ([]DesiredBot, error) {
+	var bots []DesiredBot
+	err := c.do(ctx, http.MethodGet, "/customers/bots/", nil, nil, true, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&bots)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bots, nil
+}
+
+// GetQuota returns the customer's quota overrides from core. Customers core has no quota for get an empty one.
+func (c *Client) GetQuota(ctx context.Context, userName string) (*Quota, error) {
+	var quota Quota
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/customers/get-quota/%s/", userName), nil, nil, true, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&quota)
+	})
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return &Quota{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// PostEvent sends a lifecycle event to the core webhook. Events carry an ID core deduplicates on,
+// so the call is retried.
+func (c *Client) PostEvent(ctx context.Context, event any) error {
+	if c.webhook == "" {
+		return errors.New("core lifecycle webhook isn't configured")
+	}
+	payloadBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, c.webhook, payloadBytes, nil, true, nil)
+}
+
+// do sends a request to core and passes a 200 response, or a 304 response to a conditional request,
+// to handle, which may be nil. Idempotent requests that fail transiently are retried.
+func (c *Client) do(ctx context.Context, method, path string, payload []byte, header http.Header, idempotent bool, handle func(*http.Response) error) error {
+	attempts := 1
+	if idempotent {
+		attempts += c.retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := c.delay(attempt)
+			log.Default().Printf("Core %s %s failed, retrying in %s: %v", method, path, delay, err)
+			select {
+			case <-ctx.Done():
+				return errors.Join(err, ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+
+		err = c.attempt(ctx, method, path, payload, header, handle)
+		if !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, header http.Header, handle func(*http.Response) error) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
 	if err != nil {
 		return err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Token", cfg.ApiAccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("X-Token", c.token)
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return err
 	}
@@ -75,9 +289,24 @@ func UpdateID(cfg *config.Config, userName, botName, containerID string) error {
 		}
 	}(resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	notModified := resp.StatusCode == http.StatusNotModified && req.Header.Get("If-None-Match") != ""
+	if resp.StatusCode != http.StatusOK && !notModified {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
 	}
 
-	return nil
+	if handle == nil {
+		return nil
+	}
+	return handle(resp)
+}
+
+// delay returns the backoff before the given retry, with full jitter so that builders
+// retrying at the same time don't hit core in lockstep.
+func (c *Client) delay(attempt int) time.Duration {
+	ceiling := c.backoff << (attempt - 1)
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(ceiling)))
 }
@@ -1,31 +1,44 @@
 package bot_test
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sensority-labs/builder/internal/bot"
 	"github.com/sensority-labs/builder/internal/config"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestGetBotConfig_Success(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
+func newClient(coreURL string) *bot.Client {
+	return bot.NewClient(&config.Config{
+		CoreURL:        coreURL,
+		ApiAccessToken: "secret",
+		Core: config.CoreConfig{
+			Timeout:      time.Second,
+			Retries:      2,
+			RetryBackoff: time.Millisecond,
+		},
+	})
+}
 
+func TestGetBotConfig_Success(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, http.MethodGet, r.Method)
 		assert.Equal(t, "/customers/get-bot-config/testuser/testbot", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"key": "value"}`))
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	botConfig, err := bot.GetConfig(cfg, userName, botName)
+	botConfig, err := newClient(server.URL).GetConfig(context.Background(), "testuser", "testbot")
 
 	assert.NoError(t, err)
 	assert.NotNil(t, botConfig)
@@ -33,10 +46,6 @@ func TestGetBotConfig_Success(t *testing.T) {
 }
 
 func TestGetBotConfig_Empty(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, http.MethodGet, r.Method)
 		assert.Equal(t, "/customers/get-bot-config/testuser/testbot", r.URL.Path)
@@ -45,8 +54,7 @@ func TestGetBotConfig_Empty(t *testing.T) {
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	botConfig, err := bot.GetConfig(cfg, userName, botName)
+	botConfig, err := newClient(server.URL).GetConfig(context.Background(), "testuser", "testbot")
 
 	assert.NoError(t, err)
 	assert.NotNil(t, botConfig)
@@ -54,77 +62,120 @@ func TestGetBotConfig_Empty(t *testing.T) {
 }
 
 func TestGetBotConfig_HttpError(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-
+	var calls atomic.Int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
 		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("database is down"))
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	botConfig, err := bot.GetConfig(cfg, userName, botName)
+	botConfig, err := newClient(server.URL).GetConfig(context.Background(), "testuser", "testbot")
 
-	assert.Error(t, err)
+	assert.EqualError(t, err, "unexpected status code: 500: database is down")
 	assert.Nil(t, botConfig)
+	assert.Equal(t, int32(3), calls.Load(), "the first attempt and two retries")
 }
 
-func TestGetBotConfig_InvalidJson(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
+func TestGetBotConfig_RetrySucceeds(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"key": "value"}`))
+	}))
+	defer server.Close()
+
+	botConfig, err := newClient(server.URL).GetConfig(context.Background(), "testuser", "testbot")
 
+	assert.NoError(t, err)
+	assert.Equal(t, "value", botConfig.Envs["key"])
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestGetBotConfig_InvalidJson(t *testing.T) {
+	var calls atomic.Int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`invalid json`))
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	botConfig, err := bot.GetConfig(cfg, userName, botName)
+	botConfig, err := newClient(server.URL).GetConfig(context.Background(), "testuser", "testbot")
 
 	assert.Error(t, err)
 	assert.Nil(t, botConfig)
+	assert.Equal(t, int32(1), calls.Load())
 }
 
 func TestGetBotConfig_UnexpectedStatusCode(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-
+	var calls atomic.Int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
 		w.WriteHeader(http.StatusNotFound)
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	botConfig, err := bot.GetConfig(cfg, userName, botName)
+	botConfig, err := newClient(server.URL).GetConfig(context.Background(), "testuser", "testbot")
 
-	assert.Error(t, err)
+	var statusErr *bot.StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
 	assert.Nil(t, botConfig)
+	assert.Equal(t, int32(1), calls.Load(), "client errors aren't retried")
 }
 
 func TestGetBotConfig_RequestError(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
+	_, err := newClient("http://127.0.0.1:1").GetConfig(context.Background(), "testuser", "testbot")
 
-	_, err := bot.GetConfig(cfg, userName, botName)
+	assert.Error(t, err)
+	assert.True(t, bot.IsRetryable(err))
+}
+
+func TestGetBotConfig_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client := bot.NewClient(&config.Config{
+		CoreURL: server.URL,
+		Core:    config.CoreConfig{Timeout: 20 * time.Millisecond},
+	})
+	start := time.Now()
+	_, err := client.GetConfig(context.Background(), "testuser", "testbot")
 
 	assert.Error(t, err)
+	assert.True(t, bot.IsRetryable(err))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestGetBotConfig_ContextCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := bot.NewClient(&config.Config{
+		CoreURL: server.URL,
+		Core:    config.CoreConfig{Timeout: time.Second, Retries: 100, RetryBackoff: time.Hour},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.GetConfig(ctx, "testuser", "testbot")
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
 }
 
 func TestUpdateBotID_Success(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-	containerID := "container123"
 	payloadBytes := []byte(`{"system_user_name":"testuser","bot_name":"testbot","container_id":"container123"}`)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, http.MethodPost, r.Method)
-		assert.Equal(t, "/customers/set-bot-container-id", r.URL.Path)
+		assert.Equal(t, "/customers/set-bot-container-id/", r.URL.Path)
 		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
 		reqBody, err := io.ReadAll(r.Body)
 		assert.NoError(t, err)
@@ -133,53 +184,185 @@ func TestUpdateBotID_Success(t *testing.T) {
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	err := bot.UpdateID(cfg, userName, botName, containerID)
+	err := newClient(server.URL).UpdateID(context.Background(), "testuser", "testbot", "container123")
 
 	assert.NoError(t, err)
 }
 
 func TestUpdateBotID_HttpError(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-	containerID := "container123"
-
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	err := bot.UpdateID(cfg, userName, botName, containerID)
+	err := newClient(server.URL).UpdateID(context.Background(), "testuser", "testbot", "container123")
 
 	assert.Error(t, err)
+	assert.True(t, bot.IsRetryable(err))
 }
 
 func TestUpdateBotID_UnexpectedStatusCode(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-	containerID := "container123"
-
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"detail": "bot not found"}`))
 	}))
 	defer server.Close()
 
-	cfg.CoreURL = server.URL
-	err := bot.UpdateID(cfg, userName, botName, containerID)
+	err := newClient(server.URL).UpdateID(context.Background(), "testuser", "testbot", "container123")
 
-	assert.Error(t, err)
+	assert.EqualError(t, err, `unexpected status code: 404: {"detail": "bot not found"}`)
+	assert.False(t, bot.IsRetryable(err))
 }
 
 func TestUpdateBotID_RequestError(t *testing.T) {
-	cfg := &config.Config{CoreURL: "http://example.com"}
-	userName := "testuser"
-	botName := "testbot"
-	containerID := "container123"
+	err := newClient("http://127.0.0.1:1").UpdateID(context.Background(), "testuser", "testbot", "container123")
+
+	assert.Error(t, err)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, bot.IsRetryable(&url.Error{Op: "Post", URL: "http://core", Err: errors.New("connection refused")}))
+	assert.True(t, bot.IsRetryable(&bot.StatusError{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, bot.IsRetryable(&bot.StatusError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, bot.IsRetryable(&bot.StatusError{StatusCode: http.StatusBadRequest}))
+	assert.False(t, bot.IsRetryable(errors.New("invalid character 'i' looking for beginning of value")))
+	assert.False(t, bot.IsRetryable(nil))
+}
+
+func TestGetBotConfig_RevalidatesWithETag(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"key": "value"}`))
+	}))
+	defer server.Close()
+	client := newClient(server.URL)
 
-	err := bot.UpdateID(cfg, userName, botName, containerID)
+	first, err := client.GetConfig(context.Background(), "testuser", "testbot")
+	assert.NoError(t, err)
+	second, err := client.GetConfig(context.Background(), "testuser", "testbot")
+	assert.NoError(t, err)
 
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, first.Envs, second.Envs)
+	assert.Equal(t, "value", second.Envs["key"])
+}
+
+func TestGetBotConfig_StaleIfError(t *testing.T) {
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"key": "value"}`))
+	}))
+	defer server.Close()
+	newClient := func(staleIfError time.Duration) *bot.Client {
+		return bot.NewClient(&config.Config{
+			CoreURL: server.URL,
+			Core:    config.CoreConfig{Timeout: time.Second, StaleIfError: staleIfError},
+		})
+	}
+
+	t.Run("within window", func(t *testing.T) {
+		down.Store(false)
+		client := newClient(time.Minute)
+		_, err := client.GetConfig(context.Background(), "testuser", "testbot")
+		assert.NoError(t, err)
+
+		down.Store(true)
+		botConfig, err := client.GetConfig(context.Background(), "testuser", "testbot")
+		assert.NoError(t, err)
+		assert.Equal(t, "value", botConfig.Envs["key"])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		down.Store(false)
+		client := newClient(0)
+		_, err := client.GetConfig(context.Background(), "testuser", "testbot")
+		assert.NoError(t, err)
+
+		down.Store(true)
+		_, err = client.GetConfig(context.Background(), "testuser", "testbot")
+		assert.Error(t, err)
+	})
+}
+
+func TestGetBotConfig_NotFoundDropsCache(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Write([]byte(`{"key": "value"}`))
+	}))
+	defer server.Close()
+	client := bot.NewClient(&config.Config{
+		CoreURL: server.URL,
+		Core:    config.CoreConfig{Timeout: time.Second, StaleIfError: time.Hour},
+	})
+
+	_, err := client.GetConfig(context.Background(), "testuser", "testbot")
+	assert.NoError(t, err)
+
+	status.Store(http.StatusNotFound)
+	_, err = client.GetConfig(context.Background(), "testuser", "testbot")
 	assert.Error(t, err)
+
+	status.Store(http.StatusServiceUnavailable)
+	_, err = client.GetConfig(context.Background(), "testuser", "testbot")
+	assert.Error(t, err, "the config of a bot deleted in core isn't served stale")
+}
+
+func TestListBots(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/customers/bots/", r.URL.Path)
+		w.Write([]byte(`[{"system_user_name": "acme", "bot_name": "mybot", "container_id": "c1", "desired_state": "running"}]`))
+	}))
+	defer server.Close()
+
+	bots, err := newClient(server.URL).ListBots(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []bot.DesiredBot{{UserName: "acme", BotName: "mybot", ContainerID: "c1", DesiredState: bot.DesiredRunning}}, bots)
+}
+
+func TestGetQuota(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/customers/get-quota/acme/", r.URL.Path)
+		w.Write([]byte(`{"max_bots": 20, "max_cpus": 4.5}`))
+	}))
+	defer server.Close()
+
+	quota, err := newClient(server.URL).GetQuota(context.Background(), "acme")
+
+	assert.NoError(t, err)
+	if assert.NotNil(t, quota.MaxBots) && assert.NotNil(t, quota.MaxCPUs) {
+		assert.Equal(t, 20, *quota.MaxBots)
+		assert.Equal(t, 4.5, *quota.MaxCPUs)
+	}
+	assert.Nil(t, quota.BuildsPerHour)
+}
+
+func TestGetQuota_NotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	quota, err := newClient(server.URL).GetQuota(context.Background(), "acme")
+
+	assert.NoError(t, err)
+	assert.Equal(t, &bot.Quota{}, quota)
 }
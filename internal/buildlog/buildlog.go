@@ -0,0 +1,157 @@
+package buildlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// truncatedNote ends logs that reached the size cap.
+const truncatedNote = "\n[log truncated: size limit reached]\n"
+
+// Store keeps the log of every build job as a file in its directory.
+type Store struct {
+	dir       string
+	maxSize   int64
+	retention time.Duration
+}
+
+// New opens the log store in dir. Logs are capped at maxSize bytes and removed after retention.
+// Zero maxSize or retention disables the limit.
+func New(dir string, maxSize int64, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, maxSize: maxSize, retention: retention}, nil
+}
+
+// Path returns the file of the job's log.
+func (s *Store) Path(jobID string) string {
+	return filepath.Join(s.dir, jobID+".log")
+}
+
+// Create opens the job's log for writing. Writes append to an existing log, so a build
+// resumed after a restart keeps its earlier output.
+func (s *Store) Create(jobID string) (*Writer, error) {
+	f, err := os.OpenFile(s.Path(jobID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := info.Size()
+	return &Writer{f: f, size: size, maxSize: s.maxSize, truncated: s.maxSize > 0 && size >= s.maxSize}, nil
+}
+
+// Open returns the job's log for reading.
+func (s *Store) Open(jobID string) (*os.File, error) {
+	// Job IDs come from requests, they must not point outside the store
+	if jobID == "" || strings.ContainsAny(jobID, `/\.`) {
+		return nil, errdefs.NotFound(fmt.Errorf("no log for job %q", jobID))
+	}
+	f, err := os.Open(s.Path(jobID))
+	if os.IsNotExist(err) {
+		return nil, errdefs.NotFound(fmt.Errorf("no log for job %s, it may have expired", jobID))
+	}
+	return f, err
+}
+
+// Prune removes the logs last written before the retention period.
+func (s *Store) Prune(now time.Time) error {
+	if s.retention <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() || now.Sub(info.ModTime()) < s.retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run prunes expired logs every interval until ctx is done.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Prune(time.Now()); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: pruning build logs: %+v", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Writer writes a job's log up to the size cap. Output past the cap is dropped, so a
+// runaway build can't fill the disk and doesn't fail because of its log.
+type Writer struct {
+	mu        sync.Mutex
+	f         *os.File
+	size      int64
+	maxSize   int64
+	truncated bool
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(p)
+	if w.truncated {
+		return n, nil
+	}
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize {
+		p = p[:max(w.maxSize-w.size, 0)]
+		w.truncated = true
+	}
+	written, err := w.f.Write(p)
+	w.size += int64(written)
+	if err != nil {
+		return written, err
+	}
+	if w.truncated {
+		if _, err := io.WriteString(w.f, truncatedNote); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Printf writes a line to the log.
+func (w *Writer) Printf(format string, args ...any) {
+	if _, err := fmt.Fprintf(w, time.Now().UTC().Format(time.RFC3339)+" "+format+"\n", args...); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: writing build log: %+v", err))
+	}
+}
+
+func (w *Writer) Close() error {
+	return w.f.Close()
+}
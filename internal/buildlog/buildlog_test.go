@@ -0,0 +1,91 @@
+package buildlog
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLog(t *testing.T, store *Store, jobID string) string {
+	f, err := store.Open(jobID)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestWriter_SizeCap(t *testing.T) {
+	store, err := New(t.TempDir(), 10, 0)
+	require.NoError(t, err)
+
+	w, err := store.Create("job1")
+	require.NoError(t, err)
+	n, err := w.Write([]byte("0123456"))
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+	n, err = w.Write([]byte("789abcdef"))
+	require.NoError(t, err)
+	assert.Equal(t, 9, n, "dropped output is reported as written")
+	_, err = w.Write([]byte("more"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// A reopened log that is full stays full
+	w, err = store.Create("job1")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("after restart"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, "0123456789"+truncatedNote, readLog(t, store, "job1"))
+}
+
+func TestWriter_Appends(t *testing.T) {
+	store, err := New(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	for _, line := range []string{"first", "second"} {
+		w, err := store.Create("job1")
+		require.NoError(t, err)
+		w.Printf("%s line", line)
+		require.NoError(t, w.Close())
+	}
+
+	lines := strings.Split(strings.TrimSpace(readLog(t, store, "job1")), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], " first line"))
+	assert.True(t, strings.HasSuffix(lines[1], " second line"))
+}
+
+func TestStore_Prune(t *testing.T) {
+	store, err := New(t.TempDir(), 0, 24*time.Hour)
+	require.NoError(t, err)
+	for _, jobID := range []string{"old", "new"} {
+		w, err := store.Create(jobID)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(store.Path("old"), old, old))
+
+	require.NoError(t, store.Prune(time.Now()))
+
+	_, err = store.Open("old")
+	assert.True(t, errdefs.IsNotFound(err))
+	assert.FileExists(t, store.Path("new"))
+}
+
+func TestStore_Open_RejectsPaths(t *testing.T) {
+	store, err := New(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	for _, jobID := range []string{"", "../builder", "a/b"} {
+		_, err := store.Open(jobID)
+		assert.True(t, errdefs.IsNotFound(err), jobID)
+	}
+}
@@ -1,28 +1,116 @@
 package config
 
 import (
+	"time"
+
 	"github.com/cristalhq/aconfig"
 )
 
 type Config struct {
-	Debug          bool   `default:"false"`
-	GithubToken    string `required:"true"`
-	Port           string `default:"5005"`
-	CoreURL        string `default:"http://core:8000"`
-	ApiAccessToken string `required:"true"`
-	NetworkName    string `default:"sensority-labs"`
+	Debug          bool          `default:"false"`
+	GithubToken    string        `required:"true"`
+	Port           string        `default:"5005"`
+	CoreURL        string        `default:"http://core:8000"`
+	ApiAccessToken string        `required:"true"`
+	NetworkName    string        `default:"sensority-labs"`
+	IdempotencyTTL time.Duration `default:"24h"`                  // How long build results are kept for Idempotency-Key replays
+	DataDir        string        `default:"/var/lib/bot-builder"` // Directory for state that has to survive restarts
+	OutboxInterval time.Duration `default:"10s"`                  // How often pending core callbacks are retried
+	JobRetention   time.Duration `default:"720h"`                 // How long finished build jobs are kept. Zero keeps them forever
+	Core           CoreConfig
 	Bot            BotConfig
 	Stream         StreamConfig
+	Cradle         CradleConfig
+	Reconcile      ReconcileConfig
+	BuildLog       BuildLogConfig
+	Blob           BlobConfig
+	Fleet          FleetConfig
+	Quota          QuotaConfig
+	Scheduler      SchedulerConfig
+}
+
+type CoreConfig struct {
+	Timeout      time.Duration `default:"10s"`   // Timeout of a single request to core
+	Retries      int           `default:"3"`     // Retries of idempotent requests that failed transiently
+	RetryBackoff time.Duration `default:"200ms"` // Upper bound of the first retry delay, doubles with every retry
+	StaleIfError time.Duration `default:"10m"`   // How long a cached bot config is used while core is unavailable
+
+	LifecycleWebhook string // Core path bot lifecycle events are posted to, e.g. /customers/bot-events/. Empty disables it
+}
+
+type ReconcileConfig struct {
+	Mode          string        `default:"report"` // off, report (only log the drift) or apply (converge)
+	Interval      time.Duration `default:"5m"`
+	RemoveOrphans bool          `default:"false"` // Remove containers of bots core doesn't know
+
+	// Share of the bot containers above which orphans aren't removed. Zero disables the limit
+	MaxRemovePercent int `default:"10"`
+}
+
+type BuildLogConfig struct {
+	MaxSize   int64         `default:"10485760"` // Max size in bytes of a build log, the rest of the output is dropped
+	Retention time.Duration `default:"720h"`     // How long build logs are kept. Zero keeps them forever
+}
+
+// FleetConfig holds the defaults of fleet operations, a request can override them.
+type FleetConfig struct {
+	Concurrency   int           `default:"2"`  // Bots rolled out at once
+	MaxFailures   int           `default:"1"`  // Failures after which a rollout pauses
+	HealthTimeout time.Duration `default:"2m"` // How long a bot has to become healthy after its rollout
+	BatchInterval time.Duration `default:"0s"` // Pause between batches, limits the rate of a rollout
+}
+
+// QuotaConfig holds the default quotas of every customer, core can override them per customer. Zero disables a limit.
+type QuotaConfig struct {
+	MaxBots             int     `default:"0"` // Bots a customer may have
+	MaxConcurrentBuilds int     `default:"0"` // Builds of a customer's bots at once
+	BuildsPerHour       int     `default:"0"`
+	MaxMemory           int64   `default:"0"`                // Bytes of memory across a customer's bots
+	MaxCPUs             float64 `default:"0" env:"MAX_CPUS"` // CPUs across a customer's bots
+}
+
+// SchedulerConfig holds the settings of the build queue.
+type SchedulerConfig struct {
+	Workers int `default:"4"` // Builds run at once, the others wait in the queue
+}
+
+type BlobConfig struct {
+	Backend string `default:"fs"` // fs or s3. Uploaded bundles are archived there
+	Dir     string // Directory of the fs backend. Defaults to <DATA_DIR>/blobs
+	S3      S3Config
+}
+
+type S3Config struct {
+	Endpoint  string // host:port of an S3-compatible object store
+	Bucket    string `default:"bot-builder"`
+	AccessKey string
+	SecretKey string
+	Region    string
+	Secure    bool `default:"true"` // Use HTTPS
 }
 
 type StreamConfig struct {
 	NatsURL            string `default:"nats://nats:4222"`
 	EventStreamName    string `default:"ethereum_events"`
 	FindingsStreamName string `default:"findings"`
+	LifecycleSubject   string `default:"bots.lifecycle"` // NATS subject prefix of bot lifecycle events. Empty disables them
+}
+
+type CradleConfig struct {
+	Default   string `default:"ts"`
+	Templates string // Path to a JSON file with the cradle template registry
+	CacheDir  string // Directory with bare mirrors of cradle repos. Defaults to <tmp>/cradle-mirrors
 }
 
 type BotConfig struct {
 	SentryDSN string
+	BuildArgs map[string]string // Build args for every bot image, as KEY:value,KEY2:value2
+
+	MaxEnvValueSize int `default:"32768"` // Max size in bytes of an env value from core
+
+	// Resource limits of bot containers. Zero means no limit
+	Memory int64   // Bytes
+	CPUs   float64 `env:"CPUS"` // Number of CPUs, e.g. 0.5
 }
 
 func GetConfig() (*Config, error) {
@@ -0,0 +1,136 @@
+package cradle
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/sensority-labs/builder/internal/gitauth"
+)
+
+const (
+	defaultTemplateName = "ts"
+	defaultTemplateURL  = "https://github.com/sensority-labs/cradle-ts.git"
+)
+
+// Image labels recording which cradle an image was built from.
+const (
+	LabelTemplate = "sensority.cradle.template"
+	LabelRef      = "sensority.cradle.ref"
+	LabelCommit   = "sensority.cradle.commit"
+)
+
+// Template is a cradle repository bots can be built on top of.
+// Ref pins the template to a branch, tag or commit. An empty Ref means the default branch.
+// Auth selects how the repository is accessed, by default with the builder's GitHub token.
+type Template struct {
+	Name        string           `json:"-"`
+	URL         string           `json:"url"`
+	Ref         string           `json:"ref"`
+	Auth        *gitauth.Config  `json:"auth"`
+	Credentials gitauth.Provider `json:"-"`
+}
+
+// Registry holds the named cradle templates available for builds.
+type Registry struct {
+	defaultName string
+	templates   map[string]Template
+}
+
+func NewRegistry(cfg *config.Config) (*Registry, error) {
+	templates := map[string]Template{
+		defaultTemplateName: {Name: defaultTemplateName, URL: defaultTemplateURL},
+	}
+	if cfg.Cradle.Templates != "" {
+		loaded, err := loadTemplates(cfg.Cradle.Templates)
+		if err != nil {
+			return nil, err
+		}
+		templates = loaded
+	}
+
+	for name, tmpl := range templates {
+		credentials, err := gitauth.New(tmpl.Auth, cfg.GithubToken)
+		if err != nil {
+			return nil, fmt.Errorf("cradle template %q: %w", name, err)
+		}
+		tmpl.Credentials = credentials
+		templates[name] = tmpl
+	}
+
+	if _, ok := templates[cfg.Cradle.Default]; !ok {
+		return nil, fmt.Errorf("default cradle template %q is not in the registry", cfg.Cradle.Default)
+	}
+
+	return &Registry{defaultName: cfg.Cradle.Default, templates: templates}, nil
+}
+
+// loadTemplates reads a JSON object of the form {"ts": {"url": "...", "ref": "..."}}.
+func loadTemplates(filePath string) (map[string]Template, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates map[string]Template
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse cradle templates %s: %w", filePath, err)
+	}
+	for name, tmpl := range templates {
+		if tmpl.URL == "" {
+			return nil, fmt.Errorf("cradle template %q has no url", name)
+		}
+		tmpl.Name = name
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// Get returns the template with the given name, or the default template if the name is empty.
+func (r *Registry) Get(name string) (Template, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	tmpl, ok := r.templates[name]
+	if !ok {
+		return Template{}, errs.Validation("unknown cradle template %q", name)
+	}
+	return tmpl, nil
+}
+
+// Names returns the names of all registered templates in sorted order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checkout is a cradle working tree checked out at an exact commit.
+type Checkout struct {
+	Path     string
+	Template string
+	Ref      string
+	Commit   string
+}
+
+// Labels returns the image labels recording the cradle revision of a build.
+func (c *Checkout) Labels() map[string]string {
+	return map[string]string{
+		LabelTemplate: c.Template,
+		LabelRef:      c.Ref,
+		LabelCommit:   c.Commit,
+	}
+}
+
+func refOrHead(ref string) string {
+	if ref == "" {
+		return "HEAD"
+	}
+	return ref
+}
@@ -0,0 +1,75 @@
+package cradle_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRegistry_Default(t *testing.T) {
+	cfg := &config.Config{Cradle: config.CradleConfig{Default: "ts"}}
+
+	registry, err := cradle.NewRegistry(cfg)
+
+	assert.NoError(t, err)
+	tmpl, err := registry.Get("")
+	assert.NoError(t, err)
+	assert.Equal(t, "ts", tmpl.Name)
+	assert.Equal(t, "https://github.com/sensority-labs/cradle-ts.git", tmpl.URL)
+}
+
+func TestNewRegistry_FromFile(t *testing.T) {
+	templatesPath := filepath.Join(t.TempDir(), "cradles.json")
+	err := os.WriteFile(templatesPath, []byte(`{
+		"ts": {"url": "https://example.com/cradle-ts.git", "ref": "v1.2.0"},
+		"python": {"url": "https://example.com/cradle-python.git", "ref": "0a1b2c3"}
+	}`), 0644)
+	assert.NoError(t, err)
+	cfg := &config.Config{Cradle: config.CradleConfig{Default: "python", Templates: templatesPath}}
+
+	registry, err := cradle.NewRegistry(cfg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"python", "ts"}, registry.Names())
+	tmpl, err := registry.Get("")
+	assert.NoError(t, err)
+	assert.Equal(t, "python", tmpl.Name)
+	assert.Equal(t, "0a1b2c3", tmpl.Ref)
+	tmpl, err = registry.Get("ts")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.0", tmpl.Ref)
+}
+
+func TestNewRegistry_UnknownDefault(t *testing.T) {
+	cfg := &config.Config{Cradle: config.CradleConfig{Default: "go"}}
+
+	registry, err := cradle.NewRegistry(cfg)
+
+	assert.Error(t, err)
+	assert.Nil(t, registry)
+}
+
+func TestRegistry_UnknownTemplate(t *testing.T) {
+	cfg := &config.Config{Cradle: config.CradleConfig{Default: "ts"}}
+	registry, err := cradle.NewRegistry(cfg)
+	assert.NoError(t, err)
+
+	_, err = registry.Get("rust")
+
+	assert.Error(t, err)
+}
+
+func TestNewRegistry_MissingURL(t *testing.T) {
+	templatesPath := filepath.Join(t.TempDir(), "cradles.json")
+	err := os.WriteFile(templatesPath, []byte(`{"ts": {"ref": "main"}}`), 0644)
+	assert.NoError(t, err)
+	cfg := &config.Config{Cradle: config.CradleConfig{Default: "ts", Templates: templatesPath}}
+
+	_, err = cradle.NewRegistry(cfg)
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,234 @@
+package cradle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/errs"
+
+	gitconfig "github.com/go-git/go-git/v5/config"
+)
+
+// fetchedMarker is touched inside a mirror after every successful fetch.
+const fetchedMarker = "BUILDER_FETCHED"
+
+// Mirrors keeps a local bare mirror of every cradle repository and exports checkouts from it.
+// Mirrors are fetched incrementally before each checkout. When the remote is unreachable
+// the last successfully fetched mirror is used instead.
+type Mirrors struct {
+	dir string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewMirrors(cfg *config.Config) (*Mirrors, error) {
+	dir := cfg.Cradle.CacheDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "cradle-mirrors")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Mirrors{
+		dir:   dir,
+		locks: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// lock serializes fetches and exports of a single template's mirror.
+func (m *Mirrors) lock(name string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[name] = l
+	}
+	m.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func auth(tmpl Template) (transport.AuthMethod, error) {
+	if tmpl.Credentials == nil {
+		return nil, nil
+	}
+	return tmpl.Credentials.AuthMethod(context.Background())
+}
+
+// Checkout exports the template at ref into dst. If ref is empty the template's pinned ref is used.
+// The export contains the working tree only, without any git metadata.
+func (m *Mirrors) Checkout(tmpl Template, ref, dst string) (*Checkout, error) {
+	if ref == "" {
+		ref = tmpl.Ref
+	}
+
+	// The lock is held until the tree is exported, so a concurrent fetch can't rewrite the mirror mid-read
+	unlock := m.lock(tmpl.Name)
+	defer unlock()
+	repo, err := m.sync(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := resolve(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if err := export(tree, dst); err != nil {
+		return nil, fmt.Errorf("failed to export cradle %s at %s: %w", tmpl.Name, hash, err)
+	}
+	log.Printf("Cradle %s exported at %s (%s) to the path: %s\n", tmpl.Name, hash, refOrHead(ref), dst)
+
+	return &Checkout{
+		Path:     dst,
+		Template: tmpl.Name,
+		Ref:      refOrHead(ref),
+		Commit:   hash.String(),
+	}, nil
+}
+
+// sync brings the template's mirror up to date, creating it on first use.
+func (m *Mirrors) sync(tmpl Template) (*git.Repository, error) {
+	mirrorPath := filepath.Join(m.dir, tmpl.Name+".git")
+
+	repo, err := git.PlainOpen(mirrorPath)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return m.create(tmpl, mirrorPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	authMethod, err := auth(tmpl)
+	if err != nil {
+		log.Printf("Failed to get credentials for cradle %s, using the mirror fetched at %s: %v\n", tmpl.Name, lastFetched(mirrorPath), err)
+		return repo, nil
+	}
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []gitconfig.RefSpec{"+refs/*:refs/*"},
+		Auth:       authMethod,
+		Force:      true,
+		Tags:       git.AllTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		log.Printf("Failed to fetch cradle %s, using the mirror fetched at %s: %v\n", tmpl.Name, lastFetched(mirrorPath), err)
+		return repo, nil
+	}
+	touchFetched(mirrorPath)
+	return repo, nil
+}
+
+// create clones a new mirror next to its final location and moves it in place
+// only when the clone has finished, so an interrupted clone never leaves a broken mirror.
+func (m *Mirrors) create(tmpl Template, mirrorPath string) (*git.Repository, error) {
+	log.Printf("Creating cradle mirror %s from %s\n", mirrorPath, tmpl.URL)
+	tmpPath, err := os.MkdirTemp(m.dir, tmpl.Name+".git-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	authMethod, err := auth(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := git.PlainClone(tmpPath, true, &git.CloneOptions{
+		URL:    tmpl.URL,
+		Auth:   authMethod,
+		Mirror: true,
+	}); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, mirrorPath); err != nil {
+		return nil, err
+	}
+	touchFetched(mirrorPath)
+
+	return git.PlainOpen(mirrorPath)
+}
+
+func touchFetched(mirrorPath string) {
+	if err := os.WriteFile(filepath.Join(mirrorPath, fetchedMarker), []byte(time.Now().UTC().Format(time.RFC3339)), 0644); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+}
+
+func lastFetched(mirrorPath string) string {
+	data, err := os.ReadFile(filepath.Join(mirrorPath, fetchedMarker))
+	if err != nil {
+		return "unknown time"
+	}
+	return string(data)
+}
+
+// export writes all files of the tree into dst.
+func export(tree *object.Tree, dst string) error {
+	return tree.Files().ForEach(func(f *object.File) error {
+		target := filepath.Join(dst, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if f.Mode == filemode.Symlink {
+			link, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+
+		perm := os.FileMode(0644)
+		if f.Mode == filemode.Executable {
+			perm = 0755
+		}
+		reader, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, reader); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// resolve finds the commit for a branch, tag or (possibly abbreviated) commit hash.
+func resolve(repo *git.Repository, ref string) (*plumbing.Hash, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(refOrHead(ref)))
+	if err != nil {
+		return nil, errs.Validation("cradle revision %q not found: %v", ref, err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,211 @@
+package cradle_test
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/gitauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSourceRepo creates a local repository standing in for a remote cradle.
+func newSourceRepo(t *testing.T) (string, *git.Repository) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary is required for the local file transport")
+	}
+	repoPath := t.TempDir()
+	repo, err := git.PlainInit(repoPath, false)
+	require.NoError(t, err)
+	return repoPath, repo
+}
+
+func commitFile(t *testing.T, repoPath string, repo *git.Repository, name, content string) string {
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644))
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	_, err = worktree.Add(name)
+	require.NoError(t, err)
+	hash, err := worktree.Commit("update "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+	return hash.String()
+}
+
+func newMirrors(t *testing.T) *cradle.Mirrors {
+	mirrors, err := cradle.NewMirrors(&config.Config{Cradle: config.CradleConfig{CacheDir: t.TempDir()}})
+	require.NoError(t, err)
+	return mirrors
+}
+
+func readFile(t *testing.T, filePath string) string {
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestMirrors_Checkout(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	first := commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	_, err := repo.CreateTag("v1.0.0", plumbing.NewHash(first), nil)
+	require.NoError(t, err)
+	second := commitFile(t, repoPath, repo, "Dockerfile", "FROM node:22\n")
+	mirrors := newMirrors(t)
+	tmpl := cradle.Template{Name: "ts", URL: repoPath}
+
+	dst := t.TempDir()
+	checkout, err := mirrors.Checkout(tmpl, "", dst)
+
+	require.NoError(t, err)
+	assert.Equal(t, second, checkout.Commit)
+	assert.Equal(t, "HEAD", checkout.Ref)
+	assert.Equal(t, "FROM node:22\n", readFile(t, filepath.Join(dst, "Dockerfile")))
+	assert.NoDirExists(t, filepath.Join(dst, ".git"))
+}
+
+func TestMirrors_CheckoutPinnedRef(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	first := commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	_, err := repo.CreateTag("v1.0.0", plumbing.NewHash(first), nil)
+	require.NoError(t, err)
+	commitFile(t, repoPath, repo, "Dockerfile", "FROM node:22\n")
+	mirrors := newMirrors(t)
+
+	for _, ref := range []string{"v1.0.0", first, first[:7]} {
+		dst := t.TempDir()
+		checkout, err := mirrors.Checkout(cradle.Template{Name: "ts", URL: repoPath, Ref: ref}, "", dst)
+
+		require.NoError(t, err)
+		assert.Equal(t, first, checkout.Commit)
+		assert.Equal(t, ref, checkout.Ref)
+		assert.Equal(t, "FROM node:20\n", readFile(t, filepath.Join(dst, "Dockerfile")))
+	}
+}
+
+func TestMirrors_CheckoutUnknownRef(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	mirrors := newMirrors(t)
+
+	_, err := mirrors.Checkout(cradle.Template{Name: "ts", URL: repoPath}, "no-such-branch", t.TempDir())
+
+	assert.Error(t, err)
+}
+
+func TestMirrors_IncrementalFetch(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	mirrors := newMirrors(t)
+	tmpl := cradle.Template{Name: "ts", URL: repoPath}
+	_, err := mirrors.Checkout(tmpl, "", t.TempDir())
+	require.NoError(t, err)
+
+	latest := commitFile(t, repoPath, repo, "Dockerfile", "FROM node:22\n")
+	checkout, err := mirrors.Checkout(tmpl, "", t.TempDir())
+
+	require.NoError(t, err)
+	assert.Equal(t, latest, checkout.Commit)
+}
+
+func TestMirrors_ConcurrentCheckouts(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	mirrors := newMirrors(t)
+	tmpl := cradle.Template{Name: "ts", URL: repoPath}
+	_, err := mirrors.Checkout(tmpl, "", t.TempDir())
+	require.NoError(t, err)
+	commitFile(t, repoPath, repo, "Dockerfile", "FROM node:22\n")
+
+	var wg sync.WaitGroup
+	for range 4 {
+		dst := t.TempDir()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkout, err := mirrors.Checkout(tmpl, "", dst)
+			if assert.NoError(t, err) {
+				assert.NotEmpty(t, checkout.Commit)
+				assert.FileExists(t, filepath.Join(dst, "Dockerfile"))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMirrors_FallbackWhenRemoteUnreachable(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	hash := commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	mirrors := newMirrors(t)
+	tmpl := cradle.Template{Name: "ts", URL: repoPath}
+	_, err := mirrors.Checkout(tmpl, "", t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, os.RemoveAll(repoPath))
+	dst := t.TempDir()
+	checkout, err := mirrors.Checkout(tmpl, "", dst)
+
+	require.NoError(t, err)
+	assert.Equal(t, hash, checkout.Commit)
+	assert.Equal(t, "FROM node:20\n", readFile(t, filepath.Join(dst, "Dockerfile")))
+}
+
+func TestMirrors_NoMirrorAndUnreachableRemote(t *testing.T) {
+	_, _ = newSourceRepo(t)
+	mirrors := newMirrors(t)
+
+	_, err := mirrors.Checkout(cradle.Template{Name: "ts", URL: filepath.Join(t.TempDir(), "missing")}, "", t.TempDir())
+
+	assert.Error(t, err)
+}
+
+// newGitServer serves the repositories in root over smart HTTP and only lets in requests with the given token.
+func newGitServer(t *testing.T, root, token string) *httptest.Server {
+	gitPath, err := exec.LookPath("git")
+	require.NoError(t, err)
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || password != token {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMirrors_TemplateCredentials(t *testing.T) {
+	repoPath, repo := newSourceRepo(t)
+	hash := commitFile(t, repoPath, repo, "Dockerfile", "FROM node:20\n")
+	server := newGitServer(t, filepath.Dir(repoPath), "s3cret")
+	url := server.URL + "/" + filepath.Base(repoPath)
+
+	credentials, err := gitauth.New(&gitauth.Config{Type: gitauth.TypeToken, Token: "s3cret"}, "")
+	require.NoError(t, err)
+	checkout, err := newMirrors(t).Checkout(cradle.Template{Name: "ts", URL: url, Credentials: credentials}, "", t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, hash, checkout.Commit)
+
+	credentials, err = gitauth.New(&gitauth.Config{Type: gitauth.TypeToken, Token: "wrong"}, "")
+	require.NoError(t, err)
+	_, err = newMirrors(t).Checkout(cradle.Template{Name: "ts", URL: url, Credentials: credentials}, "", t.TempDir())
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package customers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Customer statuses.
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusPurged    = "purged"
+)
+
+var bucketCustomers = []byte("customers")
+
+// Customer is the account state of a customer. Only customers that aren't active are stored.
+type Customer struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+
+	// Running are the bots that were running when the customer was suspended, resuming starts them again
+	Running []string `json:"running,omitempty"`
+
+	SuspendedAt *time.Time `json:"suspendedAt,omitempty"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+// Active reports whether the customer's bots may be built and run.
+func (c *Customer) Active() bool {
+	return c.Status == StatusActive
+}
+
+// Store persists customer states in a bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the customer store at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening customer store %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketCustomers)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the customer's state. Unknown customers are active.
+func (s *Store) Get(name string) (*Customer, error) {
+	var customer *Customer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		customer, err = get(tx, name)
+		return err
+	})
+	return customer, err
+}
+
+// Update applies fn to the customer's state and saves it. A customer that fn makes active is removed.
+func (s *Store) Update(name string, fn func(*Customer)) (*Customer, error) {
+	var customer *Customer
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if customer, err = get(tx, name); err != nil {
+			return err
+		}
+		fn(customer)
+		customer.Name = name
+		customer.UpdatedAt = time.Now().UTC()
+		if customer.Active() {
+			return tx.Bucket(bucketCustomers).Delete([]byte(name))
+		}
+		data, err := json.Marshal(customer)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketCustomers).Put([]byte(name), data)
+	})
+	return customer, err
+}
+
+func get(tx *bolt.Tx, name string) (*Customer, error) {
+	data := tx.Bucket(bucketCustomers).Get([]byte(name))
+	if data == nil {
+		return &Customer{Name: name, Status: StatusActive}, nil
+	}
+	var customer Customer
+	if err := json.Unmarshal(data, &customer); err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
@@ -0,0 +1,44 @@
+package customers
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_SuspendAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "customers.db")
+	store, err := Open(path)
+	require.NoError(t, err)
+
+	customer, err := store.Get("acme")
+	require.NoError(t, err)
+	assert.True(t, customer.Active())
+
+	now := time.Now().UTC()
+	_, err = store.Update("acme", func(c *Customer) {
+		c.Status, c.Reason, c.SuspendedAt = StatusSuspended, "unpaid", &now
+		c.Running = []string{"mybot"}
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+	customer, err = store.Get("acme")
+	require.NoError(t, err)
+	assert.False(t, customer.Active())
+	assert.Equal(t, "unpaid", customer.Reason)
+	assert.Equal(t, []string{"mybot"}, customer.Running)
+
+	customer, err = store.Update("acme", func(c *Customer) { c.Status = StatusActive })
+	require.NoError(t, err)
+	assert.True(t, customer.Active())
+	customer, err = store.Get("acme")
+	require.NoError(t, err)
+	assert.Empty(t, customer.Running, "active customers aren't stored")
+}
@@ -0,0 +1,194 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// LabelBuildHash is the image label holding the content hash of the build inputs.
+const LabelBuildHash = "sensority.build.hash"
+
+// BuildHash computes a content hash over everything that determines a bot image:
+// the bot source code, the cradle commit, the base images and the build args.
+// It returns an empty hash if a base image is not available locally, since the
+// image it resolves to during the build is unknown.
+func (c *Client) BuildHash(contextPath, sourcePath, cradleCommit string, buildArgs map[string]string) (string, error) {
+	h := sha256.New()
+
+	if _, err := fmt.Fprintf(h, "cradle %s\n", cradleCommit); err != nil {
+		return "", err
+	}
+
+	baseImages, err := baseImages(filepath.Join(contextPath, "Dockerfile"), buildArgs)
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range baseImages {
+		img, _, err := c.cl.ImageInspectWithRaw(context.Background(), ref)
+		if client.IsErrNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := fmt.Fprintf(h, "base %s %s\n", ref, img.ID); err != nil {
+			return "", err
+		}
+	}
+
+	keys := make([]string, 0, len(buildArgs))
+	for k := range buildArgs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(h, "arg %s=%s\n", k, buildArgs[k]); err != nil {
+			return "", err
+		}
+	}
+
+	if err := hashTree(h, sourcePath); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindImageByHash returns the ID of an image built from the given inputs, or an empty string.
+func (c *Client) FindImageByHash(hash string) (string, error) {
+	images, err := c.cl.ImageList(context.Background(), image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelBuildHash+"="+hash)),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(images) == 0 {
+		return "", nil
+	}
+	return images[0].ID, nil
+}
+
+// hashTree writes the path, type and content of every entry under root in lexical order.
+func hashTree(w io.Writer, root string) error {
+	return filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			_, err = fmt.Fprintf(w, "dir %s\n", rel)
+			return err
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "link %s %s\n", rel, link)
+			return err
+		case info.Mode().IsRegular():
+			if _, err := fmt.Fprintf(w, "file %s %o %d\n", rel, info.Mode().Perm()&0111, info.Size()); err != nil {
+				return err
+			}
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		default:
+			return nil
+		}
+	})
+}
+
+// baseImages returns the external images referenced by FROM instructions of a Dockerfile.
+// ARGs declared before the first FROM are substituted, overridden by the build args.
+// References to earlier build stages and "scratch" are skipped.
+func baseImages(dockerfilePath string, buildArgs map[string]string) ([]string, error) {
+	f, err := os.Open(dockerfilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var images []string
+	args := make(map[string]string)
+	seenFrom := false
+	stages := map[string]bool{"scratch": true}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "ARG") && !seenFrom {
+			name, value, _ := strings.Cut(fields[1], "=")
+			if override, ok := buildArgs[name]; ok {
+				value = override
+			}
+			args[name] = strings.Trim(value, `"'`)
+			continue
+		}
+		if !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		seenFrom = true
+
+		// Skip flags such as --platform=linux/amd64
+		from := fields[1:]
+		for len(from) > 0 && strings.HasPrefix(from[0], "--") {
+			from = from[1:]
+		}
+		if len(from) == 0 {
+			continue
+		}
+
+		ref := expandArgs(from[0], args)
+		if !stages[strings.ToLower(ref)] {
+			images = append(images, ref)
+		}
+		if len(from) == 3 && strings.EqualFold(from[1], "AS") {
+			stages[strings.ToLower(from[2])] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// expandArgs substitutes $NAME, ${NAME} and ${NAME:-default} in s. Unknown args expand to
+// an empty string, like they do in docker build.
+func expandArgs(s string, args map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		name, def, hasDefault := strings.Cut(name, ":-")
+		if value := args[name]; value != "" || !hasDefault {
+			return value
+		}
+		return def
+	})
+}
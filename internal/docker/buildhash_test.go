@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(target), 0755))
+		require.NoError(t, os.WriteFile(target, []byte(content), 0644))
+	}
+}
+
+func treeHash(t *testing.T, root string) string {
+	var buf bytes.Buffer
+	require.NoError(t, hashTree(&buf, root))
+	return buf.String()
+}
+
+func TestHashTree(t *testing.T) {
+	first := t.TempDir()
+	writeFiles(t, first, map[string]string{"index.js": "run()", "lib/util.js": "util()"})
+	second := t.TempDir()
+	writeFiles(t, second, map[string]string{"lib/util.js": "util()"})
+	writeFiles(t, second, map[string]string{"index.js": "run()"})
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(second, "index.js"), old, old))
+
+	assert.Equal(t, treeHash(t, first), treeHash(t, second), "the order files were written in and their mtimes don't matter")
+
+	writeFiles(t, second, map[string]string{"index.js": "run(1)"})
+	assert.NotEqual(t, treeHash(t, first), treeHash(t, second))
+}
+
+func TestBaseImages(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		buildArgs  map[string]string
+		want       []string
+	}{
+		{"single", "FROM node:20\nRUN npm ci\n", nil, []string{"node:20"}},
+		{"platform", "FROM --platform=linux/amd64 node:20\n", nil, []string{"node:20"}},
+		{"stages", "FROM node:20 AS build\nFROM build\nFROM alpine:3 as final\nCOPY --from=build /app /app\n", nil, []string{"node:20", "alpine:3"}},
+		{"scratch", "FROM golang:1.23 AS build\nFROM scratch\n", nil, []string{"golang:1.23"}},
+		{"arg default", "ARG NODE=20\nFROM node:${NODE}\n", nil, []string{"node:20"}},
+		{"arg override", "ARG NODE=20\nFROM node:$NODE\n", map[string]string{"NODE": "22"}, []string{"node:22"}},
+		{"arg fallback", "ARG REGISTRY\nFROM ${REGISTRY:-docker.io}/node:20\n", nil, []string{"docker.io/node:20"}},
+		{"stage arg", "FROM node:20\nARG NODE=22\nFROM node:${NODE:-18}\n", nil, []string{"node:20", "node:18"}},
+		{"lowercase", "from node:20\n", nil, []string{"node:20"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+			require.NoError(t, os.WriteFile(dockerfile, []byte(tt.dockerfile), 0644))
+
+			images, err := baseImages(dockerfile, tt.buildArgs)
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, images)
+		})
+	}
+}
+
+func TestBuildHash(t *testing.T) {
+	d := dockertest.New(t)
+	d.AddImage(container.Config{}, "node:20")
+	d.AddImage(container.Config{}, "node:22")
+	c, err := NewClient()
+	require.NoError(t, err)
+
+	type inputs struct {
+		dockerfile string
+		files      map[string]string
+		commit     string
+		buildArgs  map[string]string
+	}
+	base := inputs{
+		dockerfile: "ARG NODE=20\nFROM node:${NODE}\n",
+		files:      map[string]string{"index.js": "run()"},
+		commit:     "1111111",
+		buildArgs:  map[string]string{"BOT_NAME": "mybot"},
+	}
+	hash := func(in inputs) string {
+		contextPath := t.TempDir()
+		writeFiles(t, contextPath, map[string]string{"Dockerfile": in.dockerfile})
+		sourcePath := t.TempDir()
+		writeFiles(t, sourcePath, in.files)
+		h, err := c.BuildHash(contextPath, sourcePath, in.commit, in.buildArgs)
+		require.NoError(t, err)
+		return h
+	}
+	baseHash := hash(base)
+	require.NotEmpty(t, baseHash)
+	assert.Equal(t, baseHash, hash(base), "the same inputs hash the same")
+
+	tests := []struct {
+		name   string
+		change func(in *inputs)
+	}{
+		{"source", func(in *inputs) { in.files = map[string]string{"index.js": "run(1)"} }},
+		{"new file", func(in *inputs) { in.files = map[string]string{"index.js": "run()", "extra.js": ""} }},
+		{"cradle commit", func(in *inputs) { in.commit = "2222222" }},
+		{"build arg", func(in *inputs) { in.buildArgs = map[string]string{"BOT_NAME": "otherbot"} }},
+		{"base image arg", func(in *inputs) { in.buildArgs = map[string]string{"BOT_NAME": "mybot", "NODE": "22"} }},
+		{"template base image", func(in *inputs) { in.dockerfile = "FROM node:22\n" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := base
+			tt.change(&in)
+			assert.NotEqual(t, baseHash, hash(in))
+		})
+	}
+}
+
+func TestBuildHash_MissingBaseImage(t *testing.T) {
+	dockertest.New(t)
+	c, err := NewClient()
+	require.NoError(t, err)
+	contextPath := t.TempDir()
+	writeFiles(t, contextPath, map[string]string{"Dockerfile": "FROM node:20\n"})
+
+	hash, err := c.BuildHash(contextPath, t.TempDir(), "1111111", nil)
+
+	require.NoError(t, err)
+	assert.Empty(t, hash, "without the base image there is nothing to match a cached image against")
+}
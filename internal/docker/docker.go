@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"regexp"
 	"slices"
 	"strings"
@@ -14,6 +15,7 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/sensority-labs/builder/internal/bot"
 	"github.com/sensority-labs/builder/internal/config"
@@ -46,6 +48,24 @@ type BotContainer struct {
 	Image   string
 	Network string
 	Envs    []string
+
+	// Resource limits of the container. Zero values keep the current limits.
+	Memory   int64
+	NanoCPUs int64
+
+	// Snapshot of an existing container's configuration. Recreating the container reapplies it,
+	// overriding the image, envs, resource limits and the fields the image provides. Nil for bots
+	// that weren't created yet.
+	ImageID    string
+	Config     *container.Config
+	HostConfig *container.HostConfig
+	Networks   map[string]*network.EndpointSettings
+
+	// imageLabels are the labels of the image the container was created from, which Docker merged into Config
+	imageLabels map[string]string
+
+	// pinnedImage is the image ID the next container is created from instead of Image
+	pinnedImage string
 }
 
 // Slugify converts a string to a slug with allowed characters [a-zA-Z0-9_.-].
@@ -60,6 +80,27 @@ func sanitize(input string) string {
 	return slug
 }
 
+// labelNamespace prefixes the labels the builder sets on containers and images.
+const labelNamespace = "sensority."
+
+// Labels of the containers the builder manages, used to find them and to attribute Docker events.
+const (
+	LabelManaged  = "sensority.managed"
+	LabelCustomer = "sensority.bot.customer"
+	LabelBot      = "sensority.bot.name"
+	LabelImage    = "sensority.bot.image" // The bot's image reference, also when the container was created from an image ID
+)
+
+// ContainerName returns the name of the container running the customer's bot.
+func ContainerName(customerName, botName string) string {
+	return fmt.Sprintf("%s_%s", sanitize(customerName), sanitize(botName))
+}
+
+// Owner returns the customer and the name of the bot the container runs.
+func (bc *BotContainer) Owner() (string, string) {
+	return envValue(bc.Envs, EnvCustomerName), envValue(bc.Envs, EnvBotName)
+}
+
 func NewBotContainer(cfg *config.Config, botName, customerName string) (*BotContainer, error) {
 	cl, err := NewClient()
 	if err != nil {
@@ -68,23 +109,18 @@ func NewBotContainer(cfg *config.Config, botName, customerName string) (*BotCont
 
 	customerName = sanitize(customerName)
 	botName = sanitize(botName)
-	imageName := fmt.Sprintf("%s_%s:latest", customerName, botName)
-	containerName := fmt.Sprintf("%s_%s", customerName, botName)
-	envs := []string{
-		"NATS_URL=" + cfg.Stream.NatsURL,
-		"EVENTS_STREAM_NAME=" + cfg.Stream.EventStreamName,
-		"FINDINGS_STREAM_NAME=" + cfg.Stream.FindingsStreamName,
-		"SENTRY_DSN=" + cfg.Bot.SentryDSN,
-		"CUSTOMER_NAME=" + customerName,
-		"BOT_NAME=" + botName,
-	}
+	containerName := ContainerName(customerName, botName)
+	imageName := containerName + ":latest"
+	envs := PlatformEnvs(cfg, customerName, botName)
 
 	return &BotContainer{
-		docker:  cl,
-		Name:    containerName,
-		Image:   imageName,
-		Network: cfg.NetworkName,
-		Envs:    envs,
+		docker:   cl,
+		Name:     containerName,
+		Image:    imageName,
+		Network:  cfg.NetworkName,
+		Envs:     envs,
+		Memory:   cfg.Bot.Memory,
+		NanoCPUs: nanoCPUs(cfg.Bot.CPUs),
 	}, nil
 }
 
@@ -99,20 +135,73 @@ func GetBotContainer(id string) (*BotContainer, error) {
 		return nil, err
 	}
 
+	networks := make(map[string]*network.EndpointSettings)
 	var networkNames []string
-	for k := range containerStats.NetworkSettings.Networks {
-		networkNames = append(networkNames, k)
+	if containerStats.NetworkSettings != nil {
+		for k, settings := range containerStats.NetworkSettings.Networks {
+			networks[k] = endpointConfig(settings, containerStats.ID)
+			networkNames = append(networkNames, k)
+		}
+	}
+	slices.Sort(networkNames)
+
+	// Prefer the network the container was created with
+	var primaryNetwork string
+	if containerStats.HostConfig != nil && networks[string(containerStats.HostConfig.NetworkMode)] != nil {
+		primaryNetwork = string(containerStats.HostConfig.NetworkMode)
+	} else if len(networkNames) > 0 {
+		primaryNetwork = networkNames[0]
+	}
+
+	// The image may be gone, the builder's own labels are recognized without it
+	var imageLabels map[string]string
+	img, _, err := cl.cl.ImageInspectWithRaw(context.Background(), containerStats.Image)
+	if err != nil && !client.IsErrNotFound(err) {
+		return nil, err
+	}
+	if err == nil && img.Config != nil {
+		imageLabels = img.Config.Labels
 	}
 
 	return &BotContainer{
-		docker:  cl,
-		ID:      id,
-		Name:    strings.TrimPrefix(containerStats.Name, "/"),
-		Image:   containerStats.Config.Image,
-		Envs:    containerStats.Config.Env,
-		Network: networkNames[0],
+		docker:      cl,
+		ID:          containerStats.ID,
+		Name:        strings.TrimPrefix(containerStats.Name, "/"),
+		Image:       imageRef(containerStats.Config),
+		Envs:        containerStats.Config.Env,
+		Network:     primaryNetwork,
+		ImageID:     containerStats.Image,
+		Config:      containerStats.Config,
+		HostConfig:  containerStats.HostConfig,
+		Networks:    networks,
+		imageLabels: imageLabels,
 	}, nil
+}
 
+// endpointConfig keeps the user-supplied part of a network endpoint and drops the operational data
+// assigned by Docker, which can't be reused for a new container.
+func endpointConfig(settings *network.EndpointSettings, containerID string) *network.EndpointSettings {
+	if settings == nil {
+		return &network.EndpointSettings{}
+	}
+
+	var aliases []string
+	for _, alias := range settings.Aliases {
+		// Docker adds the short container ID as an alias on user-defined networks
+		if !strings.HasPrefix(containerID, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	endpoint := &network.EndpointSettings{
+		Links:      settings.Links,
+		Aliases:    aliases,
+		DriverOpts: settings.DriverOpts,
+	}
+	if settings.IPAMConfig != nil {
+		endpoint.IPAMConfig = settings.IPAMConfig.Copy()
+	}
+	return endpoint
 }
 
 func (bc *BotContainer) Close() error {
@@ -137,6 +226,13 @@ func (bc *BotContainer) Start() error {
 	return nil
 }
 
+func (bc *BotContainer) Unpause() error {
+	if err := bc.docker.cl.ContainerUnpause(context.Background(), bc.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (bc *BotContainer) Stop() error {
 	if err := bc.docker.cl.ContainerStop(context.Background(), bc.ID, container.StopOptions{}); err != nil {
 		return err
@@ -151,38 +247,30 @@ func (bc *BotContainer) Remove() error {
 	return nil
 }
 
-func (bc *BotContainer) UpdateEnvs(cfg *config.Config) error {
-	var botCustomerName, botName string
-	for _, env := range bc.Envs {
-		if strings.HasPrefix(env, "CUSTOMER_NAME=") {
-			botCustomerName = strings.TrimPrefix(env, "CUSTOMER_NAME=")
-		}
-		if strings.HasPrefix(env, "BOT_NAME=") {
-			botName = strings.TrimPrefix(env, "BOT_NAME=")
-		}
+// UpdateEnvs recomputes the bot's envs from the platform config and the bot config in core.
+// Envs removed in core are removed from the container as well.
+func (bc *BotContainer) UpdateEnvs(ctx context.Context, cfg *config.Config, core bot.Core) error {
+	envs, err := bc.desiredEnvs(ctx, cfg, core)
+	if err != nil {
+		return err
 	}
+	bc.Envs = envs
+	return nil
+}
+
+func (bc *BotContainer) desiredEnvs(ctx context.Context, cfg *config.Config, core bot.Core) ([]string, error) {
+	botCustomerName := envValue(bc.Envs, EnvCustomerName)
+	botName := envValue(bc.Envs, EnvBotName)
 	if botCustomerName == "" || botName == "" {
-		return fmt.Errorf("missing bot customer name or bot name in the envs. Redeploy the bot")
+		return nil, errdefs.Conflict(fmt.Errorf("missing bot customer name or bot name in the envs. Redeploy the bot"))
 	}
 
-	botCfg, err := bot.GetConfig(cfg, botCustomerName, botName)
+	botCfg, err := core.GetConfig(ctx, botCustomerName, botName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for k, v := range botCfg.Envs {
-		env := fmt.Sprintf("%s=%s", k, v)
-		if !slices.Contains(bc.Envs, env) {
-			bc.Envs = append(bc.Envs, env)
-		} else {
-			for i, e := range bc.Envs {
-				if strings.HasPrefix(e, k+"=") {
-					bc.Envs[i] = env
-				}
-			}
-		}
-	}
-	return nil
+	return BotEnvs(cfg, botCustomerName, botName, botCfg.Envs)
 }
 
 func (bc *BotContainer) Recreate() error {
@@ -206,15 +294,60 @@ func (bc *BotContainer) Recreate() error {
 	return nil
 }
 
-func (bc *BotContainer) Build(srcCodePath string) error {
-	if err := bc.docker.BuildImage(srcCodePath, bc.Image); err != nil {
-		return err
+// Build builds the bot image from the build context at contextPath, writing the build output to out.
+// If an image was already built from the same inputs, it is tagged for the bot instead and Build reports a cache hit.
+func (bc *BotContainer) Build(contextPath, sourcePath, cradleCommit string, labels, buildArgs map[string]string, out io.Writer) (bool, error) {
+	hash, err := bc.docker.BuildHash(contextPath, sourcePath, cradleCommit, buildArgs)
+	if err != nil {
+		return false, err
 	}
-	return nil
+
+	if hash != "" {
+		imageID, err := bc.docker.FindImageByHash(hash)
+		if err != nil {
+			return false, err
+		}
+		if imageID != "" {
+			log.Default().Printf("Image %s with build hash %s already exists, skipping the build\n", imageID, hash)
+			fmt.Fprintf(out, "Image %s with build hash %s already exists, skipping the build\n", imageID, hash)
+			if err := bc.docker.cl.ImageTag(context.Background(), imageID, bc.Image); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+
+	imageLabels := map[string]string{LabelBuildHash: hash}
+	for k, v := range labels {
+		imageLabels[k] = v
+	}
+	if err := bc.docker.BuildImage(contextPath, bc.Image, imageLabels, buildArgs, out); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// HasImage reports whether the bot's image exists, so a container can be created without a build.
+func (bc *BotContainer) HasImage() (bool, error) {
+	_, _, err := bc.docker.cl.ImageInspectWithRaw(context.Background(), bc.Image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ContainerImageID returns the ID of the image the bot's container was created from.
+func (bc *BotContainer) ContainerImageID() (string, error) {
+	info, err := bc.docker.cl.ContainerInspect(context.Background(), bc.ID)
+	if err != nil {
+		return "", err
+	}
+	return info.Image, nil
 }
 
 func (bc *BotContainer) Create() error {
-	containerId, err := bc.docker.CreateContainer(bc.Image, bc.Name, bc.Network, bc.Envs)
+	containerConfig, hostConfig, networks := bc.containerConfig()
+	containerId, err := bc.docker.CreateContainer(bc.Name, containerConfig, hostConfig, bc.Network, networks)
 	if err != nil {
 		return err
 	}
@@ -222,7 +355,106 @@ func (bc *BotContainer) Create() error {
 	return nil
 }
 
-func (c *Client) BuildImage(srcCodePath, imageName string) error {
+// containerConfig returns the configuration for a new container of the bot, starting from the snapshot
+// of the existing container if there is one. The command, entrypoint, working directory, healthcheck
+// and labels of the old image are dropped, so the ones of the image the container is created from apply.
+func (bc *BotContainer) containerConfig() (*container.Config, *container.HostConfig, map[string]*network.EndpointSettings) {
+	containerConfig := &container.Config{}
+	if bc.Config != nil {
+		*containerConfig = *bc.Config
+		containerConfig.Cmd = nil
+		containerConfig.Entrypoint = nil
+		containerConfig.WorkingDir = ""
+		containerConfig.Healthcheck = nil
+		// Docker defaults the hostname to the short container ID
+		if bc.ID != "" && strings.HasPrefix(bc.ID, containerConfig.Hostname) {
+			containerConfig.Hostname = ""
+		}
+	}
+	containerConfig.Image = bc.Image
+	containerConfig.Env = bc.Envs
+	containerConfig.Labels = bc.userLabels()
+	maps.Copy(containerConfig.Labels, bc.labels())
+	if bc.pinnedImage != "" {
+		containerConfig.Image = bc.pinnedImage
+	}
+
+	if bc.HostConfig == nil {
+		// HostConfig is used to configure the container to be attached to the network
+		hostConfig := &container.HostConfig{
+			RestartPolicy: container.RestartPolicy{
+				Name: container.RestartPolicyOnFailure,
+			},
+			Resources: container.Resources{
+				Memory:   bc.Memory,
+				NanoCPUs: bc.NanoCPUs,
+			},
+		}
+		networks := map[string]*network.EndpointSettings{
+			bc.Network: {},
+		}
+		return containerConfig, hostConfig, networks
+	}
+
+	hostConfig := *bc.HostConfig
+	if bc.Memory != 0 {
+		hostConfig.Memory = bc.Memory
+	}
+	if bc.NanoCPUs != 0 {
+		hostConfig.NanoCPUs = bc.NanoCPUs
+	}
+
+	networks := bc.Networks
+	if len(networks) == 0 && bc.Network != "" {
+		networks = map[string]*network.EndpointSettings{bc.Network: {}}
+	}
+	return containerConfig, &hostConfig, networks
+}
+
+// labels returns the labels marking the bot's container as managed. The labels of the image, like the
+// build hash and cradle commit, are added by Docker.
+func (bc *BotContainer) labels() map[string]string {
+	return map[string]string{
+		LabelManaged:  "true",
+		LabelCustomer: envValue(bc.Envs, EnvCustomerName),
+		LabelBot:      envValue(bc.Envs, EnvBotName),
+		LabelImage:    bc.Image,
+	}
+}
+
+// userLabels returns the labels of the container that neither the builder nor its image set.
+func (bc *BotContainer) userLabels() map[string]string {
+	labels := make(map[string]string)
+	if bc.Config == nil {
+		return labels
+	}
+	for k, v := range bc.Config.Labels {
+		if imageValue, ok := bc.imageLabels[k]; ok && imageValue == v {
+			continue
+		}
+		if strings.HasPrefix(k, labelNamespace) {
+			continue
+		}
+		labels[k] = v
+	}
+	return labels
+}
+
+// PinImage makes the next Create use the image the container runs rather than the one its tag points to now.
+func (bc *BotContainer) PinImage() {
+	bc.pinnedImage = bc.ImageID
+}
+
+// imageRef returns the bot's image reference of the container.
+func imageRef(cfg *container.Config) string {
+	if ref := cfg.Labels[LabelImage]; ref != "" {
+		return ref
+	}
+	return cfg.Image
+}
+
+// BuildImage builds the image from the Dockerfile at srcCodePath and writes the build output to out.
+func (c *Client) BuildImage(srcCodePath, imageName string, labels, buildArgs map[string]string, out io.Writer) error {
 	log.Default().Printf("Building image %s\n", imageName)
 
 	dockerContext, err := getDockerContext(srcCodePath)
@@ -230,9 +462,16 @@ func (c *Client) BuildImage(srcCodePath, imageName string) error {
 		return err
 	}
 
+	args := make(map[string]*string, len(buildArgs))
+	for k, v := range buildArgs {
+		args[k] = &v
+	}
+
 	// Build the image
 	buildResponse, err := c.cl.ImageBuild(context.Background(), dockerContext, types.ImageBuildOptions{
-		Tags: []string{imageName},
+		Tags:      []string{imageName},
+		Labels:    labels,
+		BuildArgs: args,
 	})
 	if err != nil {
 		return err
@@ -243,7 +482,7 @@ func (c *Client) BuildImage(srcCodePath, imageName string) error {
 		}
 	}(buildResponse.Body)
 
-	// Read the build output and print it to the console
+	// Read the build output. A failed build step is reported in the output, not as an API error.
 	decoder := json.NewDecoder(buildResponse.Body)
 	for {
 		var message map[string]interface{}
@@ -254,20 +493,26 @@ func (c *Client) BuildImage(srcCodePath, imageName string) error {
 		}
 
 		if stream, ok := message["stream"]; ok {
-			fmt.Print(stream)
+			fmt.Fprint(out, stream)
+		}
+		if buildErr, ok := message["error"]; ok {
+			fmt.Fprintln(out, buildErr)
+			return fmt.Errorf("building image %s: %v", imageName, buildErr)
 		}
 	}
 	return nil
 }
 
-func (c *Client) CreateContainer(imageName, containerName, networkName string, envs []string) (string, error) {
+// CreateContainer creates a container attached to all the given networks, replacing any container with the same name.
+// The container is created on primaryNetwork and connected to the other networks afterwards.
+func (c *Client) CreateContainer(containerName string, containerConfig *container.Config, hostConfig *container.HostConfig, primaryNetwork string, networks map[string]*network.EndpointSettings) (string, error) {
 	// Check if a container already exists
 	containers, err := c.cl.ContainerList(context.Background(), container.ListOptions{All: true})
 	if err != nil {
 		return "", err
 	}
 	if slices.ContainsFunc(containers, func(container types.Container) bool {
-		return container.Names[0] == "/"+containerName
+		return slices.Contains(container.Names, "/"+containerName)
 	}) {
 		// Remove old container
 		log.Default().Printf("Removing old container %s\n", containerName)
@@ -276,29 +521,36 @@ func (c *Client) CreateContainer(imageName, containerName, networkName string, e
 		}
 	}
 
-	// Create a new container
-	containerConfig := &container.Config{
-		Image: imageName,
-		Env:   envs,
-	}
-	// HostConfig is used to configure the container to be attached to the network
-	hostConfig := &container.HostConfig{
-		RestartPolicy: container.RestartPolicy{
-			Name: container.RestartPolicyOnFailure,
-		},
-	}
-	// Attach the container to the network
-	networkConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			networkName: {},
-		},
+	// Attach the container to its primary network, older daemons accept only one network on create
+	networkConfig := &network.NetworkingConfig{}
+	if primaryNetwork != "" {
+		endpoint := networks[primaryNetwork]
+		if endpoint == nil {
+			endpoint = &network.EndpointSettings{}
+		}
+		networkConfig.EndpointsConfig = map[string]*network.EndpointSettings{primaryNetwork: endpoint}
+		hostConfig.NetworkMode = container.NetworkMode(primaryNetwork)
 	}
-	log.Default().Printf("Creating container %s from image: %s\n", containerName, imageName)
+	log.Default().Printf("Creating container %s from image: %s\n", containerName, containerConfig.Image)
 	cnt, err := c.cl.ContainerCreate(context.Background(), containerConfig, hostConfig, networkConfig, nil, containerName)
 	if err != nil {
 		return "", err
 	}
 
+	extraNetworks := make([]string, 0, len(networks))
+	for name := range networks {
+		if name != primaryNetwork {
+			extraNetworks = append(extraNetworks, name)
+		}
+	}
+	slices.Sort(extraNetworks)
+	for _, name := range extraNetworks {
+		log.Default().Printf("Connecting container %s to network %s\n", containerName, name)
+		if err := c.cl.NetworkConnect(context.Background(), name, cnt.ID, networks[name]); err != nil {
+			return "", err
+		}
+	}
+
 	return cnt.ID, nil
 }
 
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecreate_NewImage(t *testing.T) {
+	d := dockertest.New(t)
+	d.AddImage(container.Config{
+		Cmd:    []string{"node", "old.js"},
+		Labels: map[string]string{LabelBuildHash: "old", "org.cradle.commit": "1111111"},
+	}, "acme_mybot:latest")
+	d.AddNetwork("sensority-labs", nil)
+	d.AddNetwork("acme-private", nil)
+	hostConfig := container.HostConfig{
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyAlways},
+		Mounts:        []mount.Mount{{Type: mount.TypeVolume, Source: "acme-data", Target: "/data"}},
+		Resources:     container.Resources{Memory: 256 << 20},
+		NetworkMode:   "sensority-labs",
+	}
+	id, err := d.AddContainer("acme_mybot", container.Config{
+		Image:      "acme_mybot:latest",
+		User:       "1000:1000",
+		StopSignal: "SIGINT",
+		Env:        []string{EnvCustomerName + "=acme", EnvBotName + "=mybot"},
+		Labels:     map[string]string{LabelManaged: "true", LabelCustomer: "acme", LabelBot: "mybot", "com.example.team": "payments"},
+	}, hostConfig, "running")
+	require.NoError(t, err)
+	d.Connect(id, "acme-private", &network.EndpointSettings{Aliases: []string{"mybot"}})
+
+	// A new build moves the tag to an image with another command and labels
+	newImage := d.AddImage(container.Config{
+		Cmd:    []string{"node", "new.js"},
+		Labels: map[string]string{LabelBuildHash: "new"},
+	}, "acme_mybot:latest")
+
+	bc, err := GetBotContainer(id)
+	require.NoError(t, err)
+	defer bc.Close()
+	require.NoError(t, bc.Recreate())
+
+	recreated, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.NotEqual(t, id, recreated.ID)
+	assert.Equal(t, "running", recreated.State)
+	assert.Equal(t, newImage, recreated.ImageID)
+	assert.Equal(t, []string{"node", "new.js"}, []string(recreated.Config.Cmd), "the new image's command runs")
+	assert.Equal(t, "new", recreated.Config.Labels[LabelBuildHash])
+	assert.NotContains(t, recreated.Config.Labels, "org.cradle.commit", "labels of the old image are dropped")
+	assert.Equal(t, "acme", recreated.Config.Labels[LabelCustomer])
+	assert.Equal(t, "payments", recreated.Config.Labels["com.example.team"], "the user's labels are kept")
+	assert.Equal(t, "1000:1000", recreated.Config.User)
+	assert.Equal(t, "SIGINT", recreated.Config.StopSignal)
+	assert.Equal(t, []string{EnvCustomerName + "=acme", EnvBotName + "=mybot"}, recreated.Config.Env)
+
+	// The host config and networks of the container are kept
+	assert.Equal(t, container.RestartPolicyAlways, recreated.HostConfig.RestartPolicy.Name)
+	assert.Equal(t, hostConfig.Mounts, recreated.HostConfig.Mounts)
+	assert.Equal(t, int64(256<<20), recreated.HostConfig.Memory)
+	assert.Contains(t, recreated.Networks, "sensority-labs")
+	assert.Equal(t, []string{"mybot"}, recreated.Networks["acme-private"].Aliases)
+}
@@ -0,0 +1,656 @@
+// Package dockertest runs an in-memory Docker daemon for tests of code using the Docker API.
+// It implements the part of the Engine API the builder uses, with Docker's semantics where the
+// builder depends on them: containers inherit the config of their image, names are unique and
+// image tags move between images.
+package dockertest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+)
+
+// Container is a container of the daemon.
+type Container struct {
+	ID         string
+	Name       string
+	ImageID    string
+	State      string // created, running, paused, restarting or exited
+	Config     container.Config
+	HostConfig container.HostConfig
+	Networks   map[string]*network.EndpointSettings
+}
+
+// Image is an image of the daemon. Its config is inherited by the containers created from it.
+type Image struct {
+	ID     string
+	Config container.Config
+}
+
+// Network is a network of the daemon.
+type Network struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+}
+
+// Daemon is an in-memory Docker daemon.
+type Daemon struct {
+	mu         sync.Mutex
+	containers map[string]*Container // By ID
+	images     map[string]*Image     // By ID
+	tags       map[string]string     // Image ID by reference
+	networks   map[string]*Network   // By ID
+	failures   map[string][]error    // Injected failures by operation
+	calls      []string
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// New starts a daemon and points the Docker client of the test at it with DOCKER_HOST.
+func New(t testing.TB) *Daemon {
+	d := &Daemon{
+		containers: make(map[string]*Container),
+		images:     make(map[string]*Image),
+		tags:       make(map[string]string),
+		networks:   make(map[string]*Network),
+		failures:   make(map[string][]error),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_ping", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /containers/json", d.listContainers)
+	mux.HandleFunc("POST /containers/create", d.createContainer)
+	mux.HandleFunc("GET /containers/{id}/json", d.inspectContainer)
+	mux.HandleFunc("POST /containers/{id}/start", d.containerAction("start"))
+	mux.HandleFunc("POST /containers/{id}/stop", d.containerAction("stop"))
+	mux.HandleFunc("POST /containers/{id}/unpause", d.containerAction("unpause"))
+	mux.HandleFunc("POST /containers/{id}/rename", d.containerAction("rename"))
+	mux.HandleFunc("DELETE /containers/{id}", d.containerAction("remove"))
+	mux.HandleFunc("GET /images/json", d.listImages)
+	mux.HandleFunc("GET /images/{ref...}", d.imageGet)
+	mux.HandleFunc("POST /images/{ref...}", d.imagePost)
+	mux.HandleFunc("DELETE /images/{ref...}", d.removeImage)
+	mux.HandleFunc("GET /networks", d.listNetworks)
+	mux.HandleFunc("POST /networks/{id}/connect", d.connectNetwork)
+	mux.HandleFunc("DELETE /networks/{id}", d.removeNetwork)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = versionPrefix.ReplaceAllString(r.URL.Path, "")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	return d
+}
+
+// AddImage adds an image with the given config and tags it with the references. It returns the image ID.
+func (d *Daemon) AddImage(cfg container.Config, refs ...string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := "sha256:" + newID()
+	d.images[id] = &Image{ID: id, Config: cfg}
+	for _, ref := range refs {
+		d.tags[normalize(ref)] = id
+	}
+	return id
+}
+
+// AddNetwork adds a network with the given labels.
+func (d *Daemon) AddNetwork(name string, labels map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := newID()
+	d.networks[id] = &Network{ID: id, Name: name, Labels: labels}
+}
+
+// AddContainer creates a container from the image the reference points to, as a create request with
+// cfg and hostCfg would, and puts it in the given state. It returns the container ID.
+func (d *Daemon) AddContainer(name string, cfg container.Config, hostCfg container.HostConfig, state string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := d.create(name, &cfg, &hostCfg, nil)
+	if err != nil {
+		return "", err
+	}
+	c.State = state
+	return c.ID, nil
+}
+
+// Connect connects the container with the given ID or name to the network.
+func (d *Daemon) Connect(ref, networkName string, endpoint *network.EndpointSettings) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c := d.find(ref); c != nil {
+		c.Networks[networkName] = endpoint
+	}
+}
+
+// Container returns a copy of the container with the given ID or name.
+func (d *Daemon) Container(ref string) (Container, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(ref)
+	if c == nil {
+		return Container{}, false
+	}
+	return *c, true
+}
+
+// Containers returns copies of all containers, ordered by name.
+func (d *Daemon) Containers() []Container {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var containers []Container
+	for _, c := range d.containers {
+		containers = append(containers, *c)
+	}
+	slices.SortFunc(containers, func(a, b Container) int { return strings.Compare(a.Name, b.Name) })
+	return containers
+}
+
+// ImageID returns the ID of the image the reference points to, empty if there is none.
+func (d *Daemon) ImageID(ref string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if img := d.image(ref); img != nil {
+		return img.ID
+	}
+	return ""
+}
+
+// Networks returns the names of the networks.
+func (d *Daemon) Networks() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var names []string
+	for _, n := range d.networks {
+		names = append(names, n.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// FailNext makes the next call of the operation fail with err. Operations are create, start, stop,
+// unpause, rename, remove, tag and connect.
+func (d *Daemon) FailNext(op string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[op] = append(d.failures[op], err)
+}
+
+// Calls returns the operations that changed the daemon, e.g. "create acme_mybot" or "stop acme_mybot".
+func (d *Daemon) Calls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.calls)
+}
+
+// ResetCalls forgets the recorded operations.
+func (d *Daemon) ResetCalls() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = nil
+}
+
+// fail returns the failure injected for the operation, if any. d.mu must be held.
+func (d *Daemon) fail(op string) error {
+	if len(d.failures[op]) == 0 {
+		return nil
+	}
+	err := d.failures[op][0]
+	d.failures[op] = d.failures[op][1:]
+	return err
+}
+
+func (d *Daemon) record(format string, args ...any) {
+	d.calls = append(d.calls, fmt.Sprintf(format, args...))
+}
+
+// find returns the container with the given ID, name or ID prefix. d.mu must be held.
+func (d *Daemon) find(ref string) *Container {
+	ref = strings.TrimPrefix(ref, "/")
+	if c, ok := d.containers[ref]; ok {
+		return c
+	}
+	for _, c := range d.containers {
+		if c.Name == ref {
+			return c
+		}
+	}
+	for _, c := range d.containers {
+		if len(ref) >= 4 && strings.HasPrefix(c.ID, ref) {
+			return c
+		}
+	}
+	return nil
+}
+
+// image returns the image with the given ID or reference. d.mu must be held.
+func (d *Daemon) image(ref string) *Image {
+	if img, ok := d.images[ref]; ok {
+		return img
+	}
+	if img, ok := d.images["sha256:"+ref]; ok {
+		return img
+	}
+	return d.images[d.tags[normalize(ref)]]
+}
+
+// create creates a container, merging the config of its image into cfg like Docker does. d.mu must be held.
+func (d *Daemon) create(name string, cfg *container.Config, hostCfg *container.HostConfig, netCfg *network.NetworkingConfig) (*Container, error) {
+	if d.find(name) != nil {
+		return nil, statusError{http.StatusConflict, fmt.Sprintf("Conflict. The container name %q is already in use", "/"+name)}
+	}
+	img := d.image(cfg.Image)
+	if img == nil {
+		return nil, statusError{http.StatusNotFound, "No such image: " + cfg.Image}
+	}
+
+	merged := *cfg
+	if len(merged.Cmd) == 0 && len(merged.Entrypoint) == 0 {
+		merged.Cmd = img.Config.Cmd
+	}
+	if len(merged.Entrypoint) == 0 {
+		merged.Entrypoint = img.Config.Entrypoint
+	}
+	if merged.WorkingDir == "" {
+		merged.WorkingDir = img.Config.WorkingDir
+	}
+	if merged.Healthcheck == nil {
+		merged.Healthcheck = img.Config.Healthcheck
+	}
+	merged.Env = slices.Clone(cfg.Env)
+	for _, env := range img.Config.Env {
+		key, _, _ := strings.Cut(env, "=")
+		if !slices.ContainsFunc(merged.Env, func(e string) bool { return strings.HasPrefix(e, key+"=") }) {
+			merged.Env = append(merged.Env, env)
+		}
+	}
+	merged.Labels = maps.Clone(img.Config.Labels)
+	if merged.Labels == nil {
+		merged.Labels = make(map[string]string)
+	}
+	maps.Copy(merged.Labels, cfg.Labels)
+
+	networks := make(map[string]*network.EndpointSettings)
+	if netCfg != nil {
+		for n, endpoint := range netCfg.EndpointsConfig {
+			networks[n] = endpoint
+		}
+	}
+	if mode := string(hostCfg.NetworkMode); mode != "" && networks[mode] == nil {
+		networks[mode] = &network.EndpointSettings{}
+	}
+	c := &Container{
+		ID:         newID(),
+		Name:       name,
+		ImageID:    img.ID,
+		State:      "created",
+		Config:     merged,
+		HostConfig: *hostCfg,
+		Networks:   networks,
+	}
+	d.containers[c.ID] = c
+	return c, nil
+}
+
+func (d *Daemon) listContainers(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	all := r.URL.Query().Get("all") == "1"
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := []types.Container{}
+	for _, c := range d.containers {
+		if !all && c.State != "running" {
+			continue
+		}
+		if !args.MatchKVList("label", c.Config.Labels) {
+			continue
+		}
+		list = append(list, types.Container{
+			ID:      c.ID,
+			Names:   []string{"/" + c.Name},
+			Image:   c.Config.Image,
+			ImageID: c.ImageID,
+			Labels:  c.Config.Labels,
+			State:   c.State,
+		})
+	}
+	slices.SortFunc(list, func(a, b types.Container) int { return strings.Compare(a.Names[0], b.Names[0]) })
+	writeJSON(w, list)
+}
+
+func (d *Daemon) createContainer(w http.ResponseWriter, r *http.Request) {
+	var req container.CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	if req.Config == nil {
+		req.Config = &container.Config{}
+	}
+	if req.HostConfig == nil {
+		req.HostConfig = &container.HostConfig{}
+	}
+	name := r.URL.Query().Get("name")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.fail("create"); err != nil {
+		writeError(w, err)
+		return
+	}
+	c, err := d.create(name, req.Config, req.HostConfig, req.NetworkingConfig)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	d.record("create %s", name)
+	writeJSON(w, container.CreateResponse{ID: c.ID})
+}
+
+func (d *Daemon) inspectContainer(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.find(r.PathValue("id"))
+	if c == nil {
+		writeError(w, statusError{http.StatusNotFound, "No such container: " + r.PathValue("id")})
+		return
+	}
+	cfg, hostCfg := c.Config, c.HostConfig
+	writeJSON(w, types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    c.ID,
+			Name:  "/" + c.Name,
+			Image: c.ImageID,
+			State: &types.ContainerState{
+				Status:     c.State,
+				Running:    c.State == "running" || c.State == "paused" || c.State == "restarting",
+				Paused:     c.State == "paused",
+				Restarting: c.State == "restarting",
+				StartedAt:  "0001-01-01T00:00:00Z",
+				FinishedAt: "0001-01-01T00:00:00Z",
+			},
+			HostConfig: &hostCfg,
+		},
+		Config:          &cfg,
+		NetworkSettings: &types.NetworkSettings{Networks: maps.Clone(c.Networks)},
+	})
+}
+
+// containerAction handles the operations changing a container's state.
+func (d *Daemon) containerAction(op string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		c := d.find(r.PathValue("id"))
+		if c == nil {
+			writeError(w, statusError{http.StatusNotFound, "No such container: " + r.PathValue("id")})
+			return
+		}
+		if err := d.fail(op); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		switch op {
+		case "start":
+			if c.State == "running" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if c.State == "paused" {
+				writeError(w, statusError{http.StatusConflict, "cannot start a paused container, try unpause instead"})
+				return
+			}
+			c.State = "running"
+		case "stop":
+			if c.State != "running" && c.State != "paused" && c.State != "restarting" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			c.State = "exited"
+		case "unpause":
+			if c.State != "paused" {
+				writeError(w, statusError{http.StatusConflict, "container is not paused"})
+				return
+			}
+			c.State = "running"
+		case "rename":
+			newName := r.URL.Query().Get("name")
+			if other := d.find(newName); other != nil && other != c {
+				writeError(w, statusError{http.StatusConflict, fmt.Sprintf("Conflict. The container name %q is already in use", "/"+newName)})
+				return
+			}
+			d.record("rename %s %s", c.Name, newName)
+			c.Name = newName
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case "remove":
+			if c.State == "running" && r.URL.Query().Get("force") != "1" {
+				writeError(w, statusError{http.StatusConflict, "cannot remove a running container"})
+				return
+			}
+			delete(d.containers, c.ID)
+		}
+		d.record("%s %s", op, c.Name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (d *Daemon) listImages(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := []image.Summary{}
+	for _, img := range d.images {
+		if !args.MatchKVList("label", img.Config.Labels) {
+			continue
+		}
+		list = append(list, image.Summary{ID: img.ID, RepoTags: d.refsOf(img.ID), Labels: img.Config.Labels})
+	}
+	writeJSON(w, list)
+}
+
+// refsOf returns the references of the image. d.mu must be held.
+func (d *Daemon) refsOf(id string) []string {
+	refs := []string{}
+	for ref, imageID := range d.tags {
+		if imageID == id {
+			refs = append(refs, ref)
+		}
+	}
+	slices.Sort(refs)
+	return refs
+}
+
+// imageGet serves image inspection, the image reference may contain slashes.
+func (d *Daemon) imageGet(w http.ResponseWriter, r *http.Request) {
+	ref, ok := strings.CutSuffix(r.PathValue("ref"), "/json")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := d.image(ref)
+	if img == nil {
+		writeError(w, statusError{http.StatusNotFound, "No such image: " + ref})
+		return
+	}
+	cfg := img.Config
+	writeJSON(w, types.ImageInspect{ID: img.ID, RepoTags: d.refsOf(img.ID), Config: &cfg})
+}
+
+// imagePost serves image tagging, the image reference may contain slashes.
+func (d *Daemon) imagePost(w http.ResponseWriter, r *http.Request) {
+	ref, ok := strings.CutSuffix(r.PathValue("ref"), "/tag")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := d.image(ref)
+	if img == nil {
+		writeError(w, statusError{http.StatusNotFound, "No such image: " + ref})
+		return
+	}
+	if err := d.fail("tag"); err != nil {
+		writeError(w, err)
+		return
+	}
+	target := r.URL.Query().Get("repo")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		target += ":" + tag
+	}
+	d.tags[normalize(target)] = img.ID
+	d.record("tag %s", normalize(target))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (d *Daemon) removeImage(w http.ResponseWriter, r *http.Request) {
+	ref := r.PathValue("ref")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := d.image(ref)
+	if img == nil {
+		writeError(w, statusError{http.StatusNotFound, "No such image: " + ref})
+		return
+	}
+
+	var deleted []image.DeleteResponse
+	if _, tagged := d.tags[normalize(ref)]; tagged {
+		delete(d.tags, normalize(ref))
+		deleted = append(deleted, image.DeleteResponse{Untagged: normalize(ref)})
+		d.record("untag %s", normalize(ref))
+	}
+	inUse := slices.ContainsFunc(slices.Collect(maps.Values(d.containers)), func(c *Container) bool { return c.ImageID == img.ID })
+	if len(d.refsOf(img.ID)) == 0 && !inUse {
+		delete(d.images, img.ID)
+		deleted = append(deleted, image.DeleteResponse{Deleted: img.ID})
+	}
+	writeJSON(w, deleted)
+}
+
+func (d *Daemon) listNetworks(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := []network.Summary{}
+	for _, n := range d.networks {
+		if args.MatchKVList("label", n.Labels) {
+			list = append(list, network.Summary{ID: n.ID, Name: n.Name, Labels: n.Labels})
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (d *Daemon) connectNetwork(w http.ResponseWriter, r *http.Request) {
+	var req network.ConnectOptions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.fail("connect"); err != nil {
+		writeError(w, err)
+		return
+	}
+	c := d.find(req.Container)
+	if c == nil {
+		writeError(w, statusError{http.StatusNotFound, "No such container: " + req.Container})
+		return
+	}
+	c.Networks[r.PathValue("id")] = req.EndpointConfig
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *Daemon) removeNetwork(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, n := range d.networks {
+		if id == r.PathValue("id") || n.Name == r.PathValue("id") {
+			delete(d.networks, id)
+			d.record("remove network %s", n.Name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, statusError{http.StatusNotFound, "network " + r.PathValue("id") + " not found"})
+}
+
+// statusError is an error the daemon responds with the given status to.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e statusError) Error() string {
+	return e.message
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if se, ok := err.(statusError); ok {
+		status = se.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(types.ErrorResponse{Message: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// normalize returns the reference with the latest tag if it has none.
+func normalize(ref string) string {
+	ref = strings.TrimPrefix(ref, "docker.io/library/")
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref
+	}
+	return ref + ":latest"
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/errs"
+)
+
+// Platform envs are set by the builder for every bot and can't be overridden by bot configs from core.
+const (
+	EnvNatsURL            = "NATS_URL"
+	EnvEventsStreamName   = "EVENTS_STREAM_NAME"
+	EnvFindingsStreamName = "FINDINGS_STREAM_NAME"
+	EnvSentryDSN          = "SENTRY_DSN"
+	EnvCustomerName       = "CUSTOMER_NAME"
+	EnvBotName            = "BOT_NAME"
+)
+
+var reservedEnvs = []string{
+	EnvNatsURL,
+	EnvEventsStreamName,
+	EnvFindingsStreamName,
+	EnvSentryDSN,
+	EnvCustomerName,
+	EnvBotName,
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// PlatformEnvs returns the envs the platform sets for the customer's bot.
+func PlatformEnvs(cfg *config.Config, customerName, botName string) []string {
+	return []string{
+		EnvNatsURL + "=" + cfg.Stream.NatsURL,
+		EnvEventsStreamName + "=" + cfg.Stream.EventStreamName,
+		EnvFindingsStreamName + "=" + cfg.Stream.FindingsStreamName,
+		EnvSentryDSN + "=" + cfg.Bot.SentryDSN,
+		EnvCustomerName + "=" + customerName,
+		EnvBotName + "=" + botName,
+	}
+}
+
+// BotEnvs computes the complete env set of a bot from scratch: the platform envs followed by
+// the envs configured in core, sorted by name. Core envs are validated and may not override platform envs.
+func BotEnvs(cfg *config.Config, customerName, botName string, coreEnvs map[string]string) ([]string, error) {
+	if err := ValidateEnvs(cfg, coreEnvs); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(coreEnvs))
+	for k := range coreEnvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	envs := PlatformEnvs(cfg, customerName, botName)
+	for _, k := range keys {
+		envs = append(envs, k+"="+coreEnvs[k])
+	}
+	return envs, nil
+}
+
+// ValidateEnvs checks env names and value sizes and rejects reserved platform envs.
+// All problems are reported in a single validation error.
+func ValidateEnvs(cfg *config.Config, envs map[string]string) error {
+	var problems []string
+	for k, v := range envs {
+		switch {
+		case slices.Contains(reservedEnvs, strings.ToUpper(k)):
+			problems = append(problems, fmt.Sprintf("%s is reserved by the platform", k))
+		case !envNameRe.MatchString(k):
+			problems = append(problems, fmt.Sprintf("%q is not a valid env name", k))
+		case cfg.Bot.MaxEnvValueSize > 0 && len(v) > cfg.Bot.MaxEnvValueSize:
+			problems = append(problems, fmt.Sprintf("%s value is %d bytes, the limit is %d", k, len(v), cfg.Bot.MaxEnvValueSize))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	return errs.Validation("invalid bot envs: %s", strings.Join(problems, "; "))
+}
+
+// envValue returns the value of the env with the given name.
+func envValue(envs []string, name string) string {
+	for _, env := range envs {
+		if v, ok := strings.CutPrefix(env, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package docker_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Stream: config.StreamConfig{
+			NatsURL:            "nats://nats:4222",
+			EventStreamName:    "ethereum_events",
+			FindingsStreamName: "findings",
+		},
+		Bot: config.BotConfig{SentryDSN: "https://sentry.example.com/1", MaxEnvValueSize: 16},
+	}
+}
+
+func TestBotEnvs(t *testing.T) {
+	envs, err := docker.BotEnvs(testConfig(), "acme", "mybot", map[string]string{"RPC_URL": "http://rpc", "API_KEY": "secret"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"NATS_URL=nats://nats:4222",
+		"EVENTS_STREAM_NAME=ethereum_events",
+		"FINDINGS_STREAM_NAME=findings",
+		"SENTRY_DSN=https://sentry.example.com/1",
+		"CUSTOMER_NAME=acme",
+		"BOT_NAME=mybot",
+		"API_KEY=secret",
+		"RPC_URL=http://rpc",
+	}, envs)
+}
+
+func TestBotEnvs_NoCoreEnvs(t *testing.T) {
+	envs, err := docker.BotEnvs(testConfig(), "acme", "mybot", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, docker.PlatformEnvs(testConfig(), "acme", "mybot"), envs)
+}
+
+func TestBotEnvs_ReservedEnvs(t *testing.T) {
+	for _, name := range []string{"NATS_URL", "CUSTOMER_NAME", "FINDINGS_STREAM_NAME", "findings_stream_name"} {
+		_, err := docker.BotEnvs(testConfig(), "acme", "mybot", map[string]string{name: "nats://evil:4222"})
+
+		assert.True(t, errs.IsValidation(err), name)
+		assert.ErrorContains(t, err, name+" is reserved by the platform")
+	}
+}
+
+func TestValidateEnvs_InvalidNames(t *testing.T) {
+	for _, name := range []string{"", "1ST", "MY-VAR", "MY VAR", "A=B"} {
+		err := docker.ValidateEnvs(testConfig(), map[string]string{name: "x"})
+
+		assert.True(t, errs.IsValidation(err), name)
+	}
+}
+
+func TestValidateEnvs_ValueTooLarge(t *testing.T) {
+	err := docker.ValidateEnvs(testConfig(), map[string]string{"RPC_URL": strings.Repeat("x", 17)})
+
+	assert.True(t, errs.IsValidation(err))
+	assert.ErrorContains(t, err, "RPC_URL value is 17 bytes, the limit is 16")
+}
+
+func TestValidateEnvs_ReportsAllProblems(t *testing.T) {
+	err := docker.ValidateEnvs(testConfig(), map[string]string{"BOT_NAME": "x", "MY-VAR": "x"})
+
+	assert.ErrorContains(t, err, "BOT_NAME is reserved by the platform")
+	assert.ErrorContains(t, err, `"MY-VAR" is not a valid env name`)
+}
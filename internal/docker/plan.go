@@ -0,0 +1,176 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/config"
+)
+
+// plainEnvs are the envs whose values plans show. Every other value may be a secret from core, like
+// credentials embedded in a URL, and is shown as a short hash. The Sentry DSN holds a key.
+var plainEnvs = slices.DeleteFunc(slices.Clone(reservedEnvs), func(env string) bool { return env == EnvSentryDSN })
+
+// Plan describes what recreating a bot's container would change.
+type Plan struct {
+	ContainerID string           `json:"containerId"`
+	Changed     bool             `json:"changed"`
+	Envs        EnvDiff          `json:"envs"`
+	Image       *ImageChange     `json:"image,omitempty"`
+	Resources   []ResourceChange `json:"resources,omitempty"`
+
+	envs     []string
+	memory   int64
+	nanoCPUs int64
+}
+
+// EnvDiff lists env changes by name. Values are masked except for the platform envs.
+type EnvDiff struct {
+	Added   map[string]string      `json:"added"`
+	Changed map[string]ValueChange `json:"changed"`
+	Removed map[string]string      `json:"removed"`
+}
+
+// Empty reports whether the envs are unchanged.
+func (d EnvDiff) Empty() bool {
+	return len(d.Added)+len(d.Changed)+len(d.Removed) == 0
+}
+
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ImageChange is reported when the bot's image tag points to another image than the container runs.
+type ImageChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ResourceChange struct {
+	Name string `json:"name"`
+	From int64  `json:"from"`
+	To   int64  `json:"to"`
+}
+
+// Plan compares the container with the bot config in core and the platform config without changing anything.
+func (bc *BotContainer) Plan(ctx context.Context, cfg *config.Config, core bot.Core) (*Plan, error) {
+	desired, err := bc.desiredEnvs(ctx, cfg, core)
+	if err != nil {
+		return nil, err
+	}
+	inherited, err := bc.imageEnvs()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		ContainerID: bc.ID,
+		Envs:        diffEnvs(bc.Envs, desired, inherited),
+		envs:        desired,
+		memory:      cfg.Bot.Memory,
+		nanoCPUs:    nanoCPUs(cfg.Bot.CPUs),
+	}
+
+	img, _, err := bc.docker.cl.ImageInspectWithRaw(context.Background(), bc.Image)
+	if err != nil && !client.IsErrNotFound(err) {
+		return nil, err
+	}
+	if err == nil && img.ID != bc.ImageID {
+		plan.Image = &ImageChange{Name: bc.Image, From: bc.ImageID, To: img.ID}
+	}
+
+	if bc.HostConfig != nil {
+		if plan.memory != 0 && plan.memory != bc.HostConfig.Memory {
+			plan.Resources = append(plan.Resources, ResourceChange{Name: "memory", From: bc.HostConfig.Memory, To: plan.memory})
+		}
+		if plan.nanoCPUs != 0 && plan.nanoCPUs != bc.HostConfig.NanoCPUs {
+			plan.Resources = append(plan.Resources, ResourceChange{Name: "nanoCpus", From: bc.HostConfig.NanoCPUs, To: plan.nanoCPUs})
+		}
+	}
+
+	plan.Changed = !plan.Envs.Empty() || plan.Image != nil || len(plan.Resources) > 0
+	return plan, nil
+}
+
+// ApplyEnvs sets only the envs of the plan for the next Create or Recreate.
+func (bc *BotContainer) ApplyEnvs(plan *Plan) {
+	bc.Envs = plan.envs
+}
+
+// Apply sets the envs and resource limits of the plan for the next Create or Recreate.
+func (bc *BotContainer) Apply(plan *Plan) {
+	bc.Envs = plan.envs
+	bc.Memory = plan.memory
+	bc.NanoCPUs = plan.nanoCPUs
+}
+
+// imageEnvs returns the envs the container's image sets.
+func (bc *BotContainer) imageEnvs() ([]string, error) {
+	img, _, err := bc.docker.cl.ImageInspectWithRaw(context.Background(), bc.ImageID)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if img.Config == nil {
+		return nil, nil
+	}
+	return img.Config.Env, nil
+}
+
+// diffEnvs compares the container's envs with the desired ones. Envs inherited unchanged from
+// the image aren't reported as removed, the image sets them again.
+func diffEnvs(current, desired, inherited []string) EnvDiff {
+	from := envMap(current)
+	to := envMap(desired)
+	diff := EnvDiff{
+		Added:   map[string]string{},
+		Changed: map[string]ValueChange{},
+		Removed: map[string]string{},
+	}
+	for k, v := range to {
+		old, ok := from[k]
+		switch {
+		case !ok:
+			diff.Added[k] = maskEnv(k, v)
+		case old != v:
+			diff.Changed[k] = ValueChange{From: maskEnv(k, old), To: maskEnv(k, v)}
+		}
+	}
+	for k, v := range from {
+		if _, ok := to[k]; !ok && !slices.Contains(inherited, k+"="+v) {
+			diff.Removed[k] = maskEnv(k, v)
+		}
+	}
+	return diff
+}
+
+func envMap(envs []string) map[string]string {
+	m := make(map[string]string, len(envs))
+	for _, env := range envs {
+		k, v, _ := strings.Cut(env, "=")
+		m[k] = v
+	}
+	return m
+}
+
+// maskEnv returns the value of a plain env, otherwise a short hash that tells values apart without revealing them.
+func maskEnv(name, value string) string {
+	if value == "" || slices.Contains(plainEnvs, name) {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+func nanoCPUs(cpus float64) int64 {
+	return int64(cpus * 1e9)
+}
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// RemoveBotImages removes the bot's image and the one kept during its deploys. Images the build
+// cache shares with other bots only lose the bot's tags. It returns the removed references.
+func RemoveBotImages(ctx context.Context, customerName, botName string) ([]string, error) {
+	cl, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer func(cl *Client) {
+		if err := cl.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(cl)
+
+	repo := ContainerName(customerName, botName)
+	var removed []string
+	for _, ref := range []string{repo + ":latest", repo + ":" + previousTag} {
+		_, err := cl.cl.ImageRemove(ctx, ref, image.RemoveOptions{PruneChildren: true})
+		if client.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, ref)
+	}
+	return removed, nil
+}
+
+// RemoveCustomerNetworks removes the networks labeled as the customer's. Bots on the shared
+// network aren't affected. It returns the names of the removed networks.
+func RemoveCustomerNetworks(ctx context.Context, customerName string) ([]string, error) {
+	cl, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer func(cl *Client) {
+		if err := cl.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(cl)
+
+	networks, err := cl.cl.NetworkList(ctx, network.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelCustomer+"="+customerName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, n := range networks {
+		if err := cl.cl.NetworkRemove(ctx, n.ID); err != nil && !client.IsErrNotFound(err) {
+			return removed, err
+		}
+		removed = append(removed, n.Name)
+	}
+	return removed, nil
+}
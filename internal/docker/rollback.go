@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// previousTag and previousSuffix name the image tag and the container kept during a deploy,
+// so a failed deploy can restore the bot as it was.
+const (
+	previousTag    = "previous"
+	previousSuffix = "-previous"
+)
+
+// Stash is the bot's previous container, stopped and renamed while a new one is deployed.
+type Stash struct {
+	ID         string
+	Name       string
+	WasRunning bool
+}
+
+// PreviousName returns the name of the container stashed during a deploy of the bot.
+func PreviousName(containerName string) string {
+	return containerName + previousSuffix
+}
+
+// IsPrevious reports whether the container name is of a container stashed during a deploy.
+func IsPrevious(containerName string) bool {
+	return strings.HasSuffix(containerName, previousSuffix)
+}
+
+func (bc *BotContainer) previousImage() string {
+	repo := bc.Image
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	return repo + ":" + previousTag
+}
+
+// KeepImage tags the bot's current image, so RestoreImage can bring it back.
+// It reports whether the bot had an image.
+func (bc *BotContainer) KeepImage() (bool, error) {
+	img, _, err := bc.docker.cl.ImageInspectWithRaw(context.Background(), bc.Image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := bc.docker.cl.ImageTag(context.Background(), img.ID, bc.previousImage()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RestoreImage points the bot's tag back to the image kept by KeepImage.
+// If the bot had no image before, the tag of the new image is removed.
+func (bc *BotContainer) RestoreImage(kept bool) error {
+	if !kept {
+		log.Default().Printf("Removing image tag %s\n", bc.Image)
+		return bc.untag(bc.Image)
+	}
+
+	log.Default().Printf("Restoring image %s from %s\n", bc.Image, bc.previousImage())
+	if err := bc.docker.cl.ImageTag(context.Background(), bc.previousImage(), bc.Image); err != nil {
+		return err
+	}
+	return bc.untag(bc.previousImage())
+}
+
+// DropKeptImage removes the tag of the image kept by KeepImage. The image itself is
+// removed too unless it is still tagged or used by a container.
+func (bc *BotContainer) DropKeptImage() error {
+	return bc.untag(bc.previousImage())
+}
+
+func (bc *BotContainer) untag(ref string) error {
+	_, err := bc.docker.cl.ImageRemove(context.Background(), ref, image.RemoveOptions{})
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// StashContainer stops the bot's current container and renames it out of the way of the new one.
+// It returns nil if the bot has no container.
+func (bc *BotContainer) StashContainer() (*Stash, error) {
+	ctx := context.Background()
+	stashName := PreviousName(bc.Name)
+
+	// A stash left behind by an interrupted deploy is outdated by the current container
+	if err := bc.docker.cl.ContainerRemove(ctx, stashName, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+		return nil, err
+	}
+
+	current, err := bc.docker.cl.ContainerInspect(ctx, bc.Name)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stash := &Stash{ID: current.ID, Name: bc.Name, WasRunning: current.State != nil && current.State.Running}
+	log.Default().Printf("Stashing container %s as %s\n", bc.Name, stashName)
+	if err := bc.docker.cl.ContainerRename(ctx, current.ID, stashName); err != nil {
+		return nil, err
+	}
+	if stash.WasRunning {
+		if err := bc.docker.cl.ContainerStop(ctx, current.ID, container.StopOptions{}); err != nil {
+			return stash, err
+		}
+	}
+	return stash, nil
+}
+
+// RestoreContainer renames the stashed container back and starts it if it was running.
+func (bc *BotContainer) RestoreContainer(stash *Stash) error {
+	ctx := context.Background()
+	log.Default().Printf("Restoring container %s\n", stash.Name)
+	if err := bc.docker.cl.ContainerRename(ctx, stash.ID, stash.Name); err != nil {
+		return err
+	}
+	if stash.WasRunning {
+		return bc.docker.cl.ContainerStart(ctx, stash.ID, container.StartOptions{})
+	}
+	return nil
+}
+
+// DropStash removes the stashed container once the new one is deployed.
+func (bc *BotContainer) DropStash(stash *Stash) error {
+	err := bc.docker.cl.ContainerRemove(context.Background(), stash.ID, container.RemoveOptions{Force: true})
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// FindStash returns the container stashed by an interrupted deploy, or nil if there is none.
+func (bc *BotContainer) FindStash() (*Stash, error) {
+	info, err := bc.docker.cl.ContainerInspect(context.Background(), PreviousName(bc.Name))
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Stash{ID: info.ID, Name: bc.Name, WasRunning: info.State != nil && info.State.Running}, nil
+}
@@ -0,0 +1,273 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// watchBackoff caps the delay between reconnects to the Docker events API.
+const watchBackoff = 30 * time.Second
+
+// trackedActions are the container events that change the state of a bot.
+var trackedActions = map[events.Action]bool{
+	events.ActionCreate:  true,
+	events.ActionStart:   true,
+	events.ActionRestart: true,
+	events.ActionStop:    true,
+	events.ActionKill:    true,
+	events.ActionDie:     true,
+	events.ActionOOM:     true,
+	events.ActionPause:   true,
+	events.ActionUnPause: true,
+	events.ActionRename:  true,
+	events.ActionDestroy: true,
+}
+
+// Notify is called for every tracked Docker event of a bot container with the action, the time of
+// the event in nanoseconds, the state of the container before the event (zero if unknown) and after it.
+type Notify func(action string, timeNano int64, previous, current state.Bot)
+
+// WatchBots keeps the store in sync with the bot containers until ctx is done.
+// It subscribes to the Docker events API and resyncs the store from a full listing
+// every time the subscription is (re)established, so no change is missed while disconnected.
+// notify, if not nil, is called for every tracked event.
+func WatchBots(ctx context.Context, store *state.Store, notify Notify) {
+	delay := time.Second
+	for ctx.Err() == nil {
+		err := watchBots(ctx, store, notify)
+		if store.Synced() {
+			// The stream was up, so the daemon is reachable again
+			delay = time.Second
+		}
+		store.SetUnsynced()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Default().Println(fmt.Sprintf("Error: Docker events stream disconnected, resyncing in %s: %+v", delay, err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, watchBackoff)
+	}
+}
+
+func watchBots(ctx context.Context, store *state.Store, notify Notify) error {
+	cl, err := NewClient()
+	if err != nil {
+		return err
+	}
+	defer func(cl *Client) {
+		if err := cl.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(cl)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before listing, so events that happen during the listing aren't lost. Events aren't
+	// filtered by label, containers deployed before the labels are bots as well.
+	messages, errs := cl.cl.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("type", string(events.ContainerEventType))),
+	})
+
+	bots, err := cl.listBots(ctx)
+	if err != nil {
+		return err
+	}
+	store.Replace(bots)
+	log.Default().Printf("Bot state synced, %d containers", len(bots))
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case msg := <-messages:
+			if err := cl.handleEvent(ctx, store, notify, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleEvent updates the store with the current state of the container the event is about.
+func (c *Client) handleEvent(ctx context.Context, store *state.Store, notify Notify, msg events.Message) error {
+	action := events.Action(strings.SplitN(string(msg.Action), ":", 2)[0])
+	if !trackedActions[action] && action != events.ActionHealthStatus {
+		return nil
+	}
+
+	previous, known := store.Lookup(msg.Actor.ID)
+	labeled := msg.Actor.Attributes[LabelManaged] == "true"
+	if !labeled && !known && !legacyName(msg.Actor.Attributes["name"]) {
+		return nil
+	}
+	current := previous
+
+	info, err := c.cl.ContainerInspect(ctx, msg.Actor.ID)
+	switch {
+	case action == events.ActionDestroy || client.IsErrNotFound(err):
+		if !labeled && !known {
+			return nil
+		}
+		store.Delete(msg.Actor.ID)
+		current.State = "removed"
+	case err != nil:
+		return err
+	case !labeled && !known && !isLegacyBot(info):
+		return nil
+	default:
+		current = botState(info)
+		current.LastEvent = string(msg.Action)
+		store.Put(current)
+	}
+
+	if current.ContainerID == "" {
+		// Destroyed before it was ever seen, fill in what the event carries
+		current.ContainerID = msg.Actor.ID
+		current.Name = msg.Actor.Attributes["name"]
+		current.Customer = msg.Actor.Attributes[LabelCustomer]
+		current.Bot = msg.Actor.Attributes[LabelBot]
+	}
+	if notify != nil {
+		notify(string(msg.Action), msg.TimeNano, previous, current)
+	}
+	return nil
+}
+
+// listBots returns the state of all bot containers, labeled or deployed before the labels.
+func (c *Client) listBots(ctx context.Context) ([]state.Bot, error) {
+	containers, err := c.cl.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	bots := make([]state.Bot, 0, len(containers))
+	for _, ctr := range containers {
+		labeled := ctr.Labels[LabelManaged] == "true"
+		if !labeled && (len(ctr.Names) == 0 || !legacyName(ctr.Names[0])) {
+			continue
+		}
+		info, err := c.cl.ContainerInspect(ctx, ctr.ID)
+		if client.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !labeled && !isLegacyBot(info) {
+			continue
+		}
+		bots = append(bots, botState(info))
+	}
+	return bots, nil
+}
+
+// legacyName reports whether a container name could be the name of a bot container, customer_bot.
+func legacyName(name string) bool {
+	return strings.Contains(name, "_")
+}
+
+// isLegacyBot reports whether an unlabeled container was deployed by the builder before its containers
+// were labeled: it carries the platform envs and is named after the customer and bot they name.
+func isLegacyBot(info types.ContainerJSON) bool {
+	if info.ContainerJSONBase == nil || info.Config == nil {
+		return false
+	}
+	customerName := envValue(info.Config.Env, EnvCustomerName)
+	botName := envValue(info.Config.Env, EnvBotName)
+	return customerName != "" && botName != "" &&
+		strings.TrimPrefix(info.Name, "/") == ContainerName(customerName, botName)
+}
+
+// ListBots returns the current state of all bot containers straight from Docker.
+func ListBots(ctx context.Context) ([]state.Bot, error) {
+	cl, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer func(cl *Client) {
+		if err := cl.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(cl)
+	return cl.listBots(ctx)
+}
+
+// InspectBot returns the current state of a container straight from Docker.
+func InspectBot(ctx context.Context, ref string) (state.Bot, error) {
+	cl, err := NewClient()
+	if err != nil {
+		return state.Bot{}, err
+	}
+	defer func(cl *Client) {
+		if err := cl.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(cl)
+
+	info, err := cl.cl.ContainerInspect(ctx, ref)
+	if err != nil {
+		return state.Bot{}, err
+	}
+	return botState(info), nil
+}
+
+// botState converts the inspected container into its bot state.
+func botState(info types.ContainerJSON) state.Bot {
+	bot := state.Bot{
+		ContainerID:  info.ID,
+		Name:         strings.TrimPrefix(info.Name, "/"),
+		RestartCount: info.RestartCount,
+		UpdatedAt:    time.Now().UTC(),
+	}
+	if info.Config != nil {
+		bot.Customer = info.Config.Labels[LabelCustomer]
+		bot.Bot = info.Config.Labels[LabelBot]
+		bot.Image = imageRef(info.Config)
+		// Containers deployed before they were labeled are recognized by the platform envs
+		if bot.Customer == "" {
+			bot.Customer = envValue(info.Config.Env, EnvCustomerName)
+		}
+		if bot.Bot == "" {
+			bot.Bot = envValue(info.Config.Env, EnvBotName)
+		}
+	}
+	if info.HostConfig != nil {
+		bot.Memory = info.HostConfig.Memory
+		bot.NanoCPUs = info.HostConfig.NanoCPUs
+	}
+	if s := info.State; s != nil {
+		bot.State = s.Status
+		bot.ExitCode = s.ExitCode
+		bot.OOMKilled = s.OOMKilled
+		if s.Health != nil {
+			bot.Health = s.Health.Status
+		}
+		bot.StartedAt = parseTime(s.StartedAt)
+		bot.FinishedAt = parseTime(s.FinishedAt)
+	}
+	return bot
+}
+
+// parseTime parses a Docker timestamp. Docker reports unset times as the zero time.
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || t.Year() <= 1 {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBotState(t *testing.T) {
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   "4f2a9c01",
+			Name: "/acme_mybot",
+			State: &types.ContainerState{
+				Status:     "exited",
+				ExitCode:   137,
+				OOMKilled:  true,
+				StartedAt:  "2024-05-01T10:00:00.123456789Z",
+				FinishedAt: "2024-05-01T11:00:00Z",
+				Health:     &types.Health{Status: "unhealthy"},
+			},
+			HostConfig: &container.HostConfig{Resources: container.Resources{Memory: 256 << 20, NanoCPUs: 5e8}},
+		},
+		Config: &container.Config{
+			Image:  "acme_mybot:latest",
+			Labels: map[string]string{LabelManaged: "true", LabelCustomer: "acme", LabelBot: "mybot"},
+		},
+	}
+
+	bot := botState(info)
+
+	assert.Equal(t, "4f2a9c01", bot.ContainerID)
+	assert.Equal(t, "acme_mybot", bot.Name)
+	assert.Equal(t, "acme", bot.Customer)
+	assert.Equal(t, "mybot", bot.Bot)
+	assert.Equal(t, "acme_mybot:latest", bot.Image)
+	assert.Equal(t, "exited", bot.State)
+	assert.Equal(t, 137, bot.ExitCode)
+	assert.True(t, bot.OOMKilled)
+	assert.Equal(t, "unhealthy", bot.Health)
+	assert.Equal(t, int64(256<<20), bot.Memory)
+	assert.Equal(t, int64(5e8), bot.NanoCPUs)
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.UTC), bot.StartedAt)
+	assert.Equal(t, time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), bot.FinishedAt)
+}
+
+func TestBotState_UnlabeledContainer(t *testing.T) {
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    "4f2a9c01",
+			Name:  "/acme_mybot",
+			State: &types.ContainerState{Status: "created", StartedAt: "0001-01-01T00:00:00Z"},
+		},
+		Config: &container.Config{Env: []string{EnvCustomerName + "=acme", EnvBotName + "=mybot"}},
+	}
+
+	bot := botState(info)
+
+	assert.Equal(t, "acme", bot.Customer)
+	assert.Equal(t, "mybot", bot.Bot)
+	assert.True(t, bot.StartedAt.IsZero())
+}
+
+func TestContainerConfig_Labels(t *testing.T) {
+	bc := &BotContainer{
+		ID:    "0123456789abcdef",
+		Image: "acme_mybot:latest",
+		Envs:  []string{EnvCustomerName + "=acme", EnvBotName + "=mybot"},
+		Config: &container.Config{
+			Hostname: "0123456789ab",
+			User:     "node",
+			Cmd:      []string{"node", "old.js"},
+			Labels: map[string]string{
+				"sensority.cradle.template":        "ts",
+				"org.opencontainers.image.version": "1.0",
+				"com.example.team":                 "payments",
+				LabelManaged:                       "true",
+				LabelBot:                           "otherbot",
+			},
+		},
+		imageLabels: map[string]string{"org.opencontainers.image.version": "1.0"},
+	}
+
+	containerConfig, _, _ := bc.containerConfig()
+
+	// Labels of the old image aren't carried over, the new image brings its own
+	assert.Equal(t, map[string]string{
+		"com.example.team": "payments",
+		LabelManaged:       "true",
+		LabelCustomer:      "acme",
+		LabelBot:           "mybot",
+		LabelImage:         "acme_mybot:latest",
+	}, containerConfig.Labels)
+	assert.Equal(t, "node", containerConfig.User)
+	assert.Empty(t, containerConfig.Cmd, "the command comes from the new image")
+	assert.Empty(t, containerConfig.Hostname, "the default hostname of the old container isn't reused")
+	assert.Equal(t, "otherbot", bc.Config.Labels[LabelBot], "the snapshot isn't modified")
+	assert.Equal(t, []string{"node", "old.js"}, []string(bc.Config.Cmd))
+}
+
+// addLegacyBots adds a labeled bot, a bot deployed before the labels and containers that aren't bots.
+func addLegacyBots(t *testing.T, d *dockertest.Daemon) (labeled, legacy, other string) {
+	d.AddImage(container.Config{}, "acme_mybot:latest", "acme_oldbot:latest", "postgres:16")
+	envs := func(bot string) []string { return []string{EnvCustomerName + "=acme", EnvBotName + "=" + bot} }
+	labeled, err := d.AddContainer("acme_mybot", container.Config{
+		Image:  "acme_mybot:latest",
+		Env:    envs("mybot"),
+		Labels: map[string]string{LabelManaged: "true", LabelCustomer: "acme", LabelBot: "mybot"},
+	}, container.HostConfig{}, "running")
+	require.NoError(t, err)
+	legacy, err = d.AddContainer("acme_oldbot", container.Config{Image: "acme_oldbot:latest", Env: envs("oldbot")}, container.HostConfig{}, "exited")
+	require.NoError(t, err)
+	_, err = d.AddContainer("postgres", container.Config{Image: "postgres:16"}, container.HostConfig{}, "running")
+	require.NoError(t, err)
+	// Named like a bot, but its envs name another one
+	other, err = d.AddContainer("acme_copy", container.Config{Image: "acme_oldbot:latest", Env: envs("oldbot")}, container.HostConfig{}, "running")
+	require.NoError(t, err)
+	return labeled, legacy, other
+}
+
+func TestListBots_LegacyContainers(t *testing.T) {
+	d := dockertest.New(t)
+	labeled, legacy, _ := addLegacyBots(t, d)
+
+	bots, err := ListBots(context.Background())
+
+	require.NoError(t, err)
+	var ids []string
+	for _, bot := range bots {
+		ids = append(ids, bot.ContainerID)
+		if bot.ContainerID == legacy {
+			assert.Equal(t, "acme", bot.Customer)
+			assert.Equal(t, "oldbot", bot.Bot)
+			assert.Equal(t, "exited", bot.State)
+		}
+	}
+	assert.ElementsMatch(t, []string{labeled, legacy}, ids)
+}
+
+func TestHandleEvent_LegacyContainers(t *testing.T) {
+	d := dockertest.New(t)
+	labeled, legacy, other := addLegacyBots(t, d)
+	postgres, ok := d.Container("postgres")
+	require.True(t, ok)
+	c, err := NewClient()
+	require.NoError(t, err)
+	defer c.Close()
+	store := state.NewStore()
+	var notified []string
+	notify := func(action string, _ int64, _, current state.Bot) { notified = append(notified, current.Name) }
+
+	event := func(id, name string, labels map[string]string) events.Message {
+		attributes := map[string]string{"name": name}
+		for k, v := range labels {
+			attributes[k] = v
+		}
+		return events.Message{Action: events.ActionStart, Actor: events.Actor{ID: id, Attributes: attributes}}
+	}
+	require.NoError(t, c.handleEvent(context.Background(), store, notify, event(labeled, "acme_mybot", map[string]string{LabelManaged: "true"})))
+	require.NoError(t, c.handleEvent(context.Background(), store, notify, event(legacy, "acme_oldbot", nil)))
+	require.NoError(t, c.handleEvent(context.Background(), store, notify, event(postgres.ID, "postgres", nil)))
+	require.NoError(t, c.handleEvent(context.Background(), store, notify, event(other, "acme_copy", nil)))
+
+	assert.Equal(t, []string{"acme_mybot", "acme_oldbot"}, notified)
+	bot, ok := store.Lookup(legacy)
+	require.True(t, ok)
+	assert.Equal(t, "oldbot", bot.Bot)
+	_, ok = store.Lookup(postgres.ID)
+	assert.False(t, ok)
+	_, ok = store.Lookup(other)
+	assert.False(t, ok)
+}
@@ -0,0 +1,52 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ValidationError is caused by invalid input from the caller rather than by a failure of the builder.
+type ValidationError struct {
+	msg string
+}
+
+func (e *ValidationError) Error() string {
+	return e.msg
+}
+
+// Validation returns a ValidationError with a formatted message.
+func Validation(format string, args ...any) error {
+	return &ValidationError{msg: fmt.Sprintf(format, args...)}
+}
+
+// IsValidation reports whether any error in err's chain is a ValidationError.
+func IsValidation(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr)
+}
+
+// QuotaError is caused by a customer exceeding one of their quotas. Rate limits can be retried later,
+// the other limits need bots to be removed or the quota to be raised.
+type QuotaError struct {
+	Limit       string        // Name of the exceeded limit, e.g. maxBots
+	RateLimited bool          // Whether the limit is on the rate of requests
+	RetryAfter  time.Duration // When a rate limited request may be retried, zero if unknown
+	msg         string
+}
+
+func (e *QuotaError) Error() string {
+	return e.msg
+}
+
+// Quota returns a QuotaError for the exceeded limit with a formatted message.
+func Quota(limit string, format string, args ...any) *QuotaError {
+	return &QuotaError{Limit: limit, msg: fmt.Sprintf(format, args...)}
+}
+
+// AsQuota returns the QuotaError in err's chain, if any.
+func AsQuota(err error) (*QuotaError, bool) {
+	var quotaErr *QuotaError
+	ok := errors.As(err, &quotaErr)
+	return quotaErr, ok
+}
@@ -0,0 +1,411 @@
+package fleet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// Operation statuses.
+const (
+	StatusRunning   = "running"
+	StatusPaused    = "paused"
+	StatusCanceled  = "canceled"
+	StatusCompleted = "completed"
+)
+
+// Target statuses.
+const (
+	TargetPending   = "pending"
+	TargetRunning   = "running"
+	TargetSucceeded = "succeeded"
+	TargetFailed    = "failed"
+	TargetSkipped   = "skipped"
+)
+
+// Options of a rollout.
+type Options struct {
+	Concurrency   int           `json:"concurrency"`   // Bots rolled out at once, also the size of a batch
+	MaxFailures   int           `json:"maxFailures"`   // Failures after which the rollout pauses
+	HealthTimeout time.Duration `json:"healthTimeout"` // How long a bot has to become healthy after its rollout
+	BatchInterval time.Duration `json:"batchInterval"` // Pause between batches
+}
+
+// Target is a bot an operation rolls out to.
+type Target struct {
+	Customer    string     `json:"customer"`
+	Bot         string     `json:"bot"`
+	Status      string     `json:"status"`
+	JobID       string     `json:"jobId,omitempty"`
+	ContainerID string     `json:"containerId,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Operation is a rollout to many bots and its progress.
+type Operation struct {
+	ID      string  `json:"id"`
+	Kind    string  `json:"kind"`
+	Status  string  `json:"status"`
+	Options Options `json:"options"`
+	Params  any     `json:"params,omitempty"` // What the operation rolls out, for the record
+
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+
+	Targets    []Target   `json:"targets"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Result is the outcome of rolling out to one bot.
+type Result struct {
+	JobID       string
+	ContainerID string
+}
+
+// ErrSkipped marks bots a step had nothing to do for. They don't count as failures.
+var ErrSkipped = errors.New("skipped")
+
+// Skip returns the error of a step that had nothing to do for a bot.
+func Skip(reason string) error {
+	return fmt.Errorf("%w: %s", ErrSkipped, reason)
+}
+
+// Step rolls out to one bot.
+type Step func(ctx context.Context, target Target) (Result, error)
+
+// Check reports whether a rolled out container is healthy, waiting up to timeout for it to settle.
+type Check func(ctx context.Context, containerID string, timeout time.Duration) error
+
+// run is an operation in progress.
+type run struct {
+	mu       sync.Mutex
+	op       Operation
+	failures int // Failures since the rollout started or was resumed
+
+	resume chan struct{}
+	cancel context.CancelFunc
+}
+
+// Manager runs fleet operations and keeps their progress in memory.
+type Manager struct {
+	mu   sync.Mutex
+	runs map[string]*run
+}
+
+func NewManager() *Manager {
+	return &Manager{runs: make(map[string]*run)}
+}
+
+// Start rolls out step to the targets in batches of opts.Concurrency bots, opts.BatchInterval
+// apart. Every rolled out bot is checked with check before the next batch starts. Once opts.MaxFailures bots failed, the rollout pauses until
+// it is resumed or canceled. Targets already marked skipped are left out.
+func (m *Manager) Start(kind string, params any, targets []Target, opts Options, step Step, check Check) Operation {
+	opts.Concurrency = max(opts.Concurrency, 1)
+	opts.MaxFailures = max(opts.MaxFailures, 1)
+
+	now := time.Now().UTC()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &run{
+		op: Operation{
+			ID:        newID(),
+			Kind:      kind,
+			Status:    StatusRunning,
+			Options:   opts,
+			Params:    params,
+			Targets:   slices.Clone(targets),
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		resume: make(chan struct{}, 1),
+		cancel: cancel,
+	}
+	for i := range r.op.Targets {
+		if r.op.Targets[i].Status != TargetSkipped {
+			r.op.Targets[i].Status = TargetPending
+		}
+	}
+	r.count()
+
+	m.mu.Lock()
+	m.runs[r.op.ID] = r
+	m.mu.Unlock()
+
+	log.Default().Printf("Fleet operation %s (%s) started for %d bots", r.op.ID, kind, r.op.Total)
+	go r.rollout(ctx, step, check)
+	return r.snapshot()
+}
+
+// Get returns the progress of an operation.
+func (m *Manager) Get(id string) (Operation, error) {
+	r, err := m.get(id)
+	if err != nil {
+		return Operation{}, err
+	}
+	return r.snapshot(), nil
+}
+
+// List returns all operations, newest first.
+func (m *Manager) List() []Operation {
+	m.mu.Lock()
+	runs := make([]*run, 0, len(m.runs))
+	for _, r := range m.runs {
+		runs = append(runs, r)
+	}
+	m.mu.Unlock()
+
+	ops := make([]Operation, 0, len(runs))
+	for _, r := range runs {
+		ops = append(ops, r.snapshot())
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].CreatedAt.After(ops[j].CreatedAt)
+	})
+	return ops
+}
+
+// Resume continues a paused operation. It may fail another opts.MaxFailures bots before it pauses again.
+func (m *Manager) Resume(id string) (Operation, error) {
+	r, err := m.get(id)
+	if err != nil {
+		return Operation{}, err
+	}
+	r.mu.Lock()
+	if r.op.Status != StatusPaused {
+		status := r.op.Status
+		r.mu.Unlock()
+		return Operation{}, errdefs.Conflict(fmt.Errorf("operation is %s, only paused operations can be resumed", status))
+	}
+	r.failures = 0
+	r.setStatus(StatusRunning)
+	r.mu.Unlock()
+
+	select {
+	case r.resume <- struct{}{}:
+	default:
+	}
+	return r.snapshot(), nil
+}
+
+// Cancel stops an operation. Bots being rolled out finish their rollout and health check, no new ones are started.
+func (m *Manager) Cancel(id string) (Operation, error) {
+	r, err := m.get(id)
+	if err != nil {
+		return Operation{}, err
+	}
+	r.mu.Lock()
+	if r.op.Status == StatusCompleted || r.op.Status == StatusCanceled {
+		status := r.op.Status
+		r.mu.Unlock()
+		return Operation{}, errdefs.Conflict(fmt.Errorf("operation is already %s", status))
+	}
+	r.setStatus(StatusCanceled)
+	r.mu.Unlock()
+	r.cancel()
+	return r.snapshot(), nil
+}
+
+func (m *Manager) get(id string) (*run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.runs[id]
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("no such fleet operation: %s", id))
+	}
+	return r, nil
+}
+
+func (r *run) rollout(ctx context.Context, step Step, check Check) {
+	defer r.cancel()
+
+	var pending []int
+	for i, target := range r.op.Targets {
+		if target.Status == TargetPending {
+			pending = append(pending, i)
+		}
+	}
+
+	for len(pending) > 0 {
+		if !r.waitIfPaused(ctx) {
+			break
+		}
+		batch := pending[:min(r.op.Options.Concurrency, len(pending))]
+		pending = pending[len(batch):]
+		r.runBatch(batch, step, check)
+		if len(pending) > 0 && !sleep(ctx, r.op.Options.BatchInterval) {
+			break
+		}
+	}
+
+	r.finish()
+}
+
+func (r *run) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.op.Status == StatusCanceled {
+		for i := range r.op.Targets {
+			if r.op.Targets[i].Status == TargetPending {
+				r.op.Targets[i].Status = TargetSkipped
+				r.op.Targets[i].Error = "operation canceled"
+			}
+		}
+		r.count()
+	} else {
+		r.setStatus(StatusCompleted)
+	}
+	finishedAt := r.op.UpdatedAt
+	r.op.FinishedAt = &finishedAt
+	log.Default().Printf("Fleet operation %s %s: %d succeeded, %d failed, %d skipped", r.op.ID, r.op.Status, r.op.Succeeded, r.op.Failed, r.op.Skipped)
+}
+
+// waitIfPaused blocks while the operation is paused. It reports false once the operation is canceled.
+func (r *run) waitIfPaused(ctx context.Context) bool {
+	for {
+		r.mu.Lock()
+		status := r.op.Status
+		r.mu.Unlock()
+		switch status {
+		case StatusRunning:
+			return true
+		case StatusCanceled:
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-r.resume:
+		}
+	}
+}
+
+// sleep waits for d. It reports false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// runBatch rolls out to the batch's targets concurrently and checks the health of the rolled out bots.
+// Rollouts that started aren't interrupted by a cancel, so they don't get ctx.
+func (r *run) runBatch(batch []int, step Step, check Check) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for _, i := range batch {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := r.startTarget(i)
+			res, err := step(ctx, target)
+			if err == nil && res.ContainerID != "" && check != nil {
+				err = check(ctx, res.ContainerID, r.op.Options.HealthTimeout)
+				if err != nil {
+					err = fmt.Errorf("health check: %w", err)
+				}
+			}
+			r.finishTarget(i, res, err)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (r *run) startTarget(i int) Target {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	r.op.Targets[i].Status = TargetRunning
+	r.op.Targets[i].StartedAt = &now
+	r.count()
+	return r.op.Targets[i]
+}
+
+func (r *run) finishTarget(i int, res Result, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	target := &r.op.Targets[i]
+	target.JobID = res.JobID
+	target.ContainerID = res.ContainerID
+	target.FinishedAt = &now
+	switch {
+	case errors.Is(err, ErrSkipped):
+		target.Status = TargetSkipped
+		target.Error = err.Error()
+	case err != nil:
+		target.Status = TargetFailed
+		target.Error = err.Error()
+		r.failures++
+		log.Default().Println(fmt.Sprintf("Error: fleet operation %s: %s/%s: %+v", r.op.ID, target.Customer, target.Bot, err))
+		if r.failures >= r.op.Options.MaxFailures && r.op.Status == StatusRunning {
+			log.Default().Printf("Fleet operation %s paused after %d failures", r.op.ID, r.failures)
+			r.setStatus(StatusPaused)
+		}
+	default:
+		target.Status = TargetSucceeded
+	}
+	r.count()
+}
+
+// count updates the counters of the operation. r.mu must be held.
+func (r *run) count() {
+	op := &r.op
+	op.Total, op.Pending, op.Succeeded, op.Failed, op.Skipped = len(op.Targets), 0, 0, 0, 0
+	for _, target := range op.Targets {
+		switch target.Status {
+		case TargetPending, TargetRunning:
+			op.Pending++
+		case TargetSucceeded:
+			op.Succeeded++
+		case TargetFailed:
+			op.Failed++
+		case TargetSkipped:
+			op.Skipped++
+		}
+	}
+	op.UpdatedAt = time.Now().UTC()
+}
+
+// setStatus changes the status of the operation. r.mu must be held.
+func (r *run) setStatus(status string) {
+	r.op.Status = status
+	r.op.UpdatedAt = time.Now().UTC()
+}
+
+func (r *run) snapshot() Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op := r.op
+	op.Targets = slices.Clone(r.op.Targets)
+	return op
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,150 @@
+package fleet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func targets(bots ...string) []Target {
+	var t []Target
+	for _, bot := range bots {
+		t = append(t, Target{Customer: "acme", Bot: bot})
+	}
+	return t
+}
+
+func waitFor(t *testing.T, m *Manager, id string, status string) Operation {
+	var op Operation
+	require.Eventually(t, func() bool {
+		var err error
+		op, err = m.Get(id)
+		require.NoError(t, err)
+		return op.Status == status
+	}, 5*time.Second, 5*time.Millisecond)
+	return op
+}
+
+func TestManager_Rollout(t *testing.T) {
+	m := NewManager()
+	var running, maxRunning atomic.Int32
+	step := func(ctx context.Context, target Target) (Result, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			current := maxRunning.Load()
+			if n <= current || maxRunning.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if target.Bot == "unchanged" {
+			return Result{}, Skip("bot is up to date")
+		}
+		return Result{JobID: "job-" + target.Bot, ContainerID: "c-" + target.Bot}, nil
+	}
+	var checked sync.Map
+	check := func(ctx context.Context, containerID string, timeout time.Duration) error {
+		checked.Store(containerID, true)
+		return nil
+	}
+
+	op := m.Start("rebuild", nil, targets("a", "b", "c", "unchanged", "e"), Options{Concurrency: 2}, step, check)
+	op = waitFor(t, m, op.ID, StatusCompleted)
+
+	assert.Equal(t, 5, op.Total)
+	assert.Equal(t, 4, op.Succeeded)
+	assert.Equal(t, 1, op.Skipped)
+	assert.Equal(t, 0, op.Pending)
+	assert.NotNil(t, op.FinishedAt)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(2))
+	assert.Equal(t, "job-a", op.Targets[0].JobID)
+	assert.Equal(t, "skipped: bot is up to date", op.Targets[3].Error)
+	_, ok := checked.Load("c-e")
+	assert.True(t, ok)
+}
+
+func TestManager_PausesAfterFailures(t *testing.T) {
+	m := NewManager()
+	var calls atomic.Int32
+	step := func(ctx context.Context, target Target) (Result, error) {
+		calls.Add(1)
+		return Result{JobID: "job-" + target.Bot, ContainerID: "c-" + target.Bot}, nil
+	}
+	check := func(ctx context.Context, containerID string, timeout time.Duration) error {
+		if containerID == "c-a" {
+			return errors.New("container exited with code 1")
+		}
+		return nil
+	}
+
+	op := m.Start("rebuild", nil, targets("a", "b", "c"), Options{Concurrency: 1, MaxFailures: 1}, step, check)
+	op = waitFor(t, m, op.ID, StatusPaused)
+	assert.Equal(t, int32(1), calls.Load(), "no batch starts after the rollout paused")
+	assert.Equal(t, 1, op.Failed)
+	assert.Equal(t, 2, op.Pending)
+	assert.Equal(t, "health check: container exited with code 1", op.Targets[0].Error)
+
+	_, err := m.Resume(op.ID)
+	require.NoError(t, err)
+	op = waitFor(t, m, op.ID, StatusCompleted)
+	assert.Equal(t, 2, op.Succeeded)
+	assert.Equal(t, 1, op.Failed)
+
+	_, err = m.Resume(op.ID)
+	assert.True(t, errdefs.IsConflict(err))
+}
+
+func TestManager_Cancel(t *testing.T) {
+	m := NewManager()
+	step := func(ctx context.Context, target Target) (Result, error) {
+		return Result{}, errors.New("build failed")
+	}
+
+	op := m.Start("rebuild", nil, targets("a", "b"), Options{Concurrency: 1, MaxFailures: 1}, step, nil)
+	waitFor(t, m, op.ID, StatusPaused)
+	_, err := m.Cancel(op.ID)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		op, _ = m.Get(op.ID)
+		return op.FinishedAt != nil
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, StatusCanceled, op.Status)
+	assert.Equal(t, TargetSkipped, op.Targets[1].Status)
+	assert.Equal(t, "operation canceled", op.Targets[1].Error)
+	assert.Len(t, m.List(), 1)
+}
+
+func TestManager_BatchInterval(t *testing.T) {
+	m := NewManager()
+	var calls atomic.Int32
+	step := func(ctx context.Context, target Target) (Result, error) {
+		calls.Add(1)
+		return Result{}, nil
+	}
+
+	op := m.Start("refresh", nil, targets("a", "b"), Options{Concurrency: 1, BatchInterval: time.Hour}, step, nil)
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, 5*time.Second, 5*time.Millisecond)
+	_, err := m.Cancel(op.ID)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		op, _ = m.Get(op.ID)
+		return op.FinishedAt != nil
+	}, 5*time.Second, 5*time.Millisecond, "a cancel ends the pause between batches")
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, TargetSkipped, op.Targets[1].Status)
+}
+
+func TestManager_UnknownOperation(t *testing.T) {
+	_, err := NewManager().Get("unknown")
+	assert.True(t, errdefs.IsNotFound(err))
+}
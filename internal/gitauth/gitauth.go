@@ -0,0 +1,116 @@
+package gitauth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Credential provider types accepted in Config.Type.
+const (
+	TypeToken     = "token"
+	TypeSSH       = "ssh"
+	TypeGithubApp = "github_app"
+)
+
+// Provider supplies the credentials used to talk to a git remote.
+type Provider interface {
+	AuthMethod(ctx context.Context) (transport.AuthMethod, error)
+}
+
+// Config selects and configures the credential provider of a single repository.
+type Config struct {
+	Type string `json:"type"`
+
+	// Personal access token. Defaults to the builder's GITHUB_TOKEN.
+	Token string `json:"token"`
+
+	// SSH deploy key. Host keys are always verified against KnownHostsFile.
+	User           string `json:"user"`
+	KeyFile        string `json:"key_file"`
+	KeyPassphrase  string `json:"key_passphrase"`
+	KnownHostsFile string `json:"known_hosts_file"`
+
+	// GitHub App installation.
+	AppID          int64  `json:"app_id"`
+	InstallationID int64  `json:"installation_id"`
+	PrivateKeyFile string `json:"private_key_file"`
+	APIURL         string `json:"api_url"`
+}
+
+// New builds the provider described by c. A nil config means token auth with defaultToken.
+func New(c *Config, defaultToken string) (Provider, error) {
+	if c == nil {
+		return NewToken(defaultToken), nil
+	}
+
+	switch c.Type {
+	case "", TypeToken:
+		if c.Token == "" {
+			return NewToken(defaultToken), nil
+		}
+		return NewToken(c.Token), nil
+	case TypeSSH:
+		return NewSSHKey(c.User, c.KeyFile, c.KeyPassphrase, c.KnownHostsFile)
+	case TypeGithubApp:
+		return NewGithubApp(c.APIURL, c.AppID, c.InstallationID, c.PrivateKeyFile)
+	default:
+		return nil, fmt.Errorf("unknown git credential provider %q", c.Type)
+	}
+}
+
+// Token authenticates over HTTPS with a personal access token.
+type Token struct {
+	token string
+}
+
+func NewToken(token string) *Token {
+	return &Token{token: token}
+}
+
+func (t *Token) AuthMethod(context.Context) (transport.AuthMethod, error) {
+	if t.token == "" {
+		return nil, nil
+	}
+	return &githttp.BasicAuth{
+		Username: "username", // Can be anything except an empty string
+		Password: t.token,
+	}, nil
+}
+
+// SSHKey authenticates with a deploy key and verifies the remote against a known_hosts file.
+type SSHKey struct {
+	auth *gitssh.PublicKeys
+}
+
+func NewSSHKey(user, keyFile, passphrase, knownHostsFile string) (*SSHKey, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("ssh credentials require a key file")
+	}
+	if knownHostsFile == "" {
+		return nil, fmt.Errorf("ssh credentials require a known_hosts file")
+	}
+	if user == "" {
+		user = "git"
+	}
+
+	auth, err := gitssh.NewPublicKeysFromFile(user, keyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := gitssh.NewKnownHostsCallback(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	auth.HostKeyCallback = callback
+
+	return &SSHKey{auth: auth}, nil
+}
+
+func (k *SSHKey) AuthMethod(context.Context) (transport.AuthMethod, error) {
+	return k.auth, nil
+}
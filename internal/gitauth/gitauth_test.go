@@ -0,0 +1,197 @@
+package gitauth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/gitauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+func TestNew_DefaultsToToken(t *testing.T) {
+	provider, err := gitauth.New(nil, "secret")
+	require.NoError(t, err)
+
+	auth, err := provider.AuthMethod(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", auth.(*githttp.BasicAuth).Password)
+}
+
+func TestNew_TokenOverride(t *testing.T) {
+	provider, err := gitauth.New(&gitauth.Config{Type: gitauth.TypeToken, Token: "repo-token"}, "secret")
+	require.NoError(t, err)
+
+	auth, err := provider.AuthMethod(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "repo-token", auth.(*githttp.BasicAuth).Password)
+}
+
+func TestNew_EmptyToken(t *testing.T) {
+	provider, err := gitauth.New(nil, "")
+	require.NoError(t, err)
+
+	auth, err := provider.AuthMethod(context.Background())
+
+	assert.NoError(t, err)
+	assert.Nil(t, auth)
+}
+
+func TestNew_UnknownType(t *testing.T) {
+	_, err := gitauth.New(&gitauth.Config{Type: "kerberos"}, "")
+
+	assert.Error(t, err)
+}
+
+func TestSSHKey_VerifiesKnownHosts(t *testing.T) {
+	dir := t.TempDir()
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+	hostPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewPublicKey(hostPub)
+	require.NoError(t, err)
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := "github.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey))) + "\n"
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(line), 0600))
+
+	provider, err := gitauth.New(&gitauth.Config{Type: gitauth.TypeSSH, KeyFile: keyFile, KnownHostsFile: knownHostsFile}, "")
+	require.NoError(t, err)
+	auth, err := provider.AuthMethod(context.Background())
+	require.NoError(t, err)
+	publicKeys := auth.(*gitssh.PublicKeys)
+	assert.Equal(t, "git", publicKeys.User)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("140.82.112.3"), Port: 22}
+	assert.NoError(t, publicKeys.HostKeyCallback("github.com:22", addr, hostKey))
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	require.NoError(t, err)
+	assert.Error(t, publicKeys.HostKeyCallback("github.com:22", addr, otherKey))
+}
+
+func TestSSHKey_RequiresKnownHosts(t *testing.T) {
+	_, err := gitauth.New(&gitauth.Config{Type: gitauth.TypeSSH, KeyFile: "id_ed25519"}, "")
+
+	assert.Error(t, err)
+}
+
+func writeRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyFile, pemBytes, 0600))
+	return key, keyFile
+}
+
+func verifyJWT(t *testing.T, key *rsa.PrivateKey, token string) map[string]any {
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(claimsJSON, &claims))
+	return claims
+}
+
+func TestGithubApp_MintsAndCachesInstallationToken(t *testing.T) {
+	key, keyFile := writeRSAKey(t)
+	mints := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/app/installations/42/access_tokens", r.URL.Path)
+		claims := verifyJWT(t, key, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		assert.Equal(t, "7", claims["iss"])
+		mints++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_installation", "expires_at": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	provider, err := gitauth.New(&gitauth.Config{
+		Type:           gitauth.TypeGithubApp,
+		APIURL:         server.URL,
+		AppID:          7,
+		InstallationID: 42,
+		PrivateKeyFile: keyFile,
+	}, "")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		auth, err := provider.AuthMethod(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "x-access-token", auth.(*githttp.BasicAuth).Username)
+		assert.Equal(t, "ghs_installation", auth.(*githttp.BasicAuth).Password)
+	}
+	assert.Equal(t, 1, mints)
+}
+
+func TestGithubApp_RefreshesExpiringToken(t *testing.T) {
+	_, keyFile := writeRSAKey(t)
+	mints := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mints++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_short", "expires_at": "` + time.Now().Add(30*time.Second).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	provider, err := gitauth.NewGithubApp(server.URL, 7, 42, keyFile)
+	require.NoError(t, err)
+
+	_, err = provider.AuthMethod(context.Background())
+	require.NoError(t, err)
+	_, err = provider.AuthMethod(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, mints)
+}
+
+func TestGithubApp_MintError(t *testing.T) {
+	_, keyFile := writeRSAKey(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "A JSON web token could not be decoded"}`))
+	}))
+	defer server.Close()
+
+	provider, err := gitauth.NewGithubApp(server.URL, 7, 42, keyFile)
+	require.NoError(t, err)
+
+	_, err = provider.AuthMethod(context.Background())
+	assert.ErrorContains(t, err, "A JSON web token could not be decoded")
+}
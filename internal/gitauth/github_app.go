@@ -0,0 +1,174 @@
+package gitauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const defaultGithubAPIURL = "https://api.github.com"
+
+// tokenRefreshMargin is how long before expiry an installation token is replaced.
+const tokenRefreshMargin = time.Minute
+
+// GithubApp authenticates as a GitHub App installation. It mints short-lived
+// installation tokens on demand and reuses them until shortly before they expire.
+type GithubApp struct {
+	apiURL         string
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	client         *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewGithubApp(apiURL string, appID, installationID int64, privateKeyFile string) (*GithubApp, error) {
+	if appID == 0 || installationID == 0 {
+		return nil, fmt.Errorf("github app credentials require app_id and installation_id")
+	}
+	pemBytes, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	if apiURL == "" {
+		apiURL = defaultGithubAPIURL
+	}
+
+	return &GithubApp{
+		apiURL:         strings.TrimSuffix(apiURL, "/"),
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func parsePrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("github app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("github app private key is not an RSA key")
+	}
+	return key, nil
+}
+
+func (a *GithubApp) AuthMethod(ctx context.Context) (transport.AuthMethod, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == "" || time.Now().Add(tokenRefreshMargin).After(a.expiresAt) {
+		token, expiresAt, err := a.mintToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		a.token = token
+		a.expiresAt = expiresAt
+	}
+
+	return &githttp.BasicAuth{
+		Username: "x-access-token",
+		Password: a.token,
+	}, nil
+}
+
+// mintToken exchanges an app JWT for an installation access token.
+func (a *GithubApp) mintToken(ctx context.Context) (string, time.Time, error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", a.apiURL, a.installationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer func(body io.ReadCloser) {
+		if err := body.Close(); err != nil {
+			fmt.Printf("Error closing response body: %v\n", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", time.Time{}, fmt.Errorf("failed to mint github app installation token: unexpected status code: %d: %s", resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", time.Time{}, err
+	}
+	if payload.Token == "" {
+		return "", time.Time{}, fmt.Errorf("github returned an empty installation token")
+	}
+	return payload.Token, payload.ExpiresAt, nil
+}
+
+// jwt builds the RS256 token GitHub expects when authenticating as the app itself.
+func (a *GithubApp) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}{
+		// Backdate to allow for clock drift, GitHub rejects tokens valid for more than 10 minutes
+		IssuedAt:  now.Add(-time.Minute).Unix(),
+		ExpiresAt: now.Add(9 * time.Minute).Unix(),
+		Issuer:    fmt.Sprintf("%d", a.appID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,300 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Kinds of deployments.
+const (
+	DeployBuild     = "build"     // A build replaced the bot's container
+	DeployRecreate  = "recreate"  // The container was recreated with new envs or limits
+	DeployReconcile = "reconcile" // The reconciler created a missing container from the bot's image
+	DeployRefresh   = "refresh"   // A fleet env refresh recreated the container with new platform envs
+)
+
+// Records are kept in customers/<customer>/<bot>/{builds,deployments}.
+var (
+	bucketCustomers   = []byte("customers")
+	bucketBuilds      = []byte("builds")
+	bucketDeployments = []byte("deployments")
+)
+
+// Build is a finished build of a bot.
+type Build struct {
+	JobID    string `json:"jobId"`
+	Customer string `json:"customer"`
+	Bot      string `json:"bot"`
+
+	Template     string `json:"template"`
+	Ref          string `json:"ref,omitempty"`
+	Source       string `json:"source"` // SHA-256 of the uploaded bundle
+	CradleCommit string `json:"cradleCommit,omitempty"`
+	ImageID      string `json:"imageId,omitempty"`
+	CacheHit     bool   `json:"cacheHit"`
+	Logs         string `json:"logs,omitempty"` // Path of the endpoint serving the build log
+
+	RequestID   string `json:"requestId,omitempty"`
+	RequestedBy string `json:"requestedBy,omitempty"`
+
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Duration   float64   `json:"durationSeconds"`
+}
+
+// Version is what a bot ran at some point.
+type Version struct {
+	JobID       string `json:"jobId,omitempty"`
+	ContainerID string `json:"containerId"`
+	ImageID     string `json:"imageId,omitempty"`
+	EnvsHash    string `json:"envsHash,omitempty"`
+}
+
+// Deployment is a change of the container running a bot.
+type Deployment struct {
+	Kind     string    `json:"kind"`
+	Customer string    `json:"customer"`
+	Bot      string    `json:"bot"`
+	Time     time.Time `json:"time"`
+	Version
+
+	// Previous is the version the deployment replaced, nil for the first deployment of a bot
+	Previous *Version `json:"previous,omitempty"`
+}
+
+// History of a bot, newest first.
+type History struct {
+	Builds      []Build      `json:"builds"`
+	Deployments []Deployment `json:"deployments"`
+}
+
+// HashEnvs returns a hash identifying a set of envs regardless of their order, without revealing them.
+func HashEnvs(envs []string) string {
+	sorted := slices.Clone(envs)
+	slices.Sort(sorted)
+	h := sha256.New()
+	for _, env := range sorted {
+		h.Write([]byte(env))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Store persists the builds and deployments of bots in a bbolt database.
+// Records are kept per bot in the order they were recorded.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the history store at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening history store %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketCustomers)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// RecordBuild appends a finished build to the bot's history.
+func (s *Store) RecordBuild(build Build) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := botBucket(tx, build.Customer, build.Bot, bucketBuilds)
+		if err != nil {
+			return err
+		}
+		return appendRecord(bucket, build)
+	})
+}
+
+// RecordDeployment appends a deployment to the bot's history. Its previous version is taken
+// from the bot's last deployment if there is one.
+func (s *Store) RecordDeployment(deployment Deployment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := botBucket(tx, deployment.Customer, deployment.Bot, bucketDeployments)
+		if err != nil {
+			return err
+		}
+		if _, data := bucket.Cursor().Last(); data != nil {
+			var last Deployment
+			if err := json.Unmarshal(data, &last); err != nil {
+				return err
+			}
+			deployment.Previous = &last.Version
+		}
+		return appendRecord(bucket, deployment)
+	})
+}
+
+// History returns up to limit of the latest builds and deployments of a bot.
+func (s *Store) History(customer, bot string, limit int) (*History, error) {
+	history := &History{Builds: []Build{}, Deployments: []Deployment{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		records := botRecords(tx, customer, bot)
+		if records == nil {
+			return nil
+		}
+		if err := latest(records.Bucket(bucketBuilds), limit, &history.Builds); err != nil {
+			return err
+		}
+		return latest(records.Bucket(bucketDeployments), limit, &history.Deployments)
+	})
+	return history, err
+}
+
+// FindBuild returns the latest build of a bot matching match, or nil if there is none.
+func (s *Store) FindBuild(customer, bot string, match func(Build) bool) (*Build, error) {
+	var found *Build
+	err := s.db.View(func(tx *bolt.Tx) error {
+		records := botRecords(tx, customer, bot)
+		if records == nil || records.Bucket(bucketBuilds) == nil {
+			return nil
+		}
+		c := records.Bucket(bucketBuilds).Cursor()
+		for k, data := c.Last(); k != nil; k, data = c.Prev() {
+			var build Build
+			if err := json.Unmarshal(data, &build); err != nil {
+				return err
+			}
+			if match(build) {
+				found = &build
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Bots returns the names of the customer's bots that have a history.
+func (s *Store) Bots(customer string) ([]string, error) {
+	var bots []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		customerBots := tx.Bucket(bucketCustomers).Bucket([]byte(customer))
+		if customerBots == nil {
+			return nil
+		}
+		return customerBots.ForEachBucket(func(name []byte) error {
+			bots = append(bots, string(name))
+			return nil
+		})
+	})
+	return bots, err
+}
+
+// Sources returns the archived sources of all recorded builds and the customers that built them.
+func (s *Store) Sources() (map[string][]string, error) {
+	sources := make(map[string][]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return forEachBot(tx, func(customer string, records *bolt.Bucket) error {
+			builds := records.Bucket(bucketBuilds)
+			if builds == nil {
+				return nil
+			}
+			return builds.ForEach(func(_, data []byte) error {
+				var build Build
+				if err := json.Unmarshal(data, &build); err != nil {
+					return err
+				}
+				if build.Source != "" && !slices.Contains(sources[build.Source], customer) {
+					sources[build.Source] = append(sources[build.Source], customer)
+				}
+				return nil
+			})
+		})
+	})
+	return sources, err
+}
+
+// DeleteCustomer removes the builds and deployments of all the customer's bots.
+func (s *Store) DeleteCustomer(customer string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketCustomers).DeleteBucket([]byte(customer))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// forEachBot calls fn with the records of every bot.
+func forEachBot(tx *bolt.Tx, fn func(customer string, records *bolt.Bucket) error) error {
+	customers := tx.Bucket(bucketCustomers)
+	return customers.ForEachBucket(func(customer []byte) error {
+		bots := customers.Bucket(customer)
+		return bots.ForEachBucket(func(bot []byte) error {
+			return fn(string(customer), bots.Bucket(bot))
+		})
+	})
+}
+
+// botRecords returns the bucket with the bot's records, nil if the bot has no history.
+func botRecords(tx *bolt.Tx, customer, bot string) *bolt.Bucket {
+	bots := tx.Bucket(bucketCustomers).Bucket([]byte(customer))
+	if bots == nil {
+		return nil
+	}
+	return bots.Bucket([]byte(bot))
+}
+
+func botBucket(tx *bolt.Tx, customer, bot string, name []byte) (*bolt.Bucket, error) {
+	bots, err := tx.Bucket(bucketCustomers).CreateBucketIfNotExists([]byte(customer))
+	if err != nil {
+		return nil, err
+	}
+	records, err := bots.CreateBucketIfNotExists([]byte(bot))
+	if err != nil {
+		return nil, err
+	}
+	return records.CreateBucketIfNotExists(name)
+}
+
+// appendRecord stores v under the bucket's next sequence number, so records sort in the order they were added.
+func appendRecord(bucket *bolt.Bucket, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return bucket.Put(key, data)
+}
+
+// latest decodes up to limit of the bucket's last records into records, newest first.
+func latest[T any](bucket *bolt.Bucket, limit int, records *[]T) error {
+	if bucket == nil {
+		return nil
+	}
+	c := bucket.Cursor()
+	for k, data := c.Last(); k != nil && len(*records) < limit; k, data = c.Prev() {
+		var record T
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		*records = append(*records, record)
+	}
+	return nil
+}
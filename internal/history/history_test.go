@@ -0,0 +1,111 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStore_History(t *testing.T) {
+	store := openStore(t)
+	for _, jobID := range []string{"job1", "job2", "job3"} {
+		require.NoError(t, store.RecordBuild(Build{JobID: jobID, Customer: "acme", Bot: "mybot", Status: "succeeded"}))
+	}
+	require.NoError(t, store.RecordBuild(Build{JobID: "other", Customer: "acme", Bot: "otherbot"}))
+
+	history, err := store.History("acme", "mybot", 2)
+	require.NoError(t, err)
+	require.Len(t, history.Builds, 2)
+	assert.Equal(t, "job3", history.Builds[0].JobID)
+	assert.Equal(t, "job2", history.Builds[1].JobID)
+	assert.Empty(t, history.Deployments)
+}
+
+func TestStore_RecordDeployment_Previous(t *testing.T) {
+	store := openStore(t)
+	first := Deployment{Kind: DeployBuild, Customer: "acme", Bot: "mybot", Time: time.Now(),
+		Version:  Version{JobID: "job1", ContainerID: "c1", ImageID: "sha256:a", EnvsHash: "e1"},
+		Previous: &Version{ContainerID: "c0"}}
+	second := Deployment{Kind: DeployRecreate, Customer: "acme", Bot: "mybot", Time: time.Now(),
+		Version: Version{ContainerID: "c2", ImageID: "sha256:a", EnvsHash: "e2"}}
+	require.NoError(t, store.RecordDeployment(first))
+	require.NoError(t, store.RecordDeployment(second))
+
+	history, err := store.History("acme", "mybot", 10)
+	require.NoError(t, err)
+	require.Len(t, history.Deployments, 2)
+	assert.Equal(t, "c2", history.Deployments[0].ContainerID)
+	assert.Equal(t, &first.Version, history.Deployments[0].Previous)
+	assert.Equal(t, &Version{ContainerID: "c0"}, history.Deployments[1].Previous, "without an earlier record the given previous version is kept")
+}
+
+func TestStore_History_UnknownBot(t *testing.T) {
+	history, err := openStore(t).History("acme", "mybot", 10)
+	require.NoError(t, err)
+	assert.Empty(t, history.Builds)
+	assert.Empty(t, history.Deployments)
+}
+
+func TestStore_BotsAndSources(t *testing.T) {
+	store := openStore(t)
+	require.NoError(t, store.RecordBuild(Build{Customer: "acme", Bot: "mybot", Source: "s1"}))
+	require.NoError(t, store.RecordBuild(Build{Customer: "acme", Bot: "otherbot", Source: "s2"}))
+	require.NoError(t, store.RecordBuild(Build{Customer: "globex", Bot: "mybot", Source: "s2"}))
+	require.NoError(t, store.RecordDeployment(Deployment{Kind: DeployReconcile, Customer: "acme", Bot: "restored"}))
+
+	bots, err := store.Bots("acme")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mybot", "otherbot", "restored"}, bots)
+
+	sources, err := store.Sources()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme"}, sources["s1"])
+	assert.ElementsMatch(t, []string{"acme", "globex"}, sources["s2"])
+}
+
+func TestStore_DeleteCustomer(t *testing.T) {
+	store := openStore(t)
+	require.NoError(t, store.RecordBuild(Build{Customer: "acme", Bot: "mybot", Source: "s1"}))
+	require.NoError(t, store.RecordDeployment(Deployment{Kind: DeployBuild, Customer: "acme", Bot: "mybot"}))
+	require.NoError(t, store.RecordBuild(Build{Customer: "globex", Bot: "mybot", Source: "s2"}))
+
+	require.NoError(t, store.DeleteCustomer("acme"))
+	require.NoError(t, store.DeleteCustomer("initech"), "a customer without a history has nothing to delete")
+
+	history, err := store.History("acme", "mybot", 10)
+	require.NoError(t, err)
+	assert.Empty(t, history.Builds)
+	assert.Empty(t, history.Deployments)
+	sources, err := store.Sources()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"s2": {"globex"}}, sources)
+}
+
+func TestStore_SeparatesCollidingNames(t *testing.T) {
+	store := openStore(t)
+	require.NoError(t, store.RecordBuild(Build{JobID: "job1", Customer: "a_b", Bot: "c"}))
+	require.NoError(t, store.RecordBuild(Build{JobID: "job2", Customer: "a", Bot: "b_c"}))
+
+	history, err := store.History("a", "b_c", 10)
+	require.NoError(t, err)
+	require.Len(t, history.Builds, 1)
+	assert.Equal(t, "job2", history.Builds[0].JobID)
+	bots, err := store.Bots("a_b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, bots)
+}
+
+func TestHashEnvs(t *testing.T) {
+	assert.Equal(t, HashEnvs([]string{"A=1", "B=2"}), HashEnvs([]string{"B=2", "A=1"}))
+	assert.NotEqual(t, HashEnvs([]string{"A=1", "B=2"}), HashEnvs([]string{"A=1", "B=3"}))
+}
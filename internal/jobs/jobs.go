@@ -0,0 +1,271 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Job statuses.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Deploy steps recorded on a job, so an interrupted deploy can be recovered.
+const (
+	StepCheckout = "checkout"
+	StepBuild    = "build"
+	StepEnvs     = "envs"
+	StepStash    = "stash"
+	StepCreate   = "create"
+	StepStart    = "start"
+	StepRegister = "register"
+	StepDone     = "done"
+)
+
+var stepOrder = []string{StepCheckout, StepBuild, StepEnvs, StepStash, StepCreate, StepStart, StepRegister, StepDone}
+
+var bucketJobs = []byte("jobs")
+
+// Job is a build requested by core, persisted so its outcome survives restarts of the builder.
+type Job struct {
+	ID       string `json:"id"`
+	Customer string `json:"customer"`
+	Bot      string `json:"bot"`
+	Template string `json:"template"`
+	Ref      string `json:"ref,omitempty"`
+	Bundle   string `json:"bundle"` // SHA-256 of the uploaded bundle
+
+	RequestID   string `json:"requestId,omitempty"`
+	RequestedBy string `json:"requestedBy,omitempty"`
+	Priority    string `json:"priority,omitempty"` // Priority class the build was queued with
+	Fleet       bool   `json:"fleet,omitempty"`    // Rebuild of a fleet operation, exempt from the customer's build rates
+
+	Status string `json:"status"`
+	Step   string `json:"step"`
+	Error  string `json:"error,omitempty"`
+
+	// Progress of the deploy, needed to undo or finish it after a restart
+	KeptImage       bool   `json:"keptImage"`
+	StashID         string `json:"stashId,omitempty"`
+	StashWasRunning bool   `json:"stashWasRunning,omitempty"`
+	ContainerID     string `json:"containerId,omitempty"`
+	ImageID         string `json:"imageId,omitempty"`
+	EnvsHash        string `json:"envsHash,omitempty"`
+
+	CradleCommit        string `json:"cradleCommit,omitempty"`
+	CacheHit            bool   `json:"cacheHit"`
+	RegistrationPending bool   `json:"registrationPending"`
+
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"` // When the build left the queue
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Finished reports whether the job has a definitive outcome.
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+// Reached reports whether the deploy got to step, or past it.
+func (j *Job) Reached(step string) bool {
+	return slices.Index(stepOrder, j.Step) >= slices.Index(stepOrder, step)
+}
+
+// Store persists jobs in a bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the job store at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening job store %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketJobs)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create stores a new job and assigns its ID. The job is running unless it is created queued.
+func (s *Store) Create(job *Job) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	job.ID = hex.EncodeToString(id)
+	if job.Status != StatusQueued {
+		job.Status = StatusRunning
+	}
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, job)
+	})
+}
+
+// Update applies fn to the stored job and saves it. job is updated to the stored state.
+func (s *Store) Update(job *Job, fn func(*Job)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		stored, err := get(tx, job.ID)
+		if err != nil {
+			return err
+		}
+		fn(stored)
+		stored.UpdatedAt = time.Now().UTC()
+		if stored.Finished() && stored.FinishedAt == nil {
+			finishedAt := stored.UpdatedAt
+			stored.FinishedAt = &finishedAt
+		}
+		if err := put(tx, stored); err != nil {
+			return err
+		}
+		*job = *stored
+		return nil
+	})
+}
+
+// Get returns the job with the given ID.
+func (s *Store) Get(id string) (*Job, error) {
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = get(tx, id)
+		return err
+	})
+	return job, err
+}
+
+// Unfinished returns the jobs that were queued or running, oldest first.
+func (s *Store) Unfinished() ([]*Job, error) {
+	var unfinished []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobs).ForEach(func(_, data []byte) error {
+			var job Job
+			if err := json.Unmarshal(data, &job); err != nil {
+				return err
+			}
+			if !job.Finished() {
+				unfinished = append(unfinished, &job)
+			}
+			return nil
+		})
+	})
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].CreatedAt.Before(unfinished[j].CreatedAt)
+	})
+	return unfinished, err
+}
+
+// Bundles returns the bundles of all kept jobs and the customers whose jobs built them.
+func (s *Store) Bundles() (map[string][]string, error) {
+	bundles := make(map[string][]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobs).ForEach(func(_, data []byte) error {
+			var job Job
+			if err := json.Unmarshal(data, &job); err != nil {
+				return err
+			}
+			if job.Bundle != "" && !slices.Contains(bundles[job.Bundle], job.Customer) {
+				bundles[job.Bundle] = append(bundles[job.Bundle], job.Customer)
+			}
+			return nil
+		})
+	})
+	return bundles, err
+}
+
+// Prune removes the jobs that finished before the given time. Unfinished jobs are kept.
+func (s *Store) Prune(before time.Time) (int, error) {
+	var expired [][]byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketJobs)
+		if err := bucket.ForEach(func(k, data []byte) error {
+			var job Job
+			if err := json.Unmarshal(data, &job); err != nil {
+				return err
+			}
+			if job.FinishedAt != nil && job.FinishedAt.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Run prunes the jobs older than retention every interval until ctx is done. Zero retention keeps them forever.
+func (s *Store) Run(ctx context.Context, interval, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if pruned, err := s.Prune(time.Now().Add(-retention)); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: pruning build jobs: %+v", err))
+		} else if pruned > 0 {
+			log.Default().Printf("Pruned %d build jobs", pruned)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func get(tx *bolt.Tx, id string) (*Job, error) {
+	data := tx.Bucket(bucketJobs).Get([]byte(id))
+	if data == nil {
+		return nil, errdefs.NotFound(fmt.Errorf("no such job: %s", id))
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func put(tx *bolt.Tx, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketJobs).Put([]byte(job.ID), data)
+}
@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T, path string) *Store {
+	store, err := Open(path)
+	require.NoError(t, err)
+	return store
+}
+
+func TestStore_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "builder.db")
+	store := openStore(t, path)
+
+	running := &Job{Customer: "acme", Bot: "mybot", Step: StepCheckout}
+	require.NoError(t, store.Create(running))
+	finished := &Job{Customer: "acme", Bot: "otherbot", Step: StepCheckout}
+	require.NoError(t, store.Create(finished))
+	require.NoError(t, store.Update(running, func(j *Job) { j.Step, j.ContainerID = StepStart, "4f2a9c01" }))
+	require.NoError(t, store.Update(finished, func(j *Job) { j.Status = StatusSucceeded }))
+	assert.NotNil(t, finished.FinishedAt)
+	require.NoError(t, store.Close())
+
+	store = openStore(t, path)
+	defer store.Close()
+	unfinished, err := store.Unfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	assert.Equal(t, running.ID, unfinished[0].ID)
+	assert.Equal(t, StatusRunning, unfinished[0].Status)
+	assert.Equal(t, StepStart, unfinished[0].Step)
+	assert.Equal(t, "4f2a9c01", unfinished[0].ContainerID)
+
+	job, err := store.Get(finished.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, job.Status)
+}
+
+func TestStore_CreateQueued(t *testing.T) {
+	store := openStore(t, filepath.Join(t.TempDir(), "builder.db"))
+	defer store.Close()
+
+	queued := &Job{Customer: "acme", Bot: "mybot", Status: StatusQueued, Step: StepCheckout}
+	require.NoError(t, store.Create(queued))
+	assert.False(t, queued.Finished())
+
+	unfinished, err := store.Unfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	assert.Equal(t, StatusQueued, unfinished[0].Status)
+}
+
+func TestStore_GetUnknown(t *testing.T) {
+	store := openStore(t, filepath.Join(t.TempDir(), "builder.db"))
+	defer store.Close()
+
+	_, err := store.Get("unknown")
+	assert.True(t, errdefs.IsNotFound(err))
+}
+
+func TestJob_Reached(t *testing.T) {
+	job := &Job{Step: StepStash}
+	assert.True(t, job.Reached(StepBuild))
+	assert.True(t, job.Reached(StepStash))
+	assert.False(t, job.Reached(StepCreate))
+}
+
+func TestStore_Prune(t *testing.T) {
+	store := openStore(t, filepath.Join(t.TempDir(), "builder.db"))
+	defer store.Close()
+	cutoff := time.Now().Add(-720 * time.Hour)
+	finish := func(job *Job, at time.Time) {
+		require.NoError(t, store.Create(job))
+		require.NoError(t, store.Update(job, func(j *Job) { j.Status, j.FinishedAt = StatusSucceeded, &at }))
+	}
+	old := &Job{Customer: "acme", Bot: "mybot", Step: StepCheckout}
+	finish(old, cutoff.Add(-time.Hour))
+	recent := &Job{Customer: "acme", Bot: "otherbot", Step: StepCheckout}
+	finish(recent, cutoff.Add(time.Hour))
+	running := &Job{Customer: "acme", Bot: "thirdbot", Step: StepCheckout}
+	require.NoError(t, store.Create(running))
+
+	pruned, err := store.Prune(cutoff)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	_, err = store.Get(old.ID)
+	assert.True(t, errdefs.IsNotFound(err))
+	_, err = store.Get(recent.ID)
+	assert.NoError(t, err)
+	_, err = store.Get(running.ID)
+	assert.NoError(t, err, "unfinished jobs are kept")
+}
+
+func TestStore_Bundles(t *testing.T) {
+	store := openStore(t, filepath.Join(t.TempDir(), "builder.db"))
+	defer store.Close()
+	for _, job := range []*Job{
+		{Customer: "acme", Bot: "mybot", Bundle: "s1", Step: StepCheckout},
+		{Customer: "acme", Bot: "otherbot", Bundle: "s1", Step: StepCheckout},
+		{Customer: "globex", Bot: "mybot", Bundle: "s1", Step: StepCheckout},
+		{Customer: "globex", Bot: "mybot", Bundle: "s2", Step: StepCheckout},
+	} {
+		require.NoError(t, store.Create(job))
+	}
+
+	bundles, err := store.Bundles()
+
+	require.NoError(t, err)
+	assert.Len(t, bundles, 2)
+	assert.ElementsMatch(t, []string{"acme", "globex"}, bundles["s1"])
+	assert.Equal(t, []string{"globex"}, bundles["s2"])
+}
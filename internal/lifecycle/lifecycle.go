@@ -0,0 +1,160 @@
+package lifecycle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// Types of lifecycle events.
+const (
+	TypeCreated   = "created"
+	TypeStarted   = "started"
+	TypeRestarted = "restarted"
+	TypeStopped   = "stopped"
+	TypeCrashed   = "crashed"
+	TypeOOMKilled = "oom_killed"
+	TypeUnhealthy = "unhealthy"
+	TypeHealthy   = "healthy"
+	TypeRemoved   = "removed"
+
+	// Outcomes of builds, so core learns about builds that finished while it wasn't waiting
+	TypeBuildSucceeded = "build_succeeded"
+	TypeBuildFailed    = "build_failed"
+)
+
+// Event is a change in the lifecycle of a bot container, published to NATS and core.
+type Event struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	ContainerID string    `json:"containerId"`
+	Name        string    `json:"name"`
+	Customer    string    `json:"customer"`
+	Bot         string    `json:"bot"`
+
+	State        string `json:"state"`
+	Health       string `json:"health,omitempty"`
+	ExitCode     int    `json:"exitCode"`
+	OOMKilled    bool   `json:"oomKilled"`
+	RestartCount int    `json:"restartCount"`
+
+	// Set on build events
+	JobID string `json:"jobId,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Publisher delivers lifecycle events.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Multi publishes every event with all of its publishers.
+type Multi []Publisher
+
+func (m Multi) Publish(ctx context.Context, event Event) error {
+	var errList []error
+	for _, p := range m {
+		if err := p.Publish(ctx, event); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// FromDocker turns a Docker event of a bot container into a lifecycle event. timeNano is the time
+// of the Docker event, previous and current are the states of the container before and after it.
+// It reports false for events that don't change the bot's lifecycle, such as renames.
+func FromDocker(action string, timeNano int64, previous, current state.Bot) (Event, bool) {
+	var eventType string
+	switch {
+	case action == "create":
+		eventType = TypeCreated
+	case action == "start":
+		eventType = TypeStarted
+		// Docker restarts containers with a restart policy without a restart event
+		if previous.ContainerID != "" && current.RestartCount > previous.RestartCount {
+			eventType = TypeRestarted
+		}
+	case action == "restart":
+		eventType = TypeRestarted
+	case action == "die":
+		switch {
+		case current.OOMKilled:
+			// Reported by the oom event already
+			return Event{}, false
+		case previous.LastEvent == "kill" || current.ExitCode == 0:
+			// Stopped or killed through the Docker API, or exited on its own without an error
+			eventType = TypeStopped
+		default:
+			eventType = TypeCrashed
+		}
+	case action == "oom":
+		eventType = TypeOOMKilled
+	case strings.HasPrefix(action, "health_status"):
+		switch current.Health {
+		case "unhealthy":
+			eventType = TypeUnhealthy
+		case "healthy":
+			if previous.Health == "healthy" {
+				return Event{}, false
+			}
+			eventType = TypeHealthy
+		default:
+			return Event{}, false
+		}
+	case action == "destroy":
+		eventType = TypeRemoved
+	default:
+		return Event{}, false
+	}
+
+	// The ID is derived from the Docker event, so the same Docker event always has the same ID
+	return Event{
+		ID:           eventID(current.ContainerID, action, strconv.FormatInt(timeNano, 10)),
+		Type:         eventType,
+		Time:         time.Unix(0, timeNano).UTC(),
+		ContainerID:  current.ContainerID,
+		Name:         current.Name,
+		Customer:     current.Customer,
+		Bot:          current.Bot,
+		State:        current.State,
+		Health:       current.Health,
+		ExitCode:     current.ExitCode,
+		OOMKilled:    current.OOMKilled,
+		RestartCount: current.RestartCount,
+	}, true
+}
+
+// FromJob returns the event reporting the outcome of a finished build job.
+func FromJob(job *jobs.Job) Event {
+	eventType := TypeBuildSucceeded
+	if job.Status == jobs.StatusFailed {
+		eventType = TypeBuildFailed
+	}
+	return Event{
+		ID:          eventID(job.ID, eventType),
+		Type:        eventType,
+		Time:        time.Now().UTC(),
+		ContainerID: job.ContainerID,
+		Name:        docker.ContainerName(job.Customer, job.Bot),
+		Customer:    job.Customer,
+		Bot:         job.Bot,
+		JobID:       job.ID,
+		Error:       job.Error,
+	}
+}
+
+// eventID returns the ID of the event identified by the parts.
+func eventID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,94 @@
+package lifecycle_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/lifecycle"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromDocker(t *testing.T) {
+	running := state.Bot{ContainerID: "4f2a", Name: "acme_mybot", Customer: "acme", Bot: "mybot", State: "running", LastEvent: "start"}
+	exited := func(exitCode int) state.Bot {
+		bot := running
+		bot.State = "exited"
+		bot.ExitCode = exitCode
+		return bot
+	}
+	killed := running
+	killed.LastEvent = "kill"
+	oomKilled := exited(137)
+	oomKilled.OOMKilled = true
+	restarted := running
+	restarted.RestartCount = 1
+	unhealthy := running
+	unhealthy.Health = "unhealthy"
+	healthy := running
+	healthy.Health = "healthy"
+
+	tests := []struct {
+		name     string
+		action   string
+		previous state.Bot
+		current  state.Bot
+		want     string
+	}{
+		{"created", "create", state.Bot{}, running, lifecycle.TypeCreated},
+		{"started", "start", exited(0), running, lifecycle.TypeStarted},
+		{"restarted by policy", "start", exited(1), restarted, lifecycle.TypeRestarted},
+		{"restarted", "restart", running, running, lifecycle.TypeRestarted},
+		{"exited cleanly", "die", running, exited(0), lifecycle.TypeStopped},
+		{"stopped", "die", killed, exited(143), lifecycle.TypeStopped},
+		{"crashed", "die", running, exited(1), lifecycle.TypeCrashed},
+		{"oom killed", "oom", running, running, lifecycle.TypeOOMKilled},
+		{"died of oom", "die", running, oomKilled, ""},
+		{"unhealthy", "health_status: unhealthy", healthy, unhealthy, lifecycle.TypeUnhealthy},
+		{"recovered", "health_status: healthy", unhealthy, healthy, lifecycle.TypeHealthy},
+		{"still healthy", "health_status: healthy", healthy, healthy, ""},
+		{"removed", "destroy", exited(0), exited(0), lifecycle.TypeRemoved},
+		{"renamed", "rename", running, running, ""},
+		{"kill", "kill", running, running, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := lifecycle.FromDocker(tt.action, 1714557600000000000, tt.previous, tt.current)
+			if tt.want == "" {
+				assert.False(t, ok)
+				return
+			}
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, event.Type)
+			assert.NotEmpty(t, event.ID)
+			assert.Equal(t, "acme", event.Customer)
+			assert.Equal(t, "mybot", event.Bot)
+			assert.Equal(t, tt.current.ExitCode, event.ExitCode)
+		})
+	}
+}
+
+func TestFromDocker_ID(t *testing.T) {
+	running := state.Bot{ContainerID: "4f2a", Name: "acme_mybot", Customer: "acme", Bot: "mybot", State: "running"}
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+
+	event, _ := lifecycle.FromDocker("start", at, state.Bot{}, running)
+	again, _ := lifecycle.FromDocker("start", at, state.Bot{}, running)
+	later, _ := lifecycle.FromDocker("start", at+1, state.Bot{}, running)
+	other, _ := lifecycle.FromDocker("create", at, state.Bot{}, running)
+
+	assert.Equal(t, event.ID, again.ID, "the same Docker event has the same ID, so JetStream drops the duplicate")
+	assert.NotEqual(t, event.ID, later.ID)
+	assert.NotEqual(t, event.ID, other.ID)
+	assert.Equal(t, time.Unix(0, at).UTC(), event.Time)
+}
+
+func TestFromJob_ID(t *testing.T) {
+	job := &jobs.Job{ID: "c81e", Customer: "acme", Bot: "mybot", Status: jobs.StatusFailed}
+
+	event := lifecycle.FromJob(job)
+
+	assert.Equal(t, lifecycle.TypeBuildFailed, event.Type)
+	assert.Equal(t, event.ID, lifecycle.FromJob(job).ID)
+}
@@ -0,0 +1,54 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS publishes lifecycle events to <subject>.<type>. Every message carries the event ID
+// as Nats-Msg-Id, so a JetStream stream on the subject drops duplicates.
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATS connects to NATS. The connection is retried in the background, so the builder
+// starts and keeps working while NATS is unavailable.
+func NewNATS(url, subject string) (*NATS, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("bot-builder"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Default().Printf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Default().Printf("Reconnected to NATS at %s", conn.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{conn: conn, subject: subject}, nil
+}
+
+func (n *NATS) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(n.subject + "." + event.Type)
+	msg.Header.Set(nats.MsgIdHdr, event.ID)
+	msg.Data = data
+	return n.conn.PublishMsg(msg)
+}
+
+// Close flushes pending events and closes the connection.
+func (n *NATS) Close() error {
+	return n.conn.Drain()
+}
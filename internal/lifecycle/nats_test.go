@@ -0,0 +1,59 @@
+package lifecycle_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sensority-labs/builder/internal/lifecycle"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runNATS(t *testing.T) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestNATS_Publish(t *testing.T) {
+	srv := runNATS(t)
+
+	sub, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer sub.Close()
+	messages := make(chan *nats.Msg, 1)
+	_, err = sub.ChanSubscribe("bots.lifecycle.>", messages)
+	require.NoError(t, err)
+	require.NoError(t, sub.Flush())
+
+	publisher, err := lifecycle.NewNATS(srv.ClientURL(), "bots.lifecycle")
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	event := lifecycle.Event{ID: "e1", Type: lifecycle.TypeCrashed, ContainerID: "4f2a", Customer: "acme", Bot: "mybot", ExitCode: 1}
+	require.NoError(t, publisher.Publish(context.Background(), event))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "bots.lifecycle.crashed", msg.Subject)
+		assert.Equal(t, "e1", msg.Header.Get(nats.MsgIdHdr))
+		var got lifecycle.Event
+		require.NoError(t, json.Unmarshal(msg.Data, &got))
+		assert.Equal(t, event, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lifecycle event wasn't published")
+	}
+}
+
+func TestNATS_StartsWithoutServer(t *testing.T) {
+	publisher, err := lifecycle.NewNATS("nats://127.0.0.1:1", "bots.lifecycle")
+	require.NoError(t, err, "the connection is retried in the background")
+	defer publisher.Close()
+}
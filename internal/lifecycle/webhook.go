@@ -0,0 +1,49 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/outbox"
+)
+
+// kindWebhook is the outbox kind of lifecycle events waiting to be posted to core.
+const kindWebhook = "core.lifecycle_event"
+
+// Webhook posts lifecycle events to core. Events go through the outbox, so they are
+// delivered once core is back if it is unavailable.
+type Webhook struct {
+	box  *outbox.Outbox
+	core bot.Core
+}
+
+// NewWebhook registers the delivery of lifecycle events to core with the outbox.
+func NewWebhook(box *outbox.Outbox, core bot.Core) *Webhook {
+	w := &Webhook{box: box, core: core}
+	box.Handle(kindWebhook, w.deliver)
+	return w
+}
+
+func (w *Webhook) Publish(ctx context.Context, event Event) error {
+	if err := w.box.Enqueue(kindWebhook+"/"+event.ID, kindWebhook, event); err != nil {
+		return err
+	}
+	// Deliver right away rather than on the next outbox run
+	w.box.Trigger()
+	return nil
+}
+
+func (w *Webhook) deliver(ctx context.Context, payload json.RawMessage) error {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return outbox.Permanent(err)
+	}
+	if err := w.core.PostEvent(ctx, event); err != nil {
+		if !bot.IsRetryable(err) {
+			return outbox.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package lifecycle_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/lifecycle"
+	"github.com/sensority-labs/builder/internal/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCore struct {
+	bot.Core
+	mu     sync.Mutex
+	events []any
+	err    error
+}
+
+func (c *fakeCore) PostEvent(ctx context.Context, event any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.events = append(c.events, event)
+	return nil
+}
+
+func TestWebhook_RetriesWhileCoreIsDown(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	core := &fakeCore{err: &bot.StatusError{StatusCode: 503}}
+	webhook := lifecycle.NewWebhook(box, core)
+
+	require.NoError(t, webhook.Publish(context.Background(), lifecycle.Event{ID: "e1", Type: lifecycle.TypeOOMKilled}))
+	box.Flush(context.Background())
+
+	pending, err := box.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, 1, pending[0].Attempts)
+}
+
+func TestWebhook_Deliver(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	core := &fakeCore{}
+	webhook := lifecycle.NewWebhook(box, core)
+
+	require.NoError(t, webhook.Publish(context.Background(), lifecycle.Event{ID: "e1", Type: lifecycle.TypeCrashed}))
+	box.Flush(context.Background())
+
+	core.mu.Lock()
+	defer core.mu.Unlock()
+	require.Len(t, core.events, 1)
+	assert.Equal(t, lifecycle.TypeCrashed, core.events[0].(lifecycle.Event).Type)
+}
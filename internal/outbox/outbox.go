@@ -0,0 +1,285 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBackoff caps the delay between delivery attempts of a message.
+const maxBackoff = 10 * time.Minute
+
+// Message is a delivery waiting in the outbox.
+type Message struct {
+	ID          string          `json:"id"`
+	Key         string          `json:"key"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// Handler delivers the payload of a message. Returning an error schedules another attempt,
+// unless the error is wrapped with Permanent.
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks a delivery error that retrying won't fix. The message is dropped.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Outbox durably stores deliveries that have to be retried until they succeed, such as callbacks to core.
+// Every message is a JSON file in the outbox directory, so pending deliveries survive restarts.
+type Outbox struct {
+	dir     string
+	backoff time.Duration
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+
+	// flushMu serializes flushes, so a message isn't delivered by two of them at once
+	flushMu sync.Mutex
+
+	// flush asks Run for a flush before the next interval. Requests made while one is pending are coalesced.
+	flush chan struct{}
+}
+
+// New opens the outbox in dir. backoff is the delay before the first retry, it doubles with every attempt.
+func New(dir string, backoff time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Outbox{dir: dir, backoff: backoff, handlers: make(map[string]Handler), flush: make(chan struct{}, 1)}, nil
+}
+
+// Handle registers the handler delivering messages of the given kind.
+func (o *Outbox) Handle(kind string, handler Handler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handlers[kind] = handler
+}
+
+// Enqueue stores a message for delivery. A pending message with the same key is replaced,
+// so only the latest delivery for a key is made.
+func (o *Outbox) Enqueue(key, kind string, payload any) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	msg := Message{
+		ID:          hex.EncodeToString(id),
+		Key:         key,
+		Kind:        kind,
+		Payload:     payloadBytes,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.write(msg)
+}
+
+// Cancel drops the pending message with the given key, if any.
+func (o *Outbox) Cancel(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.remove(key)
+}
+
+// Pending returns all messages waiting for delivery, oldest first.
+func (o *Outbox) Pending() ([]Message, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		msg, err := o.read(filepath.Join(o.dir, entry.Name()))
+		if err != nil {
+			log.Default().Println(fmt.Sprintf("Error: skipping outbox message %s: %+v", entry.Name(), err))
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+	return messages, nil
+}
+
+// Run delivers due messages every interval, and when a flush is triggered, until ctx is done.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		o.Flush(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.flush:
+		}
+	}
+}
+
+// Trigger makes Run flush the outbox right away rather than on the next interval. It doesn't block.
+func (o *Outbox) Trigger() {
+	select {
+	case o.flush <- struct{}{}:
+	default:
+	}
+}
+
+// Flush attempts to deliver every message that is due.
+func (o *Outbox) Flush(ctx context.Context) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	messages, err := o.Pending()
+	if err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		return
+	}
+
+	now := time.Now()
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			return
+		}
+		if msg.NextAttempt.After(now) {
+			continue
+		}
+		o.deliver(ctx, msg)
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, msg Message) {
+	o.mu.Lock()
+	handler, ok := o.handlers[msg.Kind]
+	o.mu.Unlock()
+	if !ok {
+		log.Default().Printf("No outbox handler for %s messages, keeping %s", msg.Kind, msg.Key)
+		return
+	}
+
+	err := handler(ctx, msg.Payload)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// The message may have been replaced by a newer one with the same key during delivery
+	current, readErr := o.read(o.path(msg.Key))
+	if readErr != nil || current.ID != msg.ID {
+		return
+	}
+
+	var permanentErr *permanentError
+	switch {
+	case err == nil:
+		log.Default().Printf("Delivered outbox message %s %s after %d attempts", msg.Kind, msg.Key, msg.Attempts+1)
+		o.remove(msg.Key)
+	case errors.As(err, &permanentErr):
+		log.Default().Println(fmt.Sprintf("Error: dropping outbox message %s %s: %+v", msg.Kind, msg.Key, err))
+		o.remove(msg.Key)
+	default:
+		msg.Attempts++
+		msg.LastError = err.Error()
+		msg.NextAttempt = time.Now().UTC().Add(o.delay(msg.Attempts))
+		log.Default().Printf("Outbox message %s %s failed (attempt %d), retrying at %s: %v", msg.Kind, msg.Key, msg.Attempts, msg.NextAttempt.Format(time.RFC3339), err)
+		if err := o.write(msg); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}
+}
+
+func (o *Outbox) delay(attempts int) time.Duration {
+	delay := o.backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+func (o *Outbox) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(o.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// write stores the message atomically, so a crash never leaves a partially written message.
+func (o *Outbox) write(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(o.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.path(msg.Key))
+}
+
+func (o *Outbox) read(filePath string) (Message, error) {
+	var msg Message
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+func (o *Outbox) remove(key string) {
+	if err := os.Remove(o.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+}
@@ -0,0 +1,151 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type payload struct {
+	ContainerID string `json:"container_id"`
+}
+
+func TestOutbox_Deliver(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	var delivered []string
+	box.Handle("core.update_id", func(ctx context.Context, raw json.RawMessage) error {
+		var p payload
+		require.NoError(t, json.Unmarshal(raw, &p))
+		delivered = append(delivered, p.ContainerID)
+		return nil
+	})
+
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "container123"}))
+	box.Flush(context.Background())
+
+	assert.Equal(t, []string{"container123"}, delivered)
+	pending, err := box.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestOutbox_RetryLater(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	attempts := 0
+	box.Handle("core.update_id", func(ctx context.Context, raw json.RawMessage) error {
+		attempts++
+		return errors.New("core is down")
+	})
+
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "container123"}))
+	box.Flush(context.Background())
+	box.Flush(context.Background())
+
+	assert.Equal(t, 1, attempts, "the second flush is before the next attempt is due")
+	pending, err := box.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.Equal(t, "core is down", pending[0].LastError)
+	assert.True(t, pending[0].NextAttempt.After(time.Now()))
+}
+
+func TestOutbox_PermanentErrorDropsMessage(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	box.Handle("core.update_id", func(ctx context.Context, raw json.RawMessage) error {
+		return outbox.Permanent(errors.New("bot not found"))
+	})
+
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "container123"}))
+	box.Flush(context.Background())
+
+	pending, err := box.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestOutbox_LatestMessagePerKey(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "old"}))
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "new"}))
+	require.NoError(t, box.Enqueue("acme/otherbot", "core.update_id", payload{ContainerID: "other"}))
+
+	pending, err := box.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "acme/mybot", pending[0].Key)
+	assert.JSONEq(t, `{"container_id": "new"}`, string(pending[0].Payload))
+}
+
+func TestOutbox_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	box, err := outbox.New(dir, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "container123"}))
+
+	reopened, err := outbox.New(dir, time.Minute)
+	require.NoError(t, err)
+	var delivered []string
+	reopened.Handle("core.update_id", func(ctx context.Context, raw json.RawMessage) error {
+		var p payload
+		require.NoError(t, json.Unmarshal(raw, &p))
+		delivered = append(delivered, p.ContainerID)
+		return nil
+	})
+	reopened.Flush(context.Background())
+
+	assert.Equal(t, []string{"container123"}, delivered)
+}
+
+func TestOutbox_Cancel(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+
+	require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: "container123"}))
+	box.Cancel("acme/mybot")
+	box.Cancel("acme/otherbot")
+
+	pending, err := box.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestOutbox_Trigger(t *testing.T) {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	delivered := make(chan string, 10)
+	box.Handle("core.update_id", func(ctx context.Context, raw json.RawMessage) error {
+		var p payload
+		require.NoError(t, json.Unmarshal(raw, &p))
+		delivered <- p.ContainerID
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go box.Run(ctx, time.Hour)
+
+	for _, id := range []string{"container1", "container2"} {
+		require.NoError(t, box.Enqueue("acme/mybot", "core.update_id", payload{ContainerID: id}))
+		for range 5 {
+			box.Trigger() // Doesn't block while a flush is pending
+		}
+
+		select {
+		case delivered := <-delivered:
+			assert.Equal(t, id, delivered)
+		case <-time.After(time.Second):
+			t.Fatal("the triggered flush didn't run before the next interval")
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package quota
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/errs"
+)
+
+// Names of the limits, as reported in quota errors.
+const (
+	LimitMaxBots       = "maxBots"
+	LimitBuildsPerHour = "buildsPerHour"
+	LimitMaxMemory     = "maxMemory"
+	LimitMaxCPUs       = "maxCpus"
+)
+
+// Limits are the quotas of a customer. Zero disables a limit.
+type Limits struct {
+	MaxBots             int     `json:"maxBots"`
+	MaxConcurrentBuilds int     `json:"maxConcurrentBuilds"` // Enforced by the build queue, builds beyond it wait
+	BuildsPerHour       int     `json:"buildsPerHour"`
+	MaxMemory           int64   `json:"maxMemory"`
+	MaxCPUs             float64 `json:"maxCpus"`
+
+	// Priority is the class the customer's builds are queued with, unless a build sets its own
+	Priority string `json:"priority,omitempty"`
+}
+
+// Defaults returns the limits of customers core sets no quota for.
+func Defaults(cfg config.QuotaConfig) Limits {
+	return Limits{
+		MaxBots:             cfg.MaxBots,
+		MaxConcurrentBuilds: cfg.MaxConcurrentBuilds,
+		BuildsPerHour:       cfg.BuildsPerHour,
+		MaxMemory:           cfg.MaxMemory,
+		MaxCPUs:             cfg.MaxCPUs,
+	}
+}
+
+// Override returns the limits with the ones set in the quota from core.
+func (l Limits) Override(q *bot.Quota) Limits {
+	if q == nil {
+		return l
+	}
+	if q.MaxBots != nil {
+		l.MaxBots = *q.MaxBots
+	}
+	if q.MaxConcurrentBuilds != nil {
+		l.MaxConcurrentBuilds = *q.MaxConcurrentBuilds
+	}
+	if q.BuildsPerHour != nil {
+		l.BuildsPerHour = *q.BuildsPerHour
+	}
+	if q.MaxMemory != nil {
+		l.MaxMemory = *q.MaxMemory
+	}
+	if q.MaxCPUs != nil {
+		l.MaxCPUs = *q.MaxCPUs
+	}
+	if q.Priority != nil {
+		l.Priority = *q.Priority
+	}
+	return l
+}
+
+// Usage is what a customer's bots take up.
+type Usage struct {
+	Bots     int   `json:"bots"`
+	Memory   int64 `json:"memory"`   // Bytes of the bots with a memory limit
+	NanoCPUs int64 `json:"nanoCpus"` // Of the bots with a CPU limit
+
+	// Bots without a memory or CPU limit, they exceed any memory or CPU quota
+	UnlimitedMemory int `json:"unlimitedMemory"`
+	UnlimitedCPUs   int `json:"unlimitedCpus"`
+}
+
+// Add counts a bot with the given resource limits, zero for no limit.
+func (u *Usage) Add(memory, nanoCPUs int64) {
+	u.Bots++
+	u.Memory += memory
+	u.NanoCPUs += nanoCPUs
+	if memory == 0 {
+		u.UnlimitedMemory++
+	}
+	if nanoCPUs == 0 {
+		u.UnlimitedCPUs++
+	}
+}
+
+// Check fails with a quota error if the usage exceeds the limits.
+func (l Limits) Check(usage Usage) error {
+	switch {
+	case l.MaxBots > 0 && usage.Bots > l.MaxBots:
+		return errs.Quota(LimitMaxBots, "customer may have at most %d bots", l.MaxBots)
+	case l.MaxMemory > 0 && usage.UnlimitedMemory > 0:
+		return errs.Quota(LimitMaxMemory, "%d bots would run without a memory limit, the customer may use at most %d bytes", usage.UnlimitedMemory, l.MaxMemory)
+	case l.MaxMemory > 0 && usage.Memory > l.MaxMemory:
+		return errs.Quota(LimitMaxMemory, "bots would take %d bytes of memory, the customer may use at most %d", usage.Memory, l.MaxMemory)
+	case l.MaxCPUs > 0 && usage.UnlimitedCPUs > 0:
+		return errs.Quota(LimitMaxCPUs, "%d bots would run without a CPU limit, the customer may use at most %g CPUs", usage.UnlimitedCPUs, l.MaxCPUs)
+	case l.MaxCPUs > 0 && usage.NanoCPUs > int64(l.MaxCPUs*1e9):
+		return errs.Quota(LimitMaxCPUs, "bots would take %g CPUs, the customer may use at most %g", float64(usage.NanoCPUs)/1e9, l.MaxCPUs)
+	}
+	return nil
+}
+
+// Tracker counts the builds of every customer to enforce their build rate limits. The counts are
+// kept in memory, so the builds of the last hour are forgotten on a restart.
+type Tracker struct {
+	mu         sync.Mutex
+	building   map[string][]string    // Bots being built by customer, a bot once per build
+	rebuilding map[string][]string    // Bots being rebuilt by fleet operations by customer
+	started    map[string][]time.Time // Starts of the builds of the last hour by customer
+	now        func() time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		building:   make(map[string][]string),
+		rebuilding: make(map[string][]string),
+		started:    make(map[string][]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Build is a build asking to be admitted.
+type Build struct {
+	Customer string
+	Bot      string
+
+	// Fleet rebuilds are started by the platform, they don't count against the customer's build rates
+	Fleet bool
+}
+
+// UsageFunc returns what the customer's bots would take up once the build is done, given the
+// customer's bots being built. It is called with the tracker locked, so it must not use the tracker.
+type UsageFunc func(building []string) (Usage, error)
+
+// Admit counts the build if the limits allow another one. The usage, if usage isn't nil, is checked
+// against the limits along with the build rates, so concurrent builds can't both take the last of
+// a quota. The build counts as running until release is called.
+func (t *Tracker) Admit(build Build, limits Limits, usage UsageFunc) (release func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	customer, botName := build.Customer, build.Bot
+	now := t.now()
+	started := slices.DeleteFunc(t.started[customer], func(at time.Time) bool {
+		return now.Sub(at) >= time.Hour
+	})
+	t.started[customer] = started
+
+	if !build.Fleet && limits.BuildsPerHour > 0 && len(started) >= limits.BuildsPerHour {
+		quotaErr := errs.Quota(LimitBuildsPerHour, "customer may start at most %d builds per hour", limits.BuildsPerHour)
+		quotaErr.RateLimited = true
+		quotaErr.RetryAfter = started[0].Add(time.Hour).Sub(now)
+		return nil, quotaErr
+	}
+	if usage != nil {
+		u, err := usage(t.buildingBots(customer))
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.Check(u); err != nil {
+			return nil, err
+		}
+	}
+
+	building := t.building
+	if build.Fleet {
+		building = t.rebuilding
+	} else {
+		t.started[customer] = append(started, now)
+	}
+	building[customer] = append(building[customer], botName)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			bots := building[customer]
+			if i := slices.Index(bots, botName); i >= 0 {
+				bots = slices.Delete(bots, i, i+1)
+			}
+			if len(bots) == 0 {
+				delete(building, customer)
+			} else {
+				building[customer] = bots
+			}
+		})
+	}, nil
+}
+
+// Building returns the customer's bots being built, fleet rebuilds included, a bot once per build.
+func (t *Tracker) Building(customer string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buildingBots(customer)
+}
+
+func (t *Tracker) buildingBots(customer string) []string {
+	return slices.Concat(t.building[customer], t.rebuilding[customer])
+}
+
+// BuildsLastHour returns how many builds the customer started in the last hour.
+func (t *Tracker) BuildsLastHour(customer string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	n := 0
+	for _, at := range t.started[customer] {
+		if now.Sub(at) < time.Hour {
+			n++
+		}
+	}
+	return n
+}
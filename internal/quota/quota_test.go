@@ -0,0 +1,128 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits_Override(t *testing.T) {
+	maxBots, unlimited := 50, 0
+	limits := Defaults(config.QuotaConfig{MaxBots: 10, BuildsPerHour: 20}).Override(&bot.Quota{MaxBots: &maxBots, BuildsPerHour: &unlimited})
+	assert.Equal(t, Limits{MaxBots: 50}, limits)
+}
+
+func TestLimits_Check(t *testing.T) {
+	limits := Limits{MaxBots: 2, MaxMemory: 1 << 30, MaxCPUs: 1.5}
+	assert.NoError(t, limits.Check(Usage{Bots: 2, Memory: 1 << 30, NanoCPUs: 15e8}))
+	assert.NoError(t, Limits{MaxBots: 2}.Check(Usage{Bots: 2, UnlimitedMemory: 2, UnlimitedCPUs: 2}))
+
+	tests := []struct {
+		usage Usage
+		limit string
+	}{
+		{Usage{Bots: 3}, LimitMaxBots},
+		{Usage{Bots: 1, Memory: 2 << 30}, LimitMaxMemory},
+		{Usage{Bots: 1, NanoCPUs: 2e9}, LimitMaxCPUs},
+		{Usage{Bots: 1, UnlimitedMemory: 1}, LimitMaxMemory},
+		{Usage{Bots: 1, UnlimitedCPUs: 1}, LimitMaxCPUs},
+	}
+	for _, tt := range tests {
+		quotaErr, ok := errs.AsQuota(limits.Check(tt.usage))
+		require.True(t, ok)
+		assert.Equal(t, tt.limit, quotaErr.Limit)
+		assert.False(t, quotaErr.RateLimited)
+	}
+}
+
+func TestTracker_Building(t *testing.T) {
+	tracker := NewTracker()
+	limits := Limits{MaxConcurrentBuilds: 1}
+
+	release, err := tracker.Admit(Build{Customer: "acme", Bot: "a"}, limits, nil)
+	require.NoError(t, err)
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "b"}, limits, nil)
+	require.NoError(t, err, "builds beyond the concurrent builds wait in the build queue")
+	assert.Equal(t, []string{"a", "b"}, tracker.Building("acme"))
+	assert.Empty(t, tracker.Building("globex"))
+
+	release()
+	release()
+	assert.Equal(t, []string{"b"}, tracker.Building("acme"))
+}
+
+func TestTracker_BuildsPerHour(t *testing.T) {
+	tracker := NewTracker()
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+	limits := Limits{BuildsPerHour: 2}
+
+	for range 2 {
+		release, err := tracker.Admit(Build{Customer: "acme", Bot: "a"}, limits, nil)
+		require.NoError(t, err)
+		release()
+		now = now.Add(10 * time.Minute)
+	}
+	_, err := tracker.Admit(Build{Customer: "acme", Bot: "a"}, limits, nil)
+	quotaErr, ok := errs.AsQuota(err)
+	require.True(t, ok)
+	assert.Equal(t, LimitBuildsPerHour, quotaErr.Limit)
+	assert.Equal(t, 40*time.Minute, quotaErr.RetryAfter)
+	assert.Equal(t, 2, tracker.BuildsLastHour("acme"))
+
+	now = now.Add(40 * time.Minute)
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "a"}, limits, nil)
+	assert.NoError(t, err)
+}
+
+func TestUsage_Add(t *testing.T) {
+	var usage Usage
+	usage.Add(1<<30, 5e8)
+	usage.Add(0, 0)
+	assert.Equal(t, Usage{Bots: 2, Memory: 1 << 30, NanoCPUs: 5e8, UnlimitedMemory: 1, UnlimitedCPUs: 1}, usage)
+}
+
+func TestTracker_Usage(t *testing.T) {
+	tracker := NewTracker()
+	limits := Limits{MaxBots: 2}
+	usage := func(building []string) (Usage, error) {
+		// Every bot being built is a new bot
+		return Usage{Bots: 1 + len(building)}, nil
+	}
+
+	release, err := tracker.Admit(Build{Customer: "acme", Bot: "a"}, limits, usage)
+	require.NoError(t, err)
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "b"}, limits, usage)
+	require.NoError(t, err)
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "c"}, limits, usage)
+	quotaErr, ok := errs.AsQuota(err)
+	require.True(t, ok, "the bots being built count: %v", err)
+	assert.Equal(t, LimitMaxBots, quotaErr.Limit)
+	assert.Equal(t, []string{"a", "b"}, tracker.Building("acme"))
+
+	release()
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "c"}, limits, usage)
+	assert.NoError(t, err)
+}
+
+func TestTracker_FleetRebuilds(t *testing.T) {
+	tracker := NewTracker()
+	limits := Limits{BuildsPerHour: 1}
+
+	release, err := tracker.Admit(Build{Customer: "acme", Bot: "a", Fleet: true}, limits, nil)
+	require.NoError(t, err)
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "b", Fleet: true}, limits, nil)
+	require.NoError(t, err, "fleet rebuilds aren't rate limited")
+	assert.Equal(t, []string{"a", "b"}, tracker.Building("acme"))
+	assert.Zero(t, tracker.BuildsLastHour("acme"))
+
+	_, err = tracker.Admit(Build{Customer: "acme", Bot: "c"}, limits, nil)
+	require.NoError(t, err, "fleet rebuilds don't take up the customer's builds")
+	release()
+	assert.Equal(t, []string{"c", "b"}, tracker.Building("acme"))
+}
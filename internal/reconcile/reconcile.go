@@ -0,0 +1,132 @@
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// Kinds of actions converging the host to core's desired state.
+const (
+	ActionCreate   = "create"   // Core has the bot but there's no container for it
+	ActionStart    = "start"    // The bot should run but its container doesn't
+	ActionStop     = "stop"     // The bot should be stopped but its container runs
+	ActionRemove   = "remove"   // The container belongs to a bot core doesn't know
+	ActionRegister = "register" // Core has another container ID for the bot
+)
+
+// Action is a step converging one bot.
+type Action struct {
+	Kind        string `json:"kind"`
+	Customer    string `json:"customer"`
+	Bot         string `json:"bot"`
+	ContainerID string `json:"containerId,omitempty"`
+	Reason      string `json:"reason"`
+
+	// Applied and Error record the outcome once the action was executed. Skipped is why it wasn't.
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// Report is the outcome of a reconciliation run.
+type Report struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	DryRun     bool      `json:"dryRun"`
+	Actions    []Action  `json:"actions"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Options control the actions of a plan.
+type Options struct {
+	RemoveOrphans    bool // Remove containers of bots core doesn't know
+	MaxRemovePercent int  // Share of the containers above which removals are skipped. Zero disables the limit
+}
+
+// Plan compares core's desired bots with the bot containers on the host and returns the actions
+// converging them. Containers stashed by a running deploy are left alone. Orphaned containers
+// are only removed if opts.RemoveOrphans is set and core returned at least one bot, so an empty
+// response from core can't wipe the host. When more containers would be removed than
+// opts.MaxRemovePercent allows, the removals are planned as skipped, as core likely lost bots.
+func Plan(desired []bot.DesiredBot, actual []state.Bot, opts Options) []Action {
+	containers := make(map[string]state.Bot, len(actual))
+	for _, ctr := range actual {
+		if ctr.Customer == "" || ctr.Bot == "" || docker.IsPrevious(ctr.Name) {
+			continue
+		}
+		containers[docker.ContainerName(ctr.Customer, ctr.Bot)] = ctr
+	}
+
+	var actions []Action
+	known := make(map[string]bool, len(desired))
+	for _, d := range desired {
+		name := docker.ContainerName(d.UserName, d.BotName)
+		known[name] = true
+		ctr, ok := containers[name]
+		if !ok {
+			if d.DesiredState != bot.DesiredStopped {
+				actions = append(actions, Action{Kind: ActionCreate, Customer: d.UserName, Bot: d.BotName, Reason: "bot has no container"})
+			}
+			continue
+		}
+
+		running := ctr.State == "running" || ctr.State == "restarting"
+		switch {
+		case d.DesiredState == bot.DesiredStopped && running:
+			actions = append(actions, Action{Kind: ActionStop, Customer: d.UserName, Bot: d.BotName, ContainerID: ctr.ContainerID, Reason: "bot is stopped in core but its container is " + ctr.State})
+		case d.DesiredState != bot.DesiredStopped && !running:
+			actions = append(actions, Action{Kind: ActionStart, Customer: d.UserName, Bot: d.BotName, ContainerID: ctr.ContainerID, Reason: "bot is running in core but its container is " + ctr.State})
+		}
+		if d.ContainerID == "" || !strings.HasPrefix(ctr.ContainerID, d.ContainerID) {
+			actions = append(actions, Action{Kind: ActionRegister, Customer: d.UserName, Bot: d.BotName, ContainerID: ctr.ContainerID, Reason: "core has container ID " + shortID(d.ContainerID)})
+		}
+	}
+
+	if opts.RemoveOrphans && len(desired) > 0 {
+		var removals []Action
+		for name, ctr := range containers {
+			if !known[name] {
+				removals = append(removals, Action{Kind: ActionRemove, Customer: ctr.Customer, Bot: ctr.Bot, ContainerID: ctr.ContainerID, Reason: "bot is unknown to core"})
+			}
+		}
+		if limit := maxRemovals(len(containers), opts.MaxRemovePercent); limit >= 0 && len(removals) > limit {
+			for i := range removals {
+				removals[i].Skipped = fmt.Sprintf("%d of %d containers would be removed, more than %d%%", len(removals), len(containers), opts.MaxRemovePercent)
+			}
+		}
+		actions = append(actions, removals...)
+	}
+
+	sort.SliceStable(actions, func(i, j int) bool {
+		if actions[i].Customer != actions[j].Customer {
+			return actions[i].Customer < actions[j].Customer
+		}
+		return actions[i].Bot < actions[j].Bot
+	})
+	return actions
+}
+
+// maxRemovals returns how many of the containers may be removed in one run, -1 if there's no limit.
+// At least one container may always be removed, so orphans of small fleets are cleaned up.
+func maxRemovals(containers, percent int) int {
+	if percent <= 0 {
+		return -1
+	}
+	return max(containers*percent/100, 1)
+}
+
+func shortID(id string) string {
+	if id == "" {
+		return "none"
+	}
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
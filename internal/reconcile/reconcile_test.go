@@ -0,0 +1,89 @@
+package reconcile_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/reconcile"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func container(id, customer, botName, containerState string) state.Bot {
+	return state.Bot{ContainerID: id, Name: customer + "_" + botName, Customer: customer, Bot: botName, State: containerState}
+}
+
+func kinds(actions []reconcile.Action) []string {
+	var result []string
+	for _, a := range actions {
+		result = append(result, a.Kind+" "+a.Customer+"/"+a.Bot)
+	}
+	return result
+}
+
+func TestPlan(t *testing.T) {
+	desired := []bot.DesiredBot{
+		{UserName: "acme", BotName: "converged", ContainerID: "c1", DesiredState: bot.DesiredRunning},
+		{UserName: "acme", BotName: "missing", DesiredState: bot.DesiredRunning},
+		{UserName: "acme", BotName: "missing-stopped", DesiredState: bot.DesiredStopped},
+		{UserName: "acme", BotName: "crashed", ContainerID: "c3", DesiredState: bot.DesiredRunning},
+		{UserName: "acme", BotName: "disabled", ContainerID: "c4", DesiredState: bot.DesiredStopped},
+		{UserName: "globex", BotName: "stale", ContainerID: "old", DesiredState: bot.DesiredRunning},
+		{UserName: "globex", BotName: "short-id", ContainerID: "c6", DesiredState: bot.DesiredRunning},
+	}
+	actual := []state.Bot{
+		container("c1", "acme", "converged", "running"),
+		container("c3", "acme", "crashed", "exited"),
+		container("c4", "acme", "disabled", "running"),
+		container("c5", "globex", "stale", "running"),
+		container("c6aaaaaaaaaa", "globex", "short-id", "running"),
+		container("c7", "globex", "orphan", "exited"),
+		{ContainerID: "c8", Name: "globex_stale-previous", Customer: "globex", Bot: "stale", State: "exited"},
+	}
+
+	actions := reconcile.Plan(desired, actual, reconcile.Options{RemoveOrphans: true})
+
+	assert.Equal(t, []string{
+		"start acme/crashed",
+		"stop acme/disabled",
+		"create acme/missing",
+		"remove globex/orphan",
+		"register globex/stale",
+	}, kinds(actions))
+	assert.Equal(t, "c5", actions[4].ContainerID)
+}
+
+func TestPlan_KeepsOrphans(t *testing.T) {
+	actual := []state.Bot{container("c7", "globex", "orphan", "running")}
+
+	assert.Empty(t, reconcile.Plan([]bot.DesiredBot{{UserName: "acme", BotName: "mybot", DesiredState: bot.DesiredStopped}}, actual, reconcile.Options{}))
+	assert.Empty(t, reconcile.Plan(nil, actual, reconcile.Options{RemoveOrphans: true}), "an empty desired set never removes containers")
+}
+
+func TestPlan_RemovalLimit(t *testing.T) {
+	desired := []bot.DesiredBot{{UserName: "acme", BotName: "known", ContainerID: "c1", DesiredState: bot.DesiredRunning}}
+	actual := []state.Bot{container("c1", "acme", "known", "running")}
+	for i := range 9 {
+		actual = append(actual, container(fmt.Sprintf("o%d", i), "globex", fmt.Sprintf("orphan%d", i), "running"))
+	}
+
+	actions := reconcile.Plan(desired, actual, reconcile.Options{RemoveOrphans: true, MaxRemovePercent: 10})
+
+	require.Len(t, actions, 9)
+	for _, action := range actions {
+		assert.Equal(t, reconcile.ActionRemove, action.Kind)
+		assert.Equal(t, "9 of 10 containers would be removed, more than 10%", action.Skipped)
+	}
+}
+
+func TestPlan_RemovalLimit_SingleOrphan(t *testing.T) {
+	desired := []bot.DesiredBot{{UserName: "acme", BotName: "known", ContainerID: "c1", DesiredState: bot.DesiredRunning}}
+	actual := []state.Bot{container("c1", "acme", "known", "running"), container("c2", "globex", "orphan", "running")}
+
+	actions := reconcile.Plan(desired, actual, reconcile.Options{RemoveOrphans: true, MaxRemovePercent: 10})
+
+	require.Len(t, actions, 1)
+	assert.Empty(t, actions[0].Skipped, "one orphan can always be removed")
+}
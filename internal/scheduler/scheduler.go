@@ -0,0 +1,273 @@
+package scheduler
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Priority classes of builds. Queued builds of a higher class run first.
+const (
+	PriorityUrgent = "urgent" // E.g. hotfix redeploys
+	PriorityHigh   = "high"   // E.g. customers of paid tiers
+	PriorityNormal = "normal"
+	PriorityLow    = "low" // E.g. fleet rebuilds
+)
+
+// priorities are the priority classes in the order they are dispatched.
+var priorities = []string{PriorityUrgent, PriorityHigh, PriorityNormal, PriorityLow}
+
+// ValidPriority reports whether p is a known priority class.
+func ValidPriority(p string) bool {
+	return slices.Contains(priorities, p)
+}
+
+// Entry is a build waiting in the queue.
+type Entry struct {
+	JobID    string    `json:"jobId"`
+	Customer string    `json:"customer"`
+	Bot      string    `json:"bot"`
+	Priority string    `json:"priority"`
+	QueuedAt time.Time `json:"queuedAt"`
+	Position int       `json:"position"` // 1 is the next build to run
+
+	// MaxRunning is how many builds of the customer with a limit may run at once, zero for no limit.
+	// Builds without a limit don't count against it.
+	MaxRunning int `json:"-"`
+}
+
+// Scheduler runs builds on a fixed number of workers. Queued builds are dispatched by priority
+// class and, within a class, round-robin across customers, so a customer queueing many builds
+// doesn't hold up the builds of the others. Builds of a bot that is being built and builds of a
+// customer at its limit of running builds wait without taking a worker.
+type Scheduler struct {
+	mu        sync.Mutex
+	workers   int
+	running   int
+	customers map[string]int  // Running builds with a limit by customer
+	bots      map[string]bool // Bots being built, by customer/bot
+	classes   map[string]*class
+}
+
+// class queues the builds of a priority class per customer.
+type class struct {
+	customers []string // Customers with queued builds, in their round-robin order from next
+	next      int
+	tickets   map[string][]*ticket
+}
+
+type ticket struct {
+	entry Entry
+	ready chan struct{}
+}
+
+// New returns a scheduler running at most workers builds at once.
+func New(workers int) *Scheduler {
+	s := &Scheduler{
+		workers:   max(workers, 1),
+		customers: make(map[string]int),
+		bots:      make(map[string]bool),
+		classes:   make(map[string]*class),
+	}
+	for _, p := range priorities {
+		s.classes[p] = &class{tickets: make(map[string][]*ticket)}
+	}
+	return s
+}
+
+// Wait queues the build and blocks until it's its turn to run. The build holds a worker until
+// release is called. If ctx is done first, the build leaves the queue with ctx's error.
+// Unknown priority classes are queued as normal.
+func (s *Scheduler) Wait(ctx context.Context, entry Entry) (release func(), err error) {
+	if !ValidPriority(entry.Priority) {
+		entry.Priority = PriorityNormal
+	}
+	if entry.QueuedAt.IsZero() {
+		entry.QueuedAt = time.Now().UTC()
+	}
+	t := &ticket{entry: entry, ready: make(chan struct{})}
+
+	s.mu.Lock()
+	s.classes[entry.Priority].push(t)
+	s.dispatch()
+	s.mu.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.running--
+			delete(s.bots, botKey(entry))
+			if entry.MaxRunning > 0 {
+				if s.customers[entry.Customer]--; s.customers[entry.Customer] == 0 {
+					delete(s.customers, entry.Customer)
+				}
+			}
+			s.dispatch()
+		})
+	}
+
+	select {
+	case <-t.ready:
+		return release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		removed := s.classes[entry.Priority].remove(t)
+		s.mu.Unlock()
+		if !removed {
+			// Dispatched in the meantime, hand the worker to the next build
+			release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch hands free workers to the next queued builds. s.mu must be held.
+func (s *Scheduler) dispatch() {
+	for s.running < s.workers {
+		t := s.pop()
+		if t == nil {
+			return
+		}
+		s.running++
+		s.bots[botKey(t.entry)] = true
+		if t.entry.MaxRunning > 0 {
+			s.customers[t.entry.Customer]++
+		}
+		close(t.ready)
+	}
+}
+
+func (s *Scheduler) pop() *ticket {
+	for _, p := range priorities {
+		if t := s.classes[p].pop(s.runnable); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// runnable reports whether the build may start: its bot isn't being built and its customer isn't at
+// its limit. s.mu must be held.
+func (s *Scheduler) runnable(entry Entry) bool {
+	if s.bots[botKey(entry)] {
+		return false
+	}
+	return entry.MaxRunning == 0 || s.customers[entry.Customer] < entry.MaxRunning
+}
+
+func botKey(entry Entry) string {
+	return entry.Customer + "/" + entry.Bot
+}
+
+// Queue returns the queued builds in the order they will run, as long as no other build
+// jumps ahead of them.
+func (s *Scheduler) Queue() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var queue []Entry
+	for _, p := range priorities {
+		for _, t := range s.classes[p].order() {
+			entry := t.entry
+			entry.Position = len(queue) + 1
+			queue = append(queue, entry)
+		}
+	}
+	return queue
+}
+
+// Position returns the position of the job in the queue, false if it isn't queued.
+func (s *Scheduler) Position(jobID string) (int, bool) {
+	for _, entry := range s.Queue() {
+		if entry.JobID == jobID {
+			return entry.Position, true
+		}
+	}
+	return 0, false
+}
+
+// Stats returns the number of workers and the builds running on them.
+func (s *Scheduler) Stats() (workers, running int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.workers, s.running
+}
+
+// push queues the ticket. A customer without queued builds joins the rotation last.
+func (c *class) push(t *ticket) {
+	customer := t.entry.Customer
+	if len(c.tickets[customer]) == 0 {
+		c.customers = slices.Insert(c.customers, c.next, customer)
+		c.next = (c.next + 1) % len(c.customers)
+	}
+	c.tickets[customer] = append(c.tickets[customer], t)
+}
+
+// pop takes the oldest runnable ticket of the customer whose turn it is and moves on to the next
+// customer. Customers without a runnable ticket are passed over.
+func (c *class) pop(runnable func(Entry) bool) *ticket {
+	for n := range len(c.customers) {
+		i := (c.next + n) % len(c.customers)
+		customer := c.customers[i]
+		j := slices.IndexFunc(c.tickets[customer], func(t *ticket) bool { return runnable(t.entry) })
+		if j < 0 {
+			continue
+		}
+		t := c.tickets[customer][j]
+		c.tickets[customer] = slices.Delete(c.tickets[customer], j, j+1)
+		c.next = i
+		if len(c.tickets[customer]) == 0 {
+			c.drop(i)
+		} else {
+			c.next = (i + 1) % len(c.customers)
+		}
+		return t
+	}
+	return nil
+}
+
+// remove takes the ticket out of the queue, false if it isn't queued anymore.
+func (c *class) remove(t *ticket) bool {
+	customer := t.entry.Customer
+	i := slices.Index(c.tickets[customer], t)
+	if i < 0 {
+		return false
+	}
+	c.tickets[customer] = slices.Delete(c.tickets[customer], i, i+1)
+	if len(c.tickets[customer]) == 0 {
+		c.drop(slices.Index(c.customers, customer))
+	}
+	return true
+}
+
+// drop removes the customer at index i from the rotation, keeping whose turn it is.
+func (c *class) drop(i int) {
+	delete(c.tickets, c.customers[i])
+	c.customers = slices.Delete(c.customers, i, i+1)
+	if i < c.next {
+		c.next--
+	}
+	if c.next >= len(c.customers) {
+		c.next = 0
+	}
+}
+
+// order returns the queued tickets in the order pop takes them.
+func (c *class) order() []*ticket {
+	rotation := append(slices.Clone(c.customers[c.next:]), c.customers[:c.next]...)
+	var order []*ticket
+	for round := 0; ; round++ {
+		taken := false
+		for _, customer := range rotation {
+			if tickets := c.tickets[customer]; round < len(tickets) {
+				order = append(order, tickets[round])
+				taken = true
+			}
+		}
+		if !taken {
+			return order
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queue starts waiting for every entry and waits until all of them are queued.
+func queue(t *testing.T, s *Scheduler, entries ...Entry) map[string]chan func() {
+	started := make(map[string]chan func())
+	for _, entry := range entries {
+		ch := make(chan func(), 1)
+		started[entry.JobID] = ch
+		go func() {
+			release, err := s.Wait(context.Background(), entry)
+			if err == nil {
+				ch <- release
+			}
+		}()
+		require.Eventually(t, func() bool {
+			_, ok := s.Position(entry.JobID)
+			return ok
+		}, time.Second, time.Millisecond)
+	}
+	return started
+}
+
+func jobIDs(queue []Entry) []string {
+	var ids []string
+	for _, entry := range queue {
+		ids = append(ids, entry.JobID)
+	}
+	return ids
+}
+
+func TestScheduler_RoundRobinAcrossCustomers(t *testing.T) {
+	s := New(1)
+	release, err := s.Wait(context.Background(), Entry{JobID: "running", Customer: "acme"})
+	require.NoError(t, err)
+
+	queue(t, s,
+		Entry{JobID: "a1", Customer: "acme"},
+		Entry{JobID: "a2", Customer: "acme"},
+		Entry{JobID: "a3", Customer: "acme"},
+		Entry{JobID: "g1", Customer: "globex"},
+		Entry{JobID: "i1", Customer: "initech"},
+		Entry{JobID: "g2", Customer: "globex"},
+	)
+	assert.Equal(t, []string{"a1", "g1", "i1", "a2", "g2", "a3"}, jobIDs(s.Queue()))
+	position, ok := s.Position("i1")
+	require.True(t, ok)
+	assert.Equal(t, 3, position)
+	release()
+}
+
+func TestScheduler_PrioritiesJumpAhead(t *testing.T) {
+	s := New(1)
+	release, err := s.Wait(context.Background(), Entry{JobID: "running", Customer: "acme"})
+	require.NoError(t, err)
+
+	queue(t, s,
+		Entry{JobID: "fleet", Customer: "acme", Priority: PriorityLow},
+		Entry{JobID: "normal", Customer: "acme"},
+		Entry{JobID: "paid", Customer: "globex", Priority: PriorityHigh},
+		Entry{JobID: "hotfix", Customer: "initech", Priority: PriorityUrgent},
+	)
+	assert.Equal(t, []string{"hotfix", "paid", "normal", "fleet"}, jobIDs(s.Queue()))
+	assert.Equal(t, PriorityNormal, s.Queue()[2].Priority, "builds without a priority are normal")
+	release()
+}
+
+func TestScheduler_DispatchesInQueueOrder(t *testing.T) {
+	s := New(1)
+	release, err := s.Wait(context.Background(), Entry{JobID: "running", Customer: "acme"})
+	require.NoError(t, err)
+	started := queue(t, s,
+		Entry{JobID: "a1", Customer: "acme"},
+		Entry{JobID: "a2", Customer: "acme"},
+		Entry{JobID: "g1", Customer: "globex"},
+	)
+
+	var order []string
+	for _, id := range jobIDs(s.Queue()) {
+		release()
+		select {
+		case release = <-started[id]:
+			order = append(order, id)
+		case <-time.After(time.Second):
+			t.Fatalf("%s wasn't dispatched", id)
+		}
+		workers, running := s.Stats()
+		assert.Equal(t, 1, workers)
+		assert.Equal(t, 1, running)
+	}
+	assert.Equal(t, []string{"a1", "g1", "a2"}, order)
+	release()
+	_, running := s.Stats()
+	assert.Zero(t, running)
+}
+
+func TestScheduler_CanceledWaitLeavesQueue(t *testing.T) {
+	s := New(1)
+	release, err := s.Wait(context.Background(), Entry{JobID: "running", Customer: "acme"})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Wait(ctx, Entry{JobID: "canceled", Customer: "globex"})
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return len(s.Queue()) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Empty(t, s.Queue())
+
+	release()
+	release, err = s.Wait(context.Background(), Entry{JobID: "next", Customer: "acme"})
+	require.NoError(t, err, "the worker is free again")
+	release()
+}
+
+// submit starts waiting for every entry and waits until each of them is queued or dispatched.
+func submit(t *testing.T, s *Scheduler, entries ...Entry) map[string]chan func() {
+	builds := make(map[string]chan func())
+	for _, entry := range entries {
+		ch := make(chan func(), 1)
+		builds[entry.JobID] = ch
+		go func() {
+			release, err := s.Wait(context.Background(), entry)
+			if err == nil {
+				ch <- release
+			}
+		}()
+		require.Eventually(t, func() bool {
+			_, queued := s.Position(entry.JobID)
+			return queued || len(ch) == 1
+		}, time.Second, time.Millisecond)
+	}
+	return builds
+}
+
+// started reports whether the build was dispatched, waiting a moment for it.
+func started(ch chan func()) (func(), bool) {
+	select {
+	case release := <-ch:
+		return release, true
+	case <-time.After(50 * time.Millisecond):
+		return nil, false
+	}
+}
+
+func TestScheduler_BotBuildsOneAtATime(t *testing.T) {
+	s := New(2)
+	release, err := s.Wait(context.Background(), Entry{JobID: "running", Customer: "acme", Bot: "a"})
+	require.NoError(t, err)
+	builds := submit(t, s,
+		Entry{JobID: "a2", Customer: "acme", Bot: "a"},
+		Entry{JobID: "b1", Customer: "acme", Bot: "b"},
+	)
+
+	releaseB, ok := started(builds["b1"])
+	require.True(t, ok, "a build of another bot takes the free worker")
+	_, ok = started(builds["a2"])
+	assert.False(t, ok, "a build of the bot being built waits")
+	releaseB()
+	_, ok = started(builds["a2"])
+	assert.False(t, ok, "a free worker isn't enough")
+	assert.Equal(t, []string{"a2"}, jobIDs(s.Queue()))
+
+	release()
+	releaseA, ok := started(builds["a2"])
+	require.True(t, ok)
+	releaseA()
+}
+
+func TestScheduler_CustomerLimit(t *testing.T) {
+	s := New(3)
+	release, err := s.Wait(context.Background(), Entry{JobID: "a1", Customer: "acme", Bot: "a", MaxRunning: 1})
+	require.NoError(t, err)
+	builds := submit(t, s,
+		Entry{JobID: "a2", Customer: "acme", Bot: "b", MaxRunning: 1},
+		Entry{JobID: "fleet", Customer: "acme", Bot: "c", Priority: PriorityLow},
+		Entry{JobID: "g1", Customer: "globex", Bot: "a", MaxRunning: 1},
+	)
+
+	releaseG, ok := started(builds["g1"])
+	require.True(t, ok, "other customers aren't held up")
+	releaseFleet, ok := started(builds["fleet"])
+	require.True(t, ok, "builds without a limit don't count against it")
+	_, ok = started(builds["a2"])
+	assert.False(t, ok, "the customer is at its limit")
+	releaseG()
+	releaseFleet()
+
+	release()
+	releaseA, ok := started(builds["a2"])
+	require.True(t, ok)
+	releaseA()
+	_, running := s.Stats()
+	assert.Zero(t, running)
+}
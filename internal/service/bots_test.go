@@ -0,0 +1,62 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func syncedStore(bots ...state.Bot) *state.Store {
+	store := state.NewStore()
+	store.Replace(bots)
+	return store
+}
+
+func TestListBots(t *testing.T) {
+	s := &server{bots: syncedStore(
+		state.Bot{ContainerID: "a1", Name: "acme_mybot", Customer: "acme", Bot: "mybot", State: "running"},
+		state.Bot{ContainerID: "a2", Name: "acme_mybot-previous", Customer: "acme", Bot: "mybot", State: "exited"},
+		state.Bot{ContainerID: "a3", Name: "acme_otherbot", Customer: "acme", Bot: "otherbot", State: "exited"},
+		state.Bot{ContainerID: "b1", Name: "globex_mybot", Customer: "globex", Bot: "mybot", State: "running"},
+	)}
+
+	list := func(query string) []string {
+		rec := httptest.NewRecorder()
+		s.listBots()(rec, httptest.NewRequest(http.MethodGet, "/bots"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var bots []state.Bot
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &bots))
+		var ids []string
+		for _, bot := range bots {
+			ids = append(ids, bot.ContainerID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"a1", "a3", "b1"}, list(""))
+	assert.Equal(t, []string{"a1", "a3"}, list("?customer=acme"))
+	assert.Equal(t, []string{"a1", "b1"}, list("?state=running"))
+}
+
+func TestBotStatus_FromStore(t *testing.T) {
+	s := &server{bots: syncedStore(
+		state.Bot{ContainerID: "4f2a9c01", Name: "acme_mybot", State: "exited", ExitCode: 137, OOMKilled: true},
+	)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{containerId}/status", s.botStatus())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/4f2a/status", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "exited", response["status"])
+	assert.Equal(t, "4f2a9c01", response["containerId"])
+	assert.Equal(t, true, response["oomKilled"])
+}
@@ -0,0 +1,414 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/customers"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/reconcile"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// Outcomes of a customer operation for a bot.
+const (
+	botStopped = "stopped"
+	botStarted = "started"
+	botRemoved = "removed"
+	botSkipped = "skipped"
+	botFailed  = "failed"
+)
+
+// botOutcome is the result of a customer operation for one of the customer's bots.
+type botOutcome struct {
+	Bot         string   `json:"bot"`
+	ContainerID string   `json:"containerId,omitempty"`
+	Result      string   `json:"result"`
+	Reason      string   `json:"reason,omitempty"`
+	Images      []string `json:"images,omitempty"` // Images removed by a purge
+}
+
+// customerReport is the result of a customer operation.
+type customerReport struct {
+	Customer *customers.Customer `json:"customer"`
+	Bots     []botOutcome        `json:"bots"`
+
+	// Removed by a purge
+	Networks []string `json:"networks,omitempty"`
+	Sources  []string `json:"sources,omitempty"`
+}
+
+func (r *customerReport) add(outcome botOutcome) {
+	r.Bots = append(r.Bots, outcome)
+}
+
+func (r *customerReport) fail(bot, containerID string, err error) {
+	log.Default().Println(fmt.Sprintf("Error: %s/%s: %+v", r.Customer.Name, bot, err))
+	r.add(botOutcome{Bot: bot, ContainerID: containerID, Result: botFailed, Reason: err.Error()})
+}
+
+// checkActive fails with a Forbidden error if the customer is suspended or purged.
+func (s *server) checkActive(customerName string) error {
+	customer, err := s.customers.Get(customerName)
+	if err != nil {
+		return err
+	}
+	if !customer.Active() {
+		return errdefs.Forbidden(fmt.Errorf("customer %s is %s", customerName, customer.Status))
+	}
+	return nil
+}
+
+// activeActions leaves out the reconcile actions of customers that aren't active, their bots
+// are stopped or removed on purpose.
+func (s *server) activeActions(actions []reconcile.Action) ([]reconcile.Action, error) {
+	active := make(map[string]bool)
+	var kept []reconcile.Action
+	for _, action := range actions {
+		ok, known := active[action.Customer]
+		if !known {
+			customer, err := s.customers.Get(action.Customer)
+			if err != nil {
+				return nil, err
+			}
+			ok = customer.Active()
+			active[action.Customer] = ok
+		}
+		if ok {
+			kept = append(kept, action)
+		}
+	}
+	return kept, nil
+}
+
+// customerBots returns the containers of the customer's bots, with the containers stashed during deploys if stashes is set.
+func (s *server) customerBots(ctx context.Context, customerName string, stashes bool) ([]state.Bot, error) {
+	actual, err := s.actualBots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var bots []state.Bot
+	for _, b := range actual {
+		if b.Customer == customerName && (stashes || !docker.IsPrevious(b.Name)) {
+			bots = append(bots, b)
+		}
+	}
+	sort.Slice(bots, func(i, j int) bool { return bots[i].Name < bots[j].Name })
+	return bots, nil
+}
+
+// customerStatus returns whether the customer is active, suspended or purged.
+func (s *server) customerStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customer, err := s.customers.Get(r.PathValue("customer"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, customer)
+	}
+}
+
+// suspendCustomer blocks builds of the customer's bots and stops the running ones. The bots
+// that were running are remembered, so resuming starts them again.
+func (s *server) suspendCustomer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerName := r.PathValue("customer")
+		customer, err := s.customers.Update(customerName, func(c *customers.Customer) {
+			if c.Active() {
+				now := time.Now().UTC()
+				c.Status, c.SuspendedAt = customers.StatusSuspended, &now
+			}
+			if reason := r.FormValue("reason"); reason != "" {
+				c.Reason = reason
+			}
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		log.Default().Printf("Customer %s %s", customerName, customer.Status)
+
+		bots, err := s.customerBots(r.Context(), customerName, false)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		report := &customerReport{Customer: customer, Bots: []botOutcome{}}
+		var stopped []string
+		for _, b := range bots {
+			if s.stopCustomerBot(b, report) {
+				stopped = append(stopped, b.Bot)
+			}
+		}
+
+		report.Customer, err = s.customers.Update(customerName, func(c *customers.Customer) {
+			for _, bot := range stopped {
+				if !slices.Contains(c.Running, bot) {
+					c.Running = append(c.Running, bot)
+				}
+			}
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, report)
+	}
+}
+
+// stopCustomerBot stops the bot's container. It reports whether the bot was running.
+func (s *server) stopCustomerBot(b state.Bot, report *customerReport) bool {
+	unlock := s.locks.Lock(docker.ContainerName(b.Customer, b.Bot))
+	defer unlock()
+
+	bc, err := docker.GetBotContainer(b.ContainerID)
+	if err != nil {
+		report.fail(b.Bot, b.ContainerID, err)
+		return false
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	status, err := bc.Status()
+	if err != nil {
+		report.fail(b.Bot, b.ContainerID, err)
+		return false
+	}
+	if status != "running" && status != "paused" && status != "restarting" {
+		report.add(botOutcome{Bot: b.Bot, ContainerID: bc.ID, Result: botSkipped, Reason: "container is " + status})
+		return false
+	}
+	if err := bc.Stop(); err != nil {
+		report.fail(b.Bot, b.ContainerID, err)
+		return false
+	}
+	report.add(botOutcome{Bot: b.Bot, ContainerID: bc.ID, Result: botStopped})
+	return true
+}
+
+// resumeCustomer lifts the suspension of the customer and starts the bots that were running when it was suspended.
+func (s *server) resumeCustomer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerName := r.PathValue("customer")
+		customer, err := s.customers.Get(customerName)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if customer.Active() {
+			writeError(w, r, errdefs.Conflict(fmt.Errorf("customer %s isn't suspended", customerName)))
+			return
+		}
+
+		bots, err := s.customerBots(r.Context(), customerName, false)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		report := &customerReport{Bots: []botOutcome{}}
+		report.Customer, err = s.customers.Update(customerName, func(c *customers.Customer) {
+			c.Status, c.Reason, c.SuspendedAt, c.Running = customers.StatusActive, "", nil, nil
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		log.Default().Printf("Customer %s resumed", customerName)
+
+		for _, b := range bots {
+			if !slices.Contains(customer.Running, b.Bot) {
+				report.add(botOutcome{Bot: b.Bot, ContainerID: b.ContainerID, Result: botSkipped, Reason: "bot wasn't running when the customer was suspended"})
+				continue
+			}
+			s.startCustomerBot(b, report)
+		}
+		for _, bot := range customer.Running {
+			if !slices.ContainsFunc(bots, func(b state.Bot) bool { return b.Bot == bot }) {
+				report.fail(bot, "", errdefs.NotFound(fmt.Errorf("container of bot %s no longer exists", bot)))
+			}
+		}
+		writeJSON(w, r, report)
+	}
+}
+
+func (s *server) startCustomerBot(b state.Bot, report *customerReport) {
+	unlock := s.locks.Lock(docker.ContainerName(b.Customer, b.Bot))
+	defer unlock()
+
+	bc, err := docker.GetBotContainer(b.ContainerID)
+	if err != nil {
+		report.fail(b.Bot, b.ContainerID, err)
+		return
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	if err := bc.Start(); err != nil {
+		report.fail(b.Bot, b.ContainerID, err)
+		return
+	}
+	report.add(botOutcome{Bot: b.Bot, ContainerID: bc.ID, Result: botStarted})
+}
+
+// purgeCustomer removes the containers, images and networks of the customer's bots, their build history
+// and the sources archived for them. The customer stays blocked until it is resumed.
+func (s *server) purgeCustomer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		customerName := r.PathValue("customer")
+		customer, err := s.customers.Update(customerName, func(c *customers.Customer) {
+			if c.SuspendedAt == nil {
+				now := time.Now().UTC()
+				c.SuspendedAt = &now
+			}
+			c.Status, c.Running = customers.StatusPurged, nil
+			if reason := r.FormValue("reason"); reason != "" {
+				c.Reason = reason
+			}
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		log.Default().Printf("Purging customer %s", customerName)
+
+		containers, err := s.customerBots(ctx, customerName, true)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		built, err := s.history.Bots(customerName)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		report := &customerReport{Customer: customer, Bots: []botOutcome{}}
+		purged := make(map[string]*botOutcome)
+		var names []string
+		for _, b := range containers {
+			if err := s.removeCustomerContainer(b); err != nil {
+				report.fail(b.Bot, b.ContainerID, err)
+				continue
+			}
+			if purged[b.Bot] == nil {
+				purged[b.Bot] = &botOutcome{Bot: b.Bot, Result: botRemoved}
+				names = append(names, b.Bot)
+			}
+			if !docker.IsPrevious(b.Name) {
+				purged[b.Bot].ContainerID = b.ContainerID
+			}
+		}
+		for _, bot := range built {
+			if purged[bot] == nil && !slices.ContainsFunc(report.Bots, func(o botOutcome) bool { return o.Bot == bot }) {
+				purged[bot] = &botOutcome{Bot: bot, Result: botRemoved}
+				names = append(names, bot)
+			}
+		}
+		sort.Strings(names)
+		for _, bot := range names {
+			outcome := purged[bot]
+			images, err := docker.RemoveBotImages(ctx, customerName, bot)
+			outcome.Images = images
+			if err != nil {
+				report.fail(bot, outcome.ContainerID, err)
+				continue
+			}
+			report.add(*outcome)
+		}
+
+		// The networks are removed once the containers attached to them are gone
+		if report.Networks, err = docker.RemoveCustomerNetworks(ctx, customerName); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if report.Sources, err = s.purgeSources(ctx, customerName); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, report)
+	}
+}
+
+func (s *server) removeCustomerContainer(b state.Bot) error {
+	unlock := s.locks.Lock(docker.ContainerName(b.Customer, b.Bot))
+	defer unlock()
+
+	bc, err := docker.GetBotContainer(b.ContainerID)
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+	if err := bc.Remove(); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// purgeSources removes the customer's build history and the archived sources built only by the
+// customer, so a resumed customer can't rebuild from a deleted source. Sources other customers built
+// as well are kept, their bots may still be rebuilt from them. Jobs are checked too, since a build
+// archives its source before it is recorded in the history. The sources stay locked until they are
+// removed, so a build archiving one meanwhile puts it back.
+func (s *server) purgeSources(ctx context.Context, customerName string) ([]string, error) {
+	sources, err := s.history.Sources()
+	if err != nil {
+		return nil, err
+	}
+	candidates := ownSources(sources, customerName)
+	for _, source := range candidates {
+		unlock := s.locks.Lock(bundleKey(source))
+		defer unlock()
+	}
+	building, err := s.jobs.Bundles()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.history.DeleteCustomer(customerName); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, source := range candidates {
+		if slices.ContainsFunc(building[source], func(c string) bool { return c != customerName }) {
+			continue
+		}
+		if err := s.bundles.Delete(ctx, bundleKey(source)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, source)
+	}
+	return removed, nil
+}
+
+// ownSources returns the sources only the customer built, sorted.
+func ownSources(sources map[string][]string, customerName string) []string {
+	var own []string
+	for source, builtBy := range sources {
+		if len(builtBy) == 1 && builtBy[0] == customerName {
+			own = append(own, source)
+		}
+	}
+	sort.Strings(own)
+	return own
+}
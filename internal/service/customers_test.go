@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/customers"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/sensority-labs/builder/internal/fleet"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/reconcile"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func suspend(t *testing.T, s *server, customerName string) {
+	_, err := s.customers.Update(customerName, func(c *customers.Customer) { c.Status = customers.StatusSuspended })
+	require.NoError(t, err)
+}
+
+func TestDeploy_SuspendedCustomer(t *testing.T) {
+	s := newJobServer(t)
+	s.locks = newBotLocks()
+	suspend(t, s, "acme")
+
+	res, err := s.deploy(context.Background(), &jobs.Job{Customer: "acme", Bot: "mybot"}, quota.Limits{}, cradle.Template{}, []byte("bundle"))
+	assert.True(t, errdefs.IsForbidden(err), "%v", err)
+	assert.Nil(t, res, "no job is created for a suspended customer")
+	require.NoError(t, s.checkActive("globex"))
+}
+
+func TestActiveActions(t *testing.T) {
+	s := newJobServer(t)
+	suspend(t, s, "acme")
+
+	actions, err := s.activeActions([]reconcile.Action{
+		{Kind: reconcile.ActionStart, Customer: "acme", Bot: "mybot"},
+		{Kind: reconcile.ActionStart, Customer: "globex", Bot: "mybot"},
+	})
+	require.NoError(t, err)
+	require.Len(t, actions, 1)
+	assert.Equal(t, "globex", actions[0].Customer)
+}
+
+func TestRebuildTargets_SuspendedCustomer(t *testing.T) {
+	s, _ := newRebuildServer(t)
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "a", Template: "ts", Source: testSource, Status: "succeeded"}))
+	suspend(t, s, "acme")
+
+	targets, err := s.rebuildTargets(context.Background(), []state.Bot{{Customer: "acme", Bot: "a"}}, "")
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, fleet.TargetSkipped, targets[0].Status)
+	assert.Equal(t, "customer is suspended", targets[0].Error)
+}
+
+func TestCustomerStatusAndResume(t *testing.T) {
+	s := newJobServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /customers/{customer}/status", s.customerStatus())
+	mux.HandleFunc("POST /customers/{customer}/resume", s.resumeCustomer())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/customers/acme/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"active"`)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/customers/acme/resume", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code, "only suspended customers can be resumed")
+}
+
+func TestOwnSources(t *testing.T) {
+	sources := map[string][]string{
+		"s1": {"acme"},
+		"s2": {"acme", "globex"},
+		"s3": {"globex"},
+		"s0": {"acme"},
+	}
+	assert.Equal(t, []string{"s0", "s1"}, ownSources(sources, "acme"))
+}
+
+// newCustomerServer returns a server with the customer operations routed, on a fake daemon.
+func newCustomerServer(t *testing.T) (*server, *http.ServeMux) {
+	s, _ := newRebuildServer(t)
+	s.bots = state.NewStore()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /customers/{customer}/suspend", s.suspendCustomer())
+	mux.HandleFunc("POST /customers/{customer}/resume", s.resumeCustomer())
+	mux.HandleFunc("POST /customers/{customer}/purge", s.purgeCustomer())
+	mux.HandleFunc("POST /bots/{customer}/{bot}/rebuild", s.rebuildBot())
+	return s, mux
+}
+
+func customerOperation(t *testing.T, mux *http.ServeMux, path string) customerReport {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var report customerReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return report
+}
+
+func TestSuspendAndResumeCustomer(t *testing.T) {
+	d := dockertest.New(t)
+	_, mux := newCustomerServer(t)
+	runningID := addBot(t, d, "acme", "running", "running")
+	stoppedID := addBot(t, d, "acme", "stopped", "exited")
+	otherID := addBot(t, d, "globex", "running", "running")
+
+	report := customerOperation(t, mux, "/customers/acme/suspend?reason=unpaid")
+
+	assert.Equal(t, customers.StatusSuspended, report.Customer.Status)
+	assert.Equal(t, "unpaid", report.Customer.Reason)
+	assert.Equal(t, []string{"running"}, report.Customer.Running)
+	assert.Equal(t, []botOutcome{
+		{Bot: "running", ContainerID: runningID, Result: botStopped},
+		{Bot: "stopped", ContainerID: stoppedID, Result: botSkipped, Reason: "container is exited"},
+	}, report.Bots)
+	running, _ := d.Container(runningID)
+	assert.Equal(t, "exited", running.State)
+	other, _ := d.Container(otherID)
+	assert.Equal(t, "running", other.State, "other customers aren't affected")
+
+	report = customerOperation(t, mux, "/customers/acme/resume")
+
+	assert.Equal(t, customers.StatusActive, report.Customer.Status)
+	assert.Equal(t, []botOutcome{
+		{Bot: "running", ContainerID: runningID, Result: botStarted},
+		{Bot: "stopped", ContainerID: stoppedID, Result: botSkipped, Reason: "bot wasn't running when the customer was suspended"},
+	}, report.Bots)
+	running, _ = d.Container(runningID)
+	assert.Equal(t, "running", running.State)
+	stopped, _ := d.Container(stoppedID)
+	assert.Equal(t, "exited", stopped.State)
+}
+
+func TestPurgeCustomer(t *testing.T) {
+	d := dockertest.New(t)
+	s, mux := newCustomerServer(t)
+	ctx := context.Background()
+	id := addBot(t, d, "acme", "mybot", "running")
+	otherID := addBot(t, d, "globex", "mybot", "running")
+	d.AddNetwork("acme-private", map[string]string{docker.LabelCustomer: "acme"})
+	d.AddNetwork("globex-private", map[string]string{docker.LabelCustomer: "globex"})
+	d.AddNetwork("sensority-labs", nil)
+	own, shared, building := strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)
+	for _, source := range []string{own, shared, building} {
+		require.NoError(t, s.archiveBundle(ctx, source, []byte("bundle")))
+	}
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "mybot", Template: "ts", Source: own, Status: "succeeded"}))
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "mybot", Template: "ts", Source: shared, Status: "succeeded"}))
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "globex", Bot: "mybot", Template: "ts", Source: shared, Status: "succeeded"}))
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "mybot", Template: "ts", Source: building, Status: "succeeded"}))
+	// A build of another customer from the same bundle that isn't in the history yet
+	require.NoError(t, s.jobs.Create(&jobs.Job{Customer: "globex", Bot: "otherbot", Bundle: building}))
+
+	report := customerOperation(t, mux, "/customers/acme/purge")
+
+	assert.Equal(t, customers.StatusPurged, report.Customer.Status)
+	assert.Equal(t, []botOutcome{
+		{Bot: "mybot", ContainerID: id, Result: botRemoved, Images: []string{"acme_mybot:latest"}},
+	}, report.Bots)
+	assert.Equal(t, []string{own}, report.Sources)
+	assert.Equal(t, []string{"acme-private"}, report.Networks)
+	assert.ElementsMatch(t, []string{"globex-private", "sensority-labs"}, d.Networks())
+	calls := d.Calls()
+	require.Contains(t, calls, "remove acme_mybot")
+	assert.Less(t, slices.Index(calls, "remove acme_mybot"), slices.Index(calls, "remove network acme-private"),
+		"networks are removed after the containers attached to them")
+	_, ok := d.Container(id)
+	assert.False(t, ok)
+	_, ok = d.Container(otherID)
+	assert.True(t, ok, "other customers aren't affected")
+	for source, kept := range map[string]bool{own: false, shared: true, building: true} {
+		exists, err := s.bundles.Exists(ctx, bundleKey(source))
+		require.NoError(t, err)
+		assert.Equal(t, kept, exists, source)
+	}
+	h, err := s.history.History("acme", "mybot", 10)
+	require.NoError(t, err)
+	assert.Empty(t, h.Builds, "the history doesn't point at removed sources")
+
+	customerOperation(t, mux, "/customers/acme/resume")
+	rec := rebuild(mux, "/bots/acme/mybot/rebuild", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "a purged bot has no build to rebuild")
+}
+
+func TestRefreshEnvs_SuspendedCustomer(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://new"}
+	s, id := newRefreshServer(t, d, core, "exited", map[string]string{"RPC_URL": "http://old"})
+	suspend(t, s, "acme")
+
+	_, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	assert.ErrorIs(t, err, fleet.ErrSkipped)
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, id, current.ID)
+}
+
+func TestRecoverJob_SuspendedCustomer(t *testing.T) {
+	d := dockertest.New(t)
+	oldImage, _, stashID := interruptedDeploy(t, d)
+	id := addBot(t, d, "acme", "mybot", "created")
+	s := newRecoveryServer(t, newFakeCore())
+	suspend(t, s, "acme")
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepCreate, KeptImage: true,
+		StashID: stashID, StashWasRunning: true, ContainerID: id}
+
+	_, err := s.recoverJob(context.Background(), job)
+
+	assert.ErrorIs(t, err, errInterrupted)
+	restored, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, stashID, restored.ID)
+	assert.Equal(t, "exited", restored.State, "the bot of a suspended customer isn't started")
+	assert.Equal(t, oldImage, d.ImageID("acme_mybot:latest"))
+	customer, err := s.customers.Get("acme")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mybot"}, customer.Running, "resuming the customer starts the bot")
+}
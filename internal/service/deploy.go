@@ -0,0 +1,410 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/buildlog"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/outbox"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/scheduler"
+)
+
+// kindCoreRegistration is the outbox kind of container IDs waiting to be registered in core.
+const kindCoreRegistration = "core.update_id"
+
+// coreRegistration is the outbox payload registering a bot's container in core.
+type coreRegistration struct {
+	CustomerName string `json:"customerName"`
+	BotName      string `json:"botName"`
+	ContainerID  string `json:"containerId"`
+}
+
+func registrationKey(customerName, botName string) string {
+	return kindCoreRegistration + "/" + customerName + "/" + botName
+}
+
+// deploy builds the bot image from the uploaded bundle and replaces the bot's container with a new one.
+// Deploys wait in the build queue for their turn, then are serialized with the other operations on the bot.
+// Builds of a customer beyond its concurrent builds wait in the queue, fleet rebuilds aren't limited.
+//
+// Every deploy is tracked as a job in the job store, so a deploy interrupted by a restart of the
+// builder can be finished or undone on startup. The result carries the job ID even if the deploy failed.
+func (s *server) deploy(ctx context.Context, job *jobs.Job, limits quota.Limits, tmpl cradle.Template, bundle []byte) (*buildResult, error) {
+	if err := s.checkActive(job.Customer); err != nil {
+		return nil, err
+	}
+
+	if !scheduler.ValidPriority(job.Priority) {
+		job.Priority = scheduler.PriorityNormal
+	}
+	job.Status, job.Step = jobs.StatusQueued, jobs.StepCheckout
+	if err := s.jobs.Create(job); err != nil {
+		return nil, err
+	}
+	entry := scheduler.Entry{
+		JobID:    job.ID,
+		Customer: job.Customer,
+		Bot:      job.Bot,
+		Priority: job.Priority,
+		QueuedAt: job.CreatedAt,
+	}
+	if !job.Fleet {
+		entry.MaxRunning = limits.MaxConcurrentBuilds
+	}
+	release, err := s.scheduler.Wait(ctx, entry)
+	if err != nil {
+		s.finishJob(job, nil, err)
+		return &buildResult{JobID: job.ID}, err
+	}
+	defer release()
+
+	unlock := s.locks.Lock(docker.ContainerName(job.Customer, job.Bot))
+	defer unlock()
+
+	// Checked again under the lock, so no deploy of a suspended customer's bot slips past a suspend
+	// or purge while it was queued
+	if err := s.checkActive(job.Customer); err != nil {
+		s.finishJob(job, nil, err)
+		return &buildResult{JobID: job.ID}, err
+	}
+
+	s.updateJob(job, func(j *jobs.Job) {
+		startedAt := time.Now().UTC()
+		j.Status, j.StartedAt = jobs.StatusRunning, &startedAt
+	})
+	log.Default().Printf("Build job %s of %s/%s started", job.ID, job.Customer, job.Bot)
+
+	buildLog, err := s.logs.Create(job.ID)
+	if err != nil {
+		s.finishJob(job, nil, err)
+		return &buildResult{JobID: job.ID}, err
+	}
+	res, err := s.runDeploy(ctx, job, tmpl, bundle, buildLog)
+	if err != nil {
+		buildLog.Printf("Build failed: %v", err)
+	} else {
+		buildLog.Printf("Build succeeded, container %s", res.ContainerID)
+	}
+	if err := buildLog.Close(); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+	s.finishJob(job, res, err)
+	if res == nil {
+		res = &buildResult{}
+	}
+	res.JobID = job.ID
+	return res, err
+}
+
+// runDeploy runs the steps of a deploy, recording its progress on the job and its output in the build log.
+//
+// The deploy runs as a saga: if a step fails, the new container is removed, the previous container
+// is restored and the image tag points back to the previous image. If core can't be reached to
+// register the new container, the registration is retried from the outbox instead.
+func (s *server) runDeploy(ctx context.Context, job *jobs.Job, tmpl cradle.Template, bundle []byte, buildLog *buildlog.Writer) (res *buildResult, err error) {
+	customerName, botName := job.Customer, job.Bot
+	logf := func(format string, args ...any) {
+		log.Default().Printf(format, args...)
+		buildLog.Printf(format, args...)
+	}
+
+	// Every build gets its own workspace exported from the cradle mirror. Workspaces live in the
+	// data directory, so the ones of builds interrupted by a restart are cleaned up on startup.
+	cradlePath := s.workspace(job.ID)
+	if err := os.MkdirAll(cradlePath, 0755); err != nil {
+		return nil, err
+	}
+
+	checkout, err := s.mirrors.Checkout(tmpl, job.Ref, cradlePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.archiveBundle(ctx, job.Bundle, bundle); err != nil {
+		// The build doesn't need the archive, only a later rebuild does
+		logf("Error: archiving the bundle: %v", err)
+	}
+	logf("Checked out cradle %s at %s", tmpl.Name, checkout.Commit)
+	s.updateJob(job, func(j *jobs.Job) { j.CradleCommit = checkout.Commit })
+
+	logf("Extracting...")
+
+	// Write the bundle next to the workspace rather than in it, so it doesn't end up in the image.
+	bundlePath := cradlePath + ".tar.gz"
+	if err := os.WriteFile(bundlePath, bundle, 0644); err != nil {
+		return nil, err
+	}
+
+	// Extract the tar.gz file to the cradle directory
+	if err := extractBotSourceCode(cradlePath, bundlePath); err != nil {
+		return nil, err
+	}
+
+	logf("Bot code extracted. Building docker image...")
+
+	bc, err := docker.NewBotContainer(s.cfg, botName, customerName)
+	if err != nil {
+		return nil, err
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	tx := newSaga("deploy of " + bc.Name)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rollbackErr := tx.rollback(); rollbackErr != nil {
+			err = fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+	}()
+
+	logf("Building the bot image...")
+	s.updateJob(job, func(j *jobs.Job) { j.Step = jobs.StepBuild })
+	var keptImage, cacheHit bool
+	if err := tx.step("build image", func() error {
+		var err error
+		if keptImage, err = bc.KeepImage(); err != nil {
+			return err
+		}
+		s.updateJob(job, func(j *jobs.Job) { j.KeptImage = keptImage })
+		if cacheHit, err = bc.Build(cradlePath, path.Join(cradlePath, "bot"), checkout.Commit, checkout.Labels(), s.cfg.Bot.BuildArgs, io.MultiWriter(os.Stdout, buildLog)); err != nil {
+			if keptImage {
+				if err := bc.DropKeptImage(); err != nil {
+					log.Default().Println(fmt.Sprintf("Error: %+v", err))
+				}
+			}
+			return err
+		}
+		return nil
+	}, func() error {
+		return bc.RestoreImage(keptImage)
+	}); err != nil {
+		return nil, err
+	}
+
+	logf("Bot image ready (cache hit: %t). Updating bot envs...", cacheHit)
+	s.updateJob(job, func(j *jobs.Job) { j.Step, j.CacheHit = jobs.StepEnvs, cacheHit })
+	if err := tx.step("update envs", func() error {
+		if err := bc.UpdateEnvs(ctx, s.cfg, s.core); err != nil {
+			return err
+		}
+		s.updateJob(job, func(j *jobs.Job) { j.EnvsHash = history.HashEnvs(bc.Envs) })
+		return nil
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	logf("Envs updated. Stashing the previous container...")
+	swap, err := s.swapContainer(ctx, customerName, botName, job, bc, tx, logf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The deploy is committed, the previous container and image are no longer needed
+	commitDeploy(bc, swap.stash, keptImage)
+
+	return &buildResult{
+		ContainerID:         bc.ID,
+		CradleCommit:        checkout.Commit,
+		CacheHit:            cacheHit,
+		RegistrationPending: swap.registrationPending,
+		Stopped:             swap.stopped,
+	}, nil
+}
+
+// swap is the outcome of replacing a bot's container.
+type swap struct {
+	stash               *docker.Stash
+	stopped             bool // The previous container was stopped, so the new one wasn't started
+	registrationPending bool
+}
+
+// swapContainer replaces the bot's container with a new one from its image as steps of tx:
+// the previous container is stashed, the new one created, started and registered in core.
+// A bot whose previous container was stopped, e.g. by its user, is left stopped.
+// The progress is recorded on job if it isn't nil.
+func (s *server) swapContainer(ctx context.Context, customerName, botName string, job *jobs.Job, bc *docker.BotContainer, tx *saga, logf func(string, ...any)) (*swap, error) {
+	res := &swap{}
+	s.updateJob(job, func(j *jobs.Job) { j.Step = jobs.StepStash })
+	if err := tx.step("stash previous container", func() error {
+		var err error
+		res.stash, err = bc.StashContainer()
+		if res.stash != nil {
+			s.updateJob(job, func(j *jobs.Job) { j.StashID, j.StashWasRunning = res.stash.ID, res.stash.WasRunning })
+		}
+		return err
+	}, func() error {
+		if res.stash == nil {
+			return nil
+		}
+		return bc.RestoreContainer(res.stash)
+	}); err != nil {
+		// A stash that failed halfway still has to be restored
+		if res.stash != nil {
+			if restoreErr := bc.RestoreContainer(res.stash); restoreErr != nil {
+				log.Default().Println(fmt.Sprintf("Error: %+v", restoreErr))
+			}
+		}
+		return nil, err
+	}
+
+	logf("Creating the container...")
+	s.updateJob(job, func(j *jobs.Job) { j.Step = jobs.StepCreate })
+	if err := tx.step("create container", func() error {
+		if err := bc.Create(); err != nil {
+			return err
+		}
+		imageID, err := bc.ContainerImageID()
+		if err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+		s.updateJob(job, func(j *jobs.Job) { j.ContainerID, j.ImageID = bc.ID, imageID })
+		return nil
+	}, func() error {
+		if err := bc.Remove(); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	res.stopped = res.stash != nil && !res.stash.WasRunning
+	if res.stopped {
+		logf("Container created with ID: %s. The previous container was stopped, so the new one isn't started", bc.ID)
+	} else {
+		logf("Container created with ID: %s. Starting...", bc.ID)
+		s.updateJob(job, func(j *jobs.Job) { j.Step = jobs.StepStart })
+		if err := tx.step("start container", bc.Start, nil); err != nil {
+			return nil, err
+		}
+		logf("Container started")
+	}
+
+	// Update the bot ID in the core. If core is only temporarily unavailable, the registration
+	// goes to the outbox rather than undoing a healthy deploy.
+	s.updateJob(job, func(j *jobs.Job) { j.Step = jobs.StepRegister })
+	if err := tx.step("register container in core", func() error {
+		var err error
+		res.registrationPending, err = s.registerContainer(ctx, customerName, botName, bc.ID)
+		return err
+	}, nil); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// commitDeploy drops the previous container and image kept to roll the deploy back.
+func commitDeploy(bc *docker.BotContainer, stash *docker.Stash, keptImage bool) {
+	if stash != nil {
+		if err := bc.DropStash(stash); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}
+	if keptImage {
+		if err := bc.DropKeptImage(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}
+}
+
+// registerContainer registers the bot's new container in core. If core is temporarily unavailable,
+// the registration is put in the outbox and reported as pending.
+func (s *server) registerContainer(ctx context.Context, customerName, botName, containerID string) (bool, error) {
+	err := s.core.UpdateID(ctx, customerName, botName, containerID)
+	if err == nil {
+		// A registration of an older container still waiting in the outbox would overwrite this one
+		s.outbox.Cancel(registrationKey(customerName, botName))
+		return false, nil
+	}
+	if !bot.IsRetryable(err) {
+		return false, err
+	}
+
+	log.Default().Printf("Core registration of %s failed, retrying from the outbox: %v", containerID, err)
+	return true, s.outbox.Enqueue(registrationKey(customerName, botName), kindCoreRegistration, coreRegistration{
+		CustomerName: customerName,
+		BotName:      botName,
+		ContainerID:  containerID,
+	})
+}
+
+// registerInCore delivers a container registration from the outbox. Registrations of containers
+// that were replaced or removed in the meantime are dropped. A bot with an operation in progress is
+// retried later rather than waited for, so the delivery doesn't hold up the rest of the outbox.
+func (s *server) registerInCore(ctx context.Context, payload json.RawMessage) error {
+	var reg coreRegistration
+	if err := json.Unmarshal(payload, &reg); err != nil {
+		return outbox.Permanent(err)
+	}
+
+	unlock, ok := s.locks.TryLock(docker.ContainerName(reg.CustomerName, reg.BotName))
+	if !ok {
+		return fmt.Errorf("%s/%s is busy, registering container %s later", reg.CustomerName, reg.BotName, reg.ContainerID)
+	}
+	defer unlock()
+
+	bc, err := docker.GetBotContainer(reg.ContainerID)
+	if errdefs.IsNotFound(err) {
+		return outbox.Permanent(fmt.Errorf("container %s of %s/%s no longer exists", reg.ContainerID, reg.CustomerName, reg.BotName))
+	}
+	if err != nil {
+		return err
+	}
+	if err := bc.Close(); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+
+	if err := s.core.UpdateID(ctx, reg.CustomerName, reg.BotName, reg.ContainerID); err != nil {
+		if !bot.IsRetryable(err) {
+			return outbox.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func extractBotSourceCode(cradlePath, tempFile string) error {
+	var errb bytes.Buffer
+	// Create a directory for the bot
+	botPath := path.Join(cradlePath, "bot")
+	if _, err := os.Stat(botPath); os.IsNotExist(err) {
+		if err := os.Mkdir(botPath, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.RemoveAll(botPath); err != nil {
+			return err
+		}
+		if err := os.Mkdir(botPath, 0755); err != nil {
+			return err
+		}
+	}
+
+	// Extract the tar.gz file
+	extractCmd := exec.Command("tar", "-xvzf", tempFile, "-C", botPath)
+	extractCmd.Stderr = &errb
+	if _, err := extractCmd.Output(); err != nil {
+		fmt.Println(errb.String())
+		return fmt.Errorf("failed to extract the tar.gz file: %s", errb.String())
+	}
+	return nil
+}
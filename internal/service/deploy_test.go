@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/customers"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/outbox"
+	"github.com/sensority-labs/builder/internal/scheduler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCore is a core that records registered container IDs and fails with err if it's set.
+type fakeCore struct {
+	configs    map[string]map[string]string
+	containers map[string]string
+	bots       []bot.DesiredBot
+	quota      *bot.Quota
+	err        error
+}
+
+func newFakeCore() *fakeCore {
+	return &fakeCore{configs: make(map[string]map[string]string), containers: make(map[string]string)}
+}
+
+func (c *fakeCore) GetConfig(ctx context.Context, userName, botName string) (*bot.Config, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &bot.Config{Envs: c.configs[userName+"/"+botName]}, nil
+}
+
+func (c *fakeCore) UpdateID(ctx context.Context, userName, botName, containerID string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.containers[userName+"/"+botName] = containerID
+	return nil
+}
+
+func (c *fakeCore) PostEvent(ctx context.Context, event any) error {
+	return c.err
+}
+
+func (c *fakeCore) ListBots(ctx context.Context) ([]bot.DesiredBot, error) {
+	return c.bots, c.err
+}
+
+func (c *fakeCore) GetQuota(ctx context.Context, userName string) (*bot.Quota, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.quota, nil
+}
+
+func newTestServer(t *testing.T, core bot.Core) *server {
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	customerStore, err := customers.Open(filepath.Join(t.TempDir(), "customers.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { customerStore.Close() })
+	return &server{core: core, locks: newBotLocks(), outbox: box, customers: customerStore, scheduler: scheduler.New(1)}
+}
+
+func TestRegisterContainer_Success(t *testing.T) {
+	core := newFakeCore()
+	s := newTestServer(t, core)
+	require.NoError(t, s.outbox.Enqueue(registrationKey("acme", "mybot"), kindCoreRegistration, coreRegistration{ContainerID: "old"}))
+
+	pending, err := s.registerContainer(context.Background(), "acme", "mybot", "container123")
+
+	require.NoError(t, err)
+	assert.False(t, pending)
+	assert.Equal(t, "container123", core.containers["acme/mybot"])
+	messages, err := s.outbox.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, messages, "an older pending registration must not overwrite the new one")
+}
+
+func TestRegisterContainer_CoreUnavailable(t *testing.T) {
+	core := newFakeCore()
+	core.err = &bot.StatusError{StatusCode: 503}
+	s := newTestServer(t, core)
+
+	pending, err := s.registerContainer(context.Background(), "acme", "mybot", "container123")
+
+	require.NoError(t, err)
+	assert.True(t, pending)
+	messages, err := s.outbox.Pending()
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	var reg coreRegistration
+	require.NoError(t, json.Unmarshal(messages[0].Payload, &reg))
+	assert.Equal(t, coreRegistration{CustomerName: "acme", BotName: "mybot", ContainerID: "container123"}, reg)
+}
+
+func TestRegisterContainer_Rejected(t *testing.T) {
+	core := newFakeCore()
+	core.err = &bot.StatusError{StatusCode: 400, Body: "unknown bot"}
+	s := newTestServer(t, core)
+
+	pending, err := s.registerContainer(context.Background(), "acme", "mybot", "container123")
+
+	assert.EqualError(t, err, "unexpected status code: 400: unknown bot")
+	assert.False(t, pending)
+	messages, err := s.outbox.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestRegisterInCore_BotBusy(t *testing.T) {
+	core := newFakeCore()
+	s := newTestServer(t, core)
+	s.outbox.Handle(kindCoreRegistration, s.registerInCore)
+	require.NoError(t, s.outbox.Enqueue(registrationKey("acme", "mybot"), kindCoreRegistration,
+		coreRegistration{CustomerName: "acme", BotName: "mybot", ContainerID: "container123"}))
+	unlock := s.locks.Lock(docker.ContainerName("acme", "mybot"))
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.outbox.Flush(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the outbox waited for the bot's lock")
+	}
+
+	assert.Empty(t, core.containers)
+	messages, err := s.outbox.Pending()
+	require.NoError(t, err)
+	require.Len(t, messages, 1, "the registration is retried later")
+	assert.Equal(t, 1, messages[0].Attempts)
+}
+
+// swapBot replaces the container of acme/mybot with one from the image tagged latest.
+func swapBot(t *testing.T, s *server) (*swap, *docker.BotContainer) {
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Step: jobs.StepEnvs}
+	require.NoError(t, s.jobs.Create(job))
+	bc, err := docker.NewBotContainer(s.cfg, "mybot", "acme")
+	require.NoError(t, err)
+	t.Cleanup(func() { bc.Close() })
+
+	res, err := s.swapContainer(context.Background(), "acme", "mybot", job, bc, newSaga("test"), func(string, ...any) {})
+	require.NoError(t, err)
+	return res, bc
+}
+
+func TestSwapContainer_KeepsStoppedBotStopped(t *testing.T) {
+	d := dockertest.New(t)
+	previous := addBot(t, d, "acme", "mybot", "exited")
+	core := newFakeCore()
+	s := newRecoveryServer(t, core)
+
+	res, bc := swapBot(t, s)
+
+	assert.True(t, res.stopped)
+	created, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, bc.ID, created.ID)
+	assert.Equal(t, "created", created.State, "a bot its user stopped isn't started by a rebuild")
+	assert.Equal(t, bc.ID, core.containers["acme/mybot"])
+	assert.Equal(t, previous, res.stash.ID)
+}
+
+func TestSwapContainer_StartsRunningBot(t *testing.T) {
+	d := dockertest.New(t)
+	addBot(t, d, "acme", "mybot", "running")
+	s := newRecoveryServer(t, newFakeCore())
+
+	res, _ := swapBot(t, s)
+
+	assert.False(t, res.stopped)
+	created, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, "running", created.State)
+}
+
+func TestSwapContainer_StartsNewBot(t *testing.T) {
+	d := dockertest.New(t)
+	d.AddImage(container.Config{Cmd: []string{"node", "index.js"}}, "acme_mybot:latest")
+	s := newRecoveryServer(t, newFakeCore())
+
+	res, _ := swapBot(t, s)
+
+	assert.False(t, res.stopped)
+	assert.Nil(t, res.stash)
+	created, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, "running", created.State)
+}
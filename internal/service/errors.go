@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/errs"
+)
+
+// Machine-readable error codes of the JSON error envelope.
+const (
+	codeNotFound    = "not_found"
+	codeConflict    = "conflict"
+	codeForbidden   = "forbidden"
+	codeQuota       = "quota_exceeded"
+	codeRateLimited = "rate_limited"
+	codeNotModified = "not_modified"
+	codeUnavailable = "unavailable"
+	codeInvalid     = "invalid_request"
+	codeInternal    = "internal_error"
+)
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	Limit     string `json:"limit,omitempty"` // The quota a quota error is about
+}
+
+// classify maps an error to its HTTP status and error code.
+func classify(err error) (int, string) {
+	switch {
+	case errs.IsValidation(err):
+		return http.StatusUnprocessableEntity, codeInvalid
+	case isRateLimited(err):
+		return http.StatusTooManyRequests, codeRateLimited
+	case isQuota(err):
+		return http.StatusForbidden, codeQuota
+	case errdefs.IsNotFound(err):
+		return http.StatusNotFound, codeNotFound
+	case errdefs.IsConflict(err):
+		return http.StatusConflict, codeConflict
+	case errdefs.IsForbidden(err):
+		return http.StatusForbidden, codeForbidden
+	case errdefs.IsNotModified(err):
+		return http.StatusNotModified, codeNotModified
+	case errdefs.IsUnavailable(err), client.IsErrConnectionFailed(err), bot.IsRetryable(err):
+		return http.StatusServiceUnavailable, codeUnavailable
+	default:
+		return http.StatusInternalServerError, codeInternal
+	}
+}
+
+// writeError logs err and writes it to the response as a JSON error envelope.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := requestIDFrom(r.Context())
+	log.Default().Println(fmt.Sprintf("Error [%s]: %+v", requestID, err))
+
+	status, code := classify(err)
+	if status == http.StatusNotModified {
+		// 304 responses can't have a body
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	response := errorResponse{Error: errorBody{
+		Code:      code,
+		Message:   err.Error(),
+		RequestID: requestID,
+	}}
+	if quotaErr, ok := errs.AsQuota(err); ok {
+		response.Error.Limit = quotaErr.Limit
+		if quotaErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+		}
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+}
+
+func isQuota(err error) bool {
+	_, ok := errs.AsQuota(err)
+	return ok
+}
+
+func isRateLimited(err error) bool {
+	quotaErr, ok := errs.AsQuota(err)
+	return ok && quotaErr.RateLimited
+}
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with the caller's X-Request-ID, or a generated one,
+// and echoes it back in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errs.Validation("bad input"), http.StatusUnprocessableEntity, codeInvalid},
+		{fmt.Errorf("wrapped: %w", errs.Validation("bad input")), http.StatusUnprocessableEntity, codeInvalid},
+		{errdefs.NotFound(errors.New("no such container")), http.StatusNotFound, codeNotFound},
+		{errdefs.Conflict(errors.New("name in use")), http.StatusConflict, codeConflict},
+		{errdefs.Forbidden(errors.New("customer is suspended")), http.StatusForbidden, codeForbidden},
+		{errs.Quota("maxBots", "too many bots"), http.StatusForbidden, codeQuota},
+		{&errs.QuotaError{Limit: "buildsPerHour", RateLimited: true}, http.StatusTooManyRequests, codeRateLimited},
+		{errdefs.NotModified(errors.New("already stopped")), http.StatusNotModified, codeNotModified},
+		{errdefs.Unavailable(errors.New("daemon down")), http.StatusServiceUnavailable, codeUnavailable},
+		{&bot.StatusError{StatusCode: http.StatusBadGateway}, http.StatusServiceUnavailable, codeUnavailable},
+		{errors.New("boom"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, tt := range tests {
+		status, code := classify(tt.err)
+		assert.Equal(t, tt.status, status, tt.err.Error())
+		assert.Equal(t, tt.code, code, tt.err.Error())
+	}
+}
+
+func TestWriteError_Envelope(t *testing.T) {
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errdefs.NotFound(errors.New("no such container: abc")))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/abc/status", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "req-1", rec.Header().Get("X-Request-ID"))
+	var response errorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, errorBody{Code: codeNotFound, Message: "no such container: abc", RequestID: "req-1"}, response.Error)
+}
+
+func TestWriteError_Quota(t *testing.T) {
+	quotaErr := errs.Quota("buildsPerHour", "customer may start at most 10 builds per hour")
+	quotaErr.RateLimited = true
+	quotaErr.RetryAfter = 90*time.Second + time.Millisecond
+	rec := httptest.NewRecorder()
+
+	writeError(rec, httptest.NewRequest(http.MethodPost, "/build/acme/mybot", nil), fmt.Errorf("wrapped: %w", quotaErr))
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "91", rec.Header().Get("Retry-After"))
+	var response errorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, codeRateLimited, response.Error.Code)
+	assert.Equal(t, "buildsPerHour", response.Error.Limit)
+}
+
+func TestWriteError_NotModifiedHasNoBody(t *testing.T) {
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errdefs.NotModified(errors.New("already stopped")))
+	}))
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/abc/stop", nil))
+
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+}
+
+func TestWithRequestID_Generated(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/abc/status", nil))
+
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, rec.Header().Get("X-Request-ID"))
+}
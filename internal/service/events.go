@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/sensority-labs/builder/internal/lifecycle"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// newLifecyclePublisher returns the publishers of bot lifecycle events enabled in the config.
+func (s *server) newLifecyclePublisher() (lifecycle.Multi, error) {
+	var publishers lifecycle.Multi
+	if subject := s.cfg.Stream.LifecycleSubject; subject != "" {
+		publisher, err := lifecycle.NewNATS(s.cfg.Stream.NatsURL, subject)
+		if err != nil {
+			return nil, err
+		}
+		log.Default().Printf("Publishing bot lifecycle events to NATS subject %s.*", subject)
+		publishers = append(publishers, publisher)
+	}
+	if webhook := s.cfg.Core.LifecycleWebhook; webhook != "" {
+		log.Default().Printf("Posting bot lifecycle events to core at %s", webhook)
+		publishers = append(publishers, lifecycle.NewWebhook(s.outbox, s.core))
+	}
+	return publishers, nil
+}
+
+// publishLifecycle publishes the lifecycle event behind a Docker event of a bot container.
+func (s *server) publishLifecycle(action string, timeNano int64, previous, current state.Bot) {
+	event, ok := lifecycle.FromDocker(action, timeNano, previous, current)
+	if !ok || len(s.events) == 0 {
+		return
+	}
+	log.Default().Printf("Bot %s %s", current.Name, event.Type)
+	if err := s.events.Publish(context.Background(), event); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: publishing lifecycle event %s of %s: %+v", event.Type, current.Name, err))
+	}
+}
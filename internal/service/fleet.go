@@ -0,0 +1,414 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/sensority-labs/builder/internal/fleet"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/scheduler"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// Kinds of fleet operations.
+const (
+	fleetRebuild = "rebuild"
+	fleetRefresh = "refresh"
+)
+
+// healthGrace is how long a bot without a Docker health check has to keep running to count as healthy.
+const healthGrace = 10 * time.Second
+
+// fleetSelector selects the bots of a fleet operation. Empty fields select all bots.
+type fleetSelector struct {
+	Customers []string `json:"customers,omitempty"`
+	Bots      []string `json:"bots,omitempty"` // As customer/bot
+}
+
+func (f fleetSelector) matches(customer, bot string) bool {
+	if len(f.Customers) > 0 && !slices.Contains(f.Customers, customer) {
+		return false
+	}
+	return len(f.Bots) == 0 || slices.Contains(f.Bots, customer+"/"+bot)
+}
+
+// fleetOptions are the rollout options of a request, falling back to the config.
+type fleetOptions struct {
+	Concurrency   int    `json:"concurrency,omitempty"`
+	MaxFailures   int    `json:"maxFailures,omitempty"`
+	HealthTimeout string `json:"healthTimeout,omitempty"` // e.g. 2m
+	BatchInterval string `json:"batchInterval,omitempty"` // e.g. 30s
+}
+
+func (s *server) rolloutOptions(req fleetOptions) (fleet.Options, error) {
+	opts := fleet.Options{
+		Concurrency:   s.cfg.Fleet.Concurrency,
+		MaxFailures:   s.cfg.Fleet.MaxFailures,
+		HealthTimeout: s.cfg.Fleet.HealthTimeout,
+		BatchInterval: s.cfg.Fleet.BatchInterval,
+	}
+	if req.Concurrency < 0 || req.MaxFailures < 0 {
+		return opts, errs.Validation("concurrency and maxFailures must not be negative")
+	}
+	if req.Concurrency > 0 {
+		opts.Concurrency = req.Concurrency
+	}
+	if req.MaxFailures > 0 {
+		opts.MaxFailures = req.MaxFailures
+	}
+	if req.HealthTimeout != "" {
+		timeout, err := time.ParseDuration(req.HealthTimeout)
+		if err != nil || timeout <= 0 {
+			return opts, errs.Validation("invalid healthTimeout %q", req.HealthTimeout)
+		}
+		opts.HealthTimeout = timeout
+	}
+	if req.BatchInterval != "" {
+		interval, err := time.ParseDuration(req.BatchInterval)
+		if err != nil || interval < 0 {
+			return opts, errs.Validation("invalid batchInterval %q", req.BatchInterval)
+		}
+		opts.BatchInterval = interval
+	}
+	return opts, nil
+}
+
+// fleetRebuildRequest rebuilds the selected bots from their last successful build.
+type fleetRebuildRequest struct {
+	fleetSelector
+	fleetOptions
+
+	// Template selects the bots last built with it and Ref is the cradle revision they are rebuilt against,
+	// the template's default if empty
+	Template string `json:"template,omitempty"`
+	Ref      string `json:"ref,omitempty"`
+}
+
+// fleetBots returns the bots on the host matching the selector, one per bot.
+func (s *server) fleetBots(ctx context.Context, selector fleetSelector) ([]state.Bot, error) {
+	actual, err := s.actualBots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var bots []state.Bot
+	seen := make(map[string]bool)
+	for _, b := range actual {
+		name := docker.ContainerName(b.Customer, b.Bot)
+		if b.Customer == "" || b.Bot == "" || docker.IsPrevious(b.Name) || seen[name] || !selector.matches(b.Customer, b.Bot) {
+			continue
+		}
+		seen[name] = true
+		bots = append(bots, b)
+	}
+	return bots, nil
+}
+
+// rebuildTargets returns the bots to rebuild, leaving out the ones last built with another template
+// than template, if set. Bots of customers that aren't active and bots without an archived
+// successful build are skipped.
+func (s *server) rebuildTargets(ctx context.Context, bots []state.Bot, template string) ([]fleet.Target, error) {
+	var targets []fleet.Target
+	for _, b := range bots {
+		last, err := s.history.FindBuild(b.Customer, b.Bot, func(build history.Build) bool {
+			return build.Status == jobs.StatusSucceeded
+		})
+		if err != nil {
+			return nil, err
+		}
+		if last != nil && template != "" && last.Template != template {
+			continue
+		}
+
+		customer, err := s.customers.Get(b.Customer)
+		if err != nil {
+			return nil, err
+		}
+
+		target := fleet.Target{Customer: b.Customer, Bot: b.Bot}
+		switch {
+		case !customer.Active():
+			target.Status, target.Error = fleet.TargetSkipped, "customer is "+customer.Status
+		case last == nil:
+			target.Status, target.Error = fleet.TargetSkipped, "bot has no successful build to rebuild"
+		case last.Source == "":
+			target.Status, target.Error = fleet.TargetSkipped, "source of the last build isn't archived"
+		default:
+			archived, err := s.bundles.Exists(ctx, bundleKey(last.Source))
+			if err != nil {
+				return nil, err
+			}
+			if !archived {
+				target.Status, target.Error = fleet.TargetSkipped, "source of the last build isn't archived"
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// rebuildFleet starts a rolling rebuild of the selected bots from their archived bundles.
+func (s *server) rebuildFleet() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req fleetRebuildRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, errs.Validation("invalid request body: %v", err))
+				return
+			}
+		}
+		opts, err := s.rolloutOptions(req.fleetOptions)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if req.Template != "" {
+			if _, err := s.cradles.Get(req.Template); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		bots, err := s.fleetBots(r.Context(), req.fleetSelector)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		targets, err := s.rebuildTargets(r.Context(), bots, req.Template)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		requestID, requestedBy := requestIDFrom(r.Context()), r.Header.Get("X-Requested-By")
+		step := func(ctx context.Context, target fleet.Target) (fleet.Result, error) {
+			tmpl, bundle, err := s.archivedVersion(ctx, target.Customer, target.Bot, "", req.Template)
+			if err != nil {
+				return fleet.Result{}, err
+			}
+			res, err := s.runBuild(&jobs.Job{
+				Customer:    target.Customer,
+				Bot:         target.Bot,
+				Template:    tmpl.Name,
+				Ref:         req.Ref,
+				RequestID:   requestID,
+				RequestedBy: requestedBy,
+				Priority:    scheduler.PriorityLow, // Builds requested by customers go first
+				Fleet:       true,
+			}, tmpl, bundle)
+			if res == nil {
+				return fleet.Result{}, err
+			}
+			if res.Stopped {
+				// A stopped bot has no health to check
+				return fleet.Result{JobID: res.JobID}, err
+			}
+			return fleet.Result{JobID: res.JobID, ContainerID: res.ContainerID}, err
+		}
+
+		op := s.fleet.Start(fleetRebuild, req, targets, opts, step, checkHealth)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, r, op)
+	}
+}
+
+// fleetRefreshRequest recreates the selected bots whose envs differ from the ones computed
+// from the current platform config and the bot config in core.
+type fleetRefreshRequest struct {
+	fleetSelector
+	fleetOptions
+}
+
+// refreshFleetEnvs starts a rolling env refresh of the selected bots.
+func (s *server) refreshFleetEnvs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req fleetRefreshRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, errs.Validation("invalid request body: %v", err))
+				return
+			}
+		}
+		opts, err := s.rolloutOptions(req.fleetOptions)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		bots, err := s.fleetBots(r.Context(), req.fleetSelector)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		targets := make([]fleet.Target, 0, len(bots))
+		for _, b := range bots {
+			targets = append(targets, fleet.Target{Customer: b.Customer, Bot: b.Bot})
+		}
+
+		op := s.fleet.Start(fleetRefresh, req, targets, opts, s.refreshEnvs, checkHealth)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, r, op)
+	}
+}
+
+// refreshEnvs recreates the bot's container if its envs are outdated. Only the envs change, the new
+// container runs the same image with the same limits. It replaces the container like a deploy, so a
+// failed refresh restores the previous container. A stopped bot is left stopped, so it has no health
+// to check. Paused bots are skipped, they were paused on purpose.
+func (s *server) refreshEnvs(ctx context.Context, target fleet.Target) (fleet.Result, error) {
+	name := docker.ContainerName(target.Customer, target.Bot)
+	unlock := s.locks.Lock(name)
+	defer unlock()
+
+	// The bots of a suspended or purged customer stay as the suspension left them
+	if err := s.checkActive(target.Customer); err != nil {
+		if errdefs.IsForbidden(err) {
+			return fleet.Result{}, fleet.Skip(err.Error())
+		}
+		return fleet.Result{}, err
+	}
+	current, err := docker.InspectBot(ctx, name)
+	if err != nil {
+		return fleet.Result{}, err
+	}
+	if current.State == "paused" {
+		return fleet.Result{}, fleet.Skip("container is paused")
+	}
+	bc, err := docker.GetBotContainer(current.ContainerID)
+	if err != nil {
+		return fleet.Result{}, err
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	plan, err := bc.Plan(ctx, s.cfg, s.core)
+	if err != nil {
+		return fleet.Result{}, err
+	}
+	if plan.Envs.Empty() {
+		return fleet.Result{}, fleet.Skip("envs are up to date")
+	}
+
+	log.Default().Printf("Refreshing envs of container %s", bc.Name)
+	bc.ApplyEnvs(plan)
+	bc.PinImage()
+	tx := newSaga("env refresh of " + bc.Name)
+	swap, err := s.swapContainer(ctx, target.Customer, target.Bot, nil, bc, tx, log.Default().Printf)
+	if err != nil {
+		if rollbackErr := tx.rollback(); rollbackErr != nil {
+			err = fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return fleet.Result{}, err
+	}
+	commitDeploy(bc, swap.stash, false)
+	s.recordDeployment(history.DeployRefresh, target.Customer, target.Bot, bc)
+
+	if swap.registrationPending {
+		log.Default().Printf("Registration of %s/%s is pending in the outbox", target.Customer, target.Bot)
+	}
+	if swap.stopped {
+		return fleet.Result{}, nil
+	}
+	return fleet.Result{ContainerID: bc.ID}, nil
+}
+
+// checkHealth waits until the container is healthy: its Docker health check passes or, without
+// a health check, it keeps running for healthGrace, at most timeout. It fails once the container stops or turns
+// unhealthy, or when timeout passes.
+func checkHealth(ctx context.Context, containerID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	started, grace := time.Now(), min(healthGrace, timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		b, err := docker.InspectBot(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		healthy, err := evaluateHealth(b, time.Since(started), grace)
+		if err != nil || healthy {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("container %s isn't healthy after %s (state %s, health %q)", b.Name, timeout, b.State, b.Health)
+		case <-ticker.C:
+		}
+	}
+}
+
+// evaluateHealth reports whether a container that was rolled out for the given time is healthy,
+// or an error if it can't become healthy anymore. Containers without a health check are healthy
+// once they kept running for grace.
+func evaluateHealth(b state.Bot, rolledOutFor, grace time.Duration) (bool, error) {
+	switch {
+	case b.State != "running":
+		return false, fmt.Errorf("container %s is %s (exit code %d)", b.Name, b.State, b.ExitCode)
+	case b.Health == "unhealthy":
+		return false, fmt.Errorf("container %s is unhealthy", b.Name)
+	case b.Health == "healthy":
+		return true, nil
+	case b.Health == "":
+		return rolledOutFor >= grace, nil
+	default:
+		// Health check still starting
+		return false, nil
+	}
+}
+
+// fleetOperations lists the fleet operations, newest first.
+func (s *server) fleetOperations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, s.fleet.List())
+	}
+}
+
+// fleetOperation returns the progress of a fleet operation.
+func (s *server) fleetOperation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := s.fleet.Get(r.PathValue("operationId"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, op)
+	}
+}
+
+// resumeFleetOperation continues a fleet operation that paused after failures.
+func (s *server) resumeFleetOperation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := s.fleet.Resume(r.PathValue("operationId"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, op)
+	}
+}
+
+// cancelFleetOperation stops a fleet operation. Bots already being rolled out are finished.
+func (s *server) cancelFleetOperation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := s.fleet.Cancel(r.PathValue("operationId"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, op)
+	}
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/sensority-labs/builder/internal/fleet"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		bot     state.Bot
+		after   time.Duration
+		healthy bool
+		err     bool
+	}{
+		{name: "exited", bot: state.Bot{State: "exited", ExitCode: 1}, err: true},
+		{name: "unhealthy", bot: state.Bot{State: "running", Health: "unhealthy"}, err: true},
+		{name: "healthy", bot: state.Bot{State: "running", Health: "healthy"}, healthy: true},
+		{name: "starting", bot: state.Bot{State: "running", Health: "starting"}, after: time.Minute},
+		{name: "no health check, settling", bot: state.Bot{State: "running"}, after: time.Second},
+		{name: "no health check, settled", bot: state.Bot{State: "running"}, after: healthGrace, healthy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy, err := evaluateHealth(tt.bot, tt.after, healthGrace)
+			assert.Equal(t, tt.err, err != nil)
+			assert.Equal(t, tt.healthy, healthy)
+		})
+	}
+}
+
+func TestFleetBots(t *testing.T) {
+	s := newJobServer(t)
+	s.bots = state.NewStore()
+	s.bots.Replace([]state.Bot{
+		{ContainerID: "1", Name: "acme_a", Customer: "acme", Bot: "a"},
+		{ContainerID: "2", Name: "acme_a-previous", Customer: "acme", Bot: "a"},
+		{ContainerID: "3", Name: "acme_b", Customer: "acme", Bot: "b"},
+		{ContainerID: "4", Name: "globex_a", Customer: "globex", Bot: "a"},
+		{ContainerID: "5", Name: "unlabeled"},
+	})
+
+	bots, err := s.fleetBots(context.Background(), fleetSelector{})
+	require.NoError(t, err)
+	assert.Len(t, bots, 3)
+
+	bots, err = s.fleetBots(context.Background(), fleetSelector{Customers: []string{"acme"}})
+	require.NoError(t, err)
+	assert.Len(t, bots, 2)
+
+	bots, err = s.fleetBots(context.Background(), fleetSelector{Bots: []string{"globex/a"}})
+	require.NoError(t, err)
+	require.Len(t, bots, 1)
+	assert.Equal(t, "4", bots[0].ContainerID)
+}
+
+func TestRebuildTargets(t *testing.T) {
+	s, _ := newRebuildServer(t)
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "a", Template: "ts", Source: testSource, Status: "succeeded"}))
+	require.NoError(t, s.archiveBundle(context.Background(), testSource, []byte("bundle")))
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "b", Template: "py", Source: testSource, Status: "succeeded"}))
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "c", Template: "ts", Status: "failed"}))
+	bots := []state.Bot{{Customer: "acme", Bot: "a"}, {Customer: "acme", Bot: "b"}, {Customer: "acme", Bot: "c"}}
+
+	targets, err := s.rebuildTargets(context.Background(), bots, "ts")
+	require.NoError(t, err)
+	require.Len(t, targets, 2, "bots built with another template are left out")
+	assert.Equal(t, "a", targets[0].Bot)
+	assert.Empty(t, targets[0].Status)
+	assert.Equal(t, "c", targets[1].Bot)
+	assert.Equal(t, fleet.TargetSkipped, targets[1].Status)
+}
+
+func TestFleetOperations(t *testing.T) {
+	s := newJobServer(t)
+	s.cfg.Fleet = config.FleetConfig{Concurrency: 2, MaxFailures: 1, HealthTimeout: time.Minute}
+	s.fleet = fleet.NewManager()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /fleet/operations", s.fleetOperations())
+	mux.HandleFunc("GET /fleet/operations/{operationId}", s.fleetOperation())
+	mux.HandleFunc("POST /fleet/operations/{operationId}/resume", s.resumeFleetOperation())
+
+	op := s.fleet.Start(fleetRebuild, nil, nil, fleet.Options{}, nil, nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fleet/operations", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), op.ID)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fleet/operations/"+op.ID, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fleet/operations/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fleet/operations/"+op.ID+"/resume", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code, "only paused operations can be resumed")
+}
+
+func TestRolloutOptions(t *testing.T) {
+	s := newJobServer(t)
+	s.cfg.Fleet = config.FleetConfig{Concurrency: 2, MaxFailures: 1, HealthTimeout: time.Minute}
+
+	opts, err := s.rolloutOptions(fleetOptions{Concurrency: 5, HealthTimeout: "30s", BatchInterval: "1m"})
+	require.NoError(t, err)
+	assert.Equal(t, fleet.Options{Concurrency: 5, MaxFailures: 1, HealthTimeout: 30 * time.Second, BatchInterval: time.Minute}, opts)
+
+	_, err = s.rolloutOptions(fleetOptions{HealthTimeout: "soon"})
+	assert.Error(t, err)
+	_, err = s.rolloutOptions(fleetOptions{BatchInterval: "-1s"})
+	assert.Error(t, err)
+
+	s.fleet = fleet.NewManager()
+	rec := httptest.NewRecorder()
+	s.rebuildFleet()(rec, httptest.NewRequest(http.MethodPost, "/fleet/rebuild", strings.NewReader(`{"concurrency": -1}`)))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.refreshFleetEnvs()(rec, httptest.NewRequest(http.MethodPost, "/fleet/refresh-envs", strings.NewReader(`{"batchInterval": "often"}`)))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestRebuildFleet_Accepted(t *testing.T) {
+	dockertest.New(t)
+	s, _ := newRebuildServer(t)
+	s.cfg.Fleet = config.FleetConfig{Concurrency: 2, MaxFailures: 1, HealthTimeout: time.Minute}
+	s.fleet = fleet.NewManager()
+	s.bots = state.NewStore()
+
+	rec := httptest.NewRecorder()
+	s.rebuildFleet()(rec, httptest.NewRequest(http.MethodPost, "/fleet/rebuild", nil))
+
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"), "the header is set before the status is written")
+	assert.Contains(t, rec.Body.String(), `"id"`)
+}
+
+func TestRefreshFleetEnvs_Accepted(t *testing.T) {
+	dockertest.New(t)
+	s := newJobServer(t)
+	s.cfg.Fleet = config.FleetConfig{Concurrency: 2, MaxFailures: 1, HealthTimeout: time.Minute}
+	s.fleet = fleet.NewManager()
+	s.bots = state.NewStore()
+
+	rec := httptest.NewRecorder()
+	s.refreshFleetEnvs()(rec, httptest.NewRequest(http.MethodPost, "/fleet/refresh-envs", nil))
+
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "application/json", rec.Result().Header.Get("Content-Type"), "the header is set before the status is written")
+	assert.Contains(t, rec.Body.String(), `"id"`)
+}
+
+// newRefreshServer returns a server refreshing the envs of acme/mybot, whose container runs with envs in state.
+func newRefreshServer(t *testing.T, d *dockertest.Daemon, core *fakeCore, state string, envs map[string]string) (*server, string) {
+	s := newRecoveryServer(t, core)
+	s.cfg.NetworkName = "sensority-labs"
+	d.AddNetwork("sensority-labs", nil)
+	d.AddImage(container.Config{Cmd: []string{"node", "index.js"}}, "acme_mybot:latest")
+	botEnvs, err := docker.BotEnvs(s.cfg, "acme", "mybot", envs)
+	require.NoError(t, err)
+	id, err := d.AddContainer("acme_mybot", container.Config{
+		Image: "acme_mybot:latest",
+		Env:   botEnvs,
+		Labels: map[string]string{
+			docker.LabelManaged:  "true",
+			docker.LabelCustomer: "acme",
+			docker.LabelBot:      "mybot",
+		},
+	}, container.HostConfig{NetworkMode: "sensority-labs", Resources: container.Resources{Memory: 256 << 20}}, state)
+	require.NoError(t, err)
+	return s, id
+}
+
+func TestRefreshEnvs_UpToDate(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://rpc"}
+	s, id := newRefreshServer(t, d, core, "running", core.configs["acme/mybot"])
+
+	_, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	assert.ErrorIs(t, err, fleet.ErrSkipped)
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, id, current.ID)
+}
+
+func TestRefreshEnvs_Running(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://new"}
+	s, oldID := newRefreshServer(t, d, core, "running", map[string]string{"RPC_URL": "http://old"})
+	oldImage := d.ImageID("acme_mybot:latest")
+	// A build the bot hasn't been deployed with yet
+	d.AddImage(container.Config{Cmd: []string{"node", "index.js"}}, "acme_mybot:latest")
+
+	res, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	require.NoError(t, err)
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.NotEqual(t, oldID, current.ID)
+	assert.Equal(t, current.ID, res.ContainerID)
+	assert.Equal(t, "running", current.State)
+	assert.Equal(t, oldImage, current.ImageID, "the refresh keeps the image the bot runs")
+	assert.Equal(t, "acme_mybot:latest", current.Config.Labels[docker.LabelImage])
+	assert.Contains(t, current.Config.Env, "RPC_URL=http://new")
+	assert.Equal(t, int64(256<<20), current.HostConfig.Memory, "the refresh only changes the envs")
+	assert.Len(t, d.Containers(), 1, "the previous container is removed")
+	assert.Equal(t, current.ID, core.containers["acme/mybot"])
+}
+
+func TestRefreshEnvs_Restarting(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://new"}
+	s, _ := newRefreshServer(t, d, core, "restarting", map[string]string{"RPC_URL": "http://old"})
+
+	_, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	require.NoError(t, err)
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, "running", current.State)
+	assert.Contains(t, current.Config.Env, "RPC_URL=http://new")
+	assert.Len(t, d.Containers(), 1)
+}
+
+func TestRefreshEnvs_Stopped(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://new"}
+	s, _ := newRefreshServer(t, d, core, "exited", map[string]string{"RPC_URL": "http://old"})
+
+	res, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	require.NoError(t, err)
+	assert.Empty(t, res.ContainerID, "a stopped bot has nothing to health check")
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, "created", current.State, "a stopped bot stays stopped")
+	assert.Contains(t, current.Config.Env, "RPC_URL=http://new")
+}
+
+func TestRefreshEnvs_Paused(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://new"}
+	s, id := newRefreshServer(t, d, core, "paused", map[string]string{"RPC_URL": "http://old"})
+
+	_, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	assert.ErrorIs(t, err, fleet.ErrSkipped)
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, id, current.ID)
+	assert.Equal(t, "paused", current.State)
+}
+
+func TestRefreshEnvs_CreateFails(t *testing.T) {
+	d := dockertest.New(t)
+	core := newFakeCore()
+	core.configs["acme/mybot"] = map[string]string{"RPC_URL": "http://new"}
+	s, id := newRefreshServer(t, d, core, "running", map[string]string{"RPC_URL": "http://old"})
+	d.FailNext("create", errors.New("no space left on device"))
+
+	_, err := s.refreshEnvs(context.Background(), fleet.Target{Customer: "acme", Bot: "mybot"})
+
+	require.Error(t, err)
+	current, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, id, current.ID, "the previous container is restored")
+	assert.Equal(t, "running", current.State)
+	assert.Contains(t, current.Config.Env, "RPC_URL=http://old")
+	assert.Len(t, d.Containers(), 1)
+}
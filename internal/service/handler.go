@@ -1,345 +1,509 @@
 package service
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"os/exec"
-	"path"
 
-	"github.com/sensority-labs/builder/internal/bot"
-	"github.com/sensority-labs/builder/internal/config"
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/cradle"
 	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/scheduler"
+	"github.com/sensority-labs/builder/internal/state"
 )
 
-func startBot() http.HandlerFunc {
+// Container states reported by lifecycle operations besides the ones Docker reports.
+const stateRemoved = "removed"
+
+// lifecycleResponse reports the state of a bot before and after a lifecycle operation.
+type lifecycleResponse struct {
+	ContainerID   string `json:"containerId"`
+	PreviousState string `json:"previousState"`
+	State         string `json:"state"`
+}
+
+// lockContainer takes the lock of the bot running in the container, then inspects the container
+// under it, so the operation doesn't act on a state another operation changed in the meantime.
+// The lock is keyed by the bot, which stays the same when a deploy renames the container.
+// unlock also closes the container's Docker client.
+func (s *server) lockContainer(ctx context.Context, containerId string) (*docker.BotContainer, func(), error) {
+	b, err := docker.InspectBot(ctx, containerId)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := b.Name
+	if b.Customer != "" && b.Bot != "" {
+		key = docker.ContainerName(b.Customer, b.Bot)
+	}
+	unlock := s.locks.Lock(key)
+
+	bc, err := docker.GetBotContainer(containerId)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return bc, func() {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+		unlock()
+	}, nil
+}
+
+// startBot starts the bot's container. Starting a running bot succeeds without doing anything.
+func (s *server) startBot() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
 
-		bc, err := docker.GetBotContainer(containerId)
+		bc, unlock, err := s.lockContainer(r.Context(), containerId)
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		defer func(bc *docker.BotContainer) {
-			if err := bc.Close(); err != nil {
-				log.Default().Println(fmt.Sprintf("Error: %+v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		defer unlock()
+
+		if customerName, _ := bc.Owner(); customerName != "" {
+			if err := s.checkActive(customerName); err != nil {
+				writeError(w, r, err)
 				return
 			}
-		}(bc)
+		}
 
-		if err := bc.Start(); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		previousState, err := bc.Status()
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
 
-		log.Default().Println("Container started with ID: ", containerId)
+		switch previousState {
+		case "running":
+			log.Default().Println("Container is already running with ID: ", containerId)
+		case "paused":
+			if err := bc.Unpause(); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			log.Default().Println("Container unpaused with ID: ", containerId)
+		default:
+			if err := bc.Start(); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			log.Default().Println("Container started with ID: ", containerId)
+		}
+
+		state, err := bc.Status()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, lifecycleResponse{ContainerID: containerId, PreviousState: previousState, State: state})
 	}
 }
 
-func stopBot() http.HandlerFunc {
+// stopBot stops the bot's container. Stopping a bot that isn't running succeeds without doing anything.
+func (s *server) stopBot() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
 
-		bc, err := docker.GetBotContainer(containerId)
+		bc, unlock, err := s.lockContainer(r.Context(), containerId)
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		defer func(bc *docker.BotContainer) {
-			if err := bc.Close(); err != nil {
-				log.Default().Println(fmt.Sprintf("Error: %+v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		defer unlock()
+
+		previousState, err := bc.Status()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		switch previousState {
+		case "created", "exited", "dead":
+			log.Default().Println("Container is not running with ID: ", containerId)
+		default:
+			if err := bc.Stop(); err != nil {
+				writeError(w, r, err)
 				return
 			}
-		}(bc)
+			log.Default().Println("Container stopped with ID: ", containerId)
+		}
 
-		if err := bc.Stop(); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		state, err := bc.Status()
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-
-		log.Default().Println("Container stopped with ID: ", containerId)
+		writeJSON(w, r, lifecycleResponse{ContainerID: containerId, PreviousState: previousState, State: state})
 	}
 }
 
-func removeBot() http.HandlerFunc {
+// removeBot removes the bot's container. Removing a bot that is already gone succeeds.
+func (s *server) removeBot() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
 
-		bc, err := docker.GetBotContainer(containerId)
+		bc, unlock, err := s.lockContainer(r.Context(), containerId)
+		if errdefs.IsNotFound(err) {
+			log.Default().Println("Container is already removed with ID: ", containerId)
+			writeJSON(w, r, lifecycleResponse{ContainerID: containerId, PreviousState: stateRemoved, State: stateRemoved})
+			return
+		}
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		defer func(bc *docker.BotContainer) {
-			if err := bc.Close(); err != nil {
-				log.Default().Println(fmt.Sprintf("Error: %+v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}(bc)
+		defer unlock()
 
-		if err := bc.Remove(); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		previousState, err := bc.Status()
+		if errdefs.IsNotFound(err) {
+			previousState = stateRemoved
+		} else if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := bc.Remove(); err != nil && !errdefs.IsNotFound(err) {
+			writeError(w, r, err)
 			return
 		}
 
 		log.Default().Println("Container removed with ID: ", containerId)
+		writeJSON(w, r, lifecycleResponse{ContainerID: containerId, PreviousState: previousState, State: stateRemoved})
 	}
 }
 
-func recreateBot(cfg *config.Config) http.HandlerFunc {
+// recreateBot recreates the bot's container with the current config from core.
+// The container is left untouched if nothing changed, unless force=true is passed.
+func (s *server) recreateBot() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
+		force := r.URL.Query().Get("force") == "true"
 
-		bc, err := docker.GetBotContainer(containerId)
+		bc, unlock, err := s.lockContainer(r.Context(), containerId)
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer func(bc *docker.BotContainer) {
-			if err := bc.Close(); err != nil {
-				log.Default().Println(fmt.Sprintf("Error: %+v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}(bc)
-
-		log.Default().Printf("Updating envs for container %s", containerId)
-		if err := bc.UpdateEnvs(cfg); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		defer unlock()
 
-		if err := bc.Recreate(); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Default().Printf("Planning changes for container %s", containerId)
+		plan, err := bc.Plan(r.Context(), s.cfg, s.core)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
 
-		log.Default().Printf("Container recreated\n Old ID: %s\n New ID: %s", containerId, bc.ID)
-
 		response := struct {
-			ContainerID string `json:"containerId"`
+			ContainerID string       `json:"containerId"`
+			Recreated   bool         `json:"recreated"`
+			Plan        *docker.Plan `json:"plan"`
 		}{
 			ContainerID: bc.ID,
+			Plan:        plan,
 		}
 
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !plan.Changed && !force {
+			log.Default().Printf("Nothing changed for container %s, skipping recreate", containerId)
+			writeJSON(w, r, response)
+			return
+		}
+
+		if customerName, _ := bc.Owner(); customerName != "" {
+			if err := s.checkActive(customerName); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		bc.Apply(plan)
+		if err := bc.Recreate(); err != nil {
+			writeError(w, r, err)
 			return
 		}
 
+		log.Default().Printf("Container recreated\n Old ID: %s\n New ID: %s", containerId, bc.ID)
+		customerName, botName := bc.Owner()
+		s.recordDeployment(history.DeployRecreate, customerName, botName, bc)
+
+		response.ContainerID = bc.ID
+		response.Recreated = true
+		writeJSON(w, r, response)
 	}
 }
 
-func botStatus() http.HandlerFunc {
+// planBot shows what recreating the bot's container would change, without touching it.
+func (s *server) planBot() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		containerId := r.PathValue("containerId")
 
 		bc, err := docker.GetBotContainer(containerId)
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		defer func(bc *docker.BotContainer) {
 			if err := bc.Close(); err != nil {
 				log.Default().Println(fmt.Sprintf("Error: %+v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
 			}
 		}(bc)
 
-		status, err := bc.Status()
+		plan, err := bc.Plan(r.Context(), s.cfg, s.core)
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		writeJSON(w, r, plan)
+	}
+}
+
+// botStatus reports the bot's state from the state store kept by the Docker events watcher.
+// Containers the store doesn't know, or any container while the store is resyncing, are inspected directly.
+func (s *server) botStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		containerId := r.PathValue("containerId")
+
+		bot, ok := s.bots.Lookup(containerId)
+		if !ok || !s.bots.Synced() {
+			var err error
+			if bot, err = docker.InspectBot(r.Context(), containerId); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
 
 		statusResponse := struct {
 			Status string `json:"status"`
+			state.Bot
 		}{
-			Status: status,
-		}
-
-		if err := json.NewEncoder(w).Encode(statusResponse); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			Status: bot.State,
+			Bot:    bot,
 		}
+		writeJSON(w, r, statusResponse)
 	}
 }
 
-func makeBot(cfg *config.Config) http.HandlerFunc {
+// listBots lists the bots' containers from the state store, optionally filtered by customer and state.
+// Containers stashed by running deploys are left out.
+func (s *server) listBots() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tmpDir := os.TempDir()
-		cradlePath := path.Join(tmpDir, "cradle-ts")
+		customer := r.URL.Query().Get("customer")
+		containerState := r.URL.Query().Get("state")
+
+		bots := s.bots.List()
+		if !s.bots.Synced() {
+			var err error
+			if bots, err = docker.ListBots(r.Context()); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
 
-		if err := getCradle(cradlePath, cfg.GithubToken); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		filtered := make([]state.Bot, 0, len(bots))
+		for _, bot := range bots {
+			if docker.IsPrevious(bot.Name) {
+				continue
+			}
+			if customer != "" && bot.Customer != customer {
+				continue
+			}
+			if containerState != "" && bot.State != containerState {
+				continue
+			}
+			filtered = append(filtered, bot)
 		}
+		writeJSON(w, r, filtered)
+	}
+}
+
+// buildResult is the outcome of a deploy, shared by all callers of coalesced builds.
+type buildResult struct {
+	JobID        string
+	ContainerID  string
+	CradleCommit string
+	CacheHit     bool
+
+	// RegistrationPending is set when core couldn't be told about the new container yet.
+	// The registration is retried from the outbox.
+	RegistrationPending bool
 
+	// Stopped is set when the bot was stopped before the build, its new container isn't started.
+	Stopped bool
+}
+
+func (s *server) makeBot() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		botName := r.PathValue("botName")
 		customerName := r.PathValue("customerName")
 
 		// Parse our multipart form, 10 << 20 specifies a maximum upload of 10 MB files.
 		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, errs.Validation("invalid multipart form: %v", err))
 			return
 		}
 
+		// Select the cradle template and revision, falling back to the registry defaults
+		tmpl, err := s.cradles.Get(r.FormValue("template"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		ref := r.FormValue("ref")
+
 		file, handler, err := r.FormFile("file")
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, errs.Validation("missing bot code file: %v", err))
 			return
 		}
 		defer func(file multipart.File) {
-			err := file.Close()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			if err := file.Close(); err != nil {
+				log.Default().Println(fmt.Sprintf("Error: %+v", err))
 			}
 		}(file)
 
 		log.Default().Println("Received new bot code:")
 		log.Default().Println("Received file: ", handler.Filename)
 		log.Default().Println("File size: ", handler.Size)
-		log.Default().Println("Extracting...")
 
-		// Create a temporary file within our temp-images directory that follows a particular pattern.
-		tempFile, err := os.CreateTemp(cradlePath, "*.tar.gz")
+		bundle, err := io.ReadAll(file)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		defer func(tempFile *os.File) {
-			err := tempFile.Close()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}(tempFile)
 
-		fileBytes, err := io.ReadAll(file)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if _, err := tempFile.Write(fileBytes); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Extract the tar.gz file to the cradle directory
-		if err := extractBotSourceCode(cradlePath, tempFile.Name()); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		s.build(w, r, customerName, botName, tmpl, ref, bundle)
+	}
+}
 
-		log.Default().Println("Bot code extracted. Building docker image...")
+// build deploys the bundle as the bot and writes the build result.
+func (s *server) build(w http.ResponseWriter, r *http.Request, customerName, botName string, tmpl cradle.Template, ref string, bundle []byte) {
+	// Core sets the priority class of builds that jump the queue, e.g. hotfix redeploys
+	priority := r.FormValue("priority")
+	if priority != "" && !scheduler.ValidPriority(priority) {
+		writeError(w, r, errs.Validation("unknown priority %q", priority))
+		return
+	}
+	if priority != "" && !s.fromCore(r) {
+		writeError(w, r, errdefs.Forbidden(errors.New("only core may set the priority of a build")))
+		return
+	}
 
-		bc, err := docker.NewBotContainer(cfg, botName, customerName)
+	// Retries with the same Idempotency-Key get the result of the completed build
+	key := buildKey(customerName, botName, tmpl, ref, bundle)
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		result, ok, err := s.idempotency.Get(idempotencyKey, key)
 		if err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer func(bc *docker.BotContainer) {
-			if err := bc.Close(); err != nil {
-				log.Default().Println(fmt.Sprintf("Error: %+v", err))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}(bc)
-
-		log.Default().Println("Building the bot image...")
-		if err := bc.Build(cradlePath); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-
-		log.Default().Println("Bot image built. Updating bot envs...")
-		if err := bc.UpdateEnvs(cfg); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if ok {
+			log.Default().Printf("Replaying build of %s/%s for Idempotency-Key %s", customerName, botName, idempotencyKey)
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeBuildResult(w, r, result)
 			return
 		}
+	}
 
-		log.Default().Println("Envs updated. Creating the container...")
-		if err := bc.Create(); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	result, err := s.runBuild(&jobs.Job{
+		Customer:    customerName,
+		Bot:         botName,
+		Template:    tmpl.Name,
+		Ref:         ref,
+		RequestID:   requestIDFrom(r.Context()),
+		RequestedBy: r.Header.Get("X-Requested-By"),
+		Priority:    priority,
+	}, tmpl, bundle)
+	if err != nil {
+		if result != nil {
+			w.Header().Set("X-Job-ID", result.JobID)
+		}
+		writeError(w, r, err)
+		return
+	}
+	if idempotencyKey != "" {
+		s.idempotency.Put(idempotencyKey, key, result)
+	}
+	writeBuildResult(w, r, result)
+}
 
-		log.Default().Printf("Container created with ID: %s\nStarting...", bc.ID)
-		if err := bc.Start(); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// fromCore reports whether the request carries core's API token in the X-Token header, as core's
+// requests to the builder do.
+func (s *server) fromCore(r *http.Request) bool {
+	token := r.Header.Get("X-Token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.ApiAccessToken)) == 1
+}
 
-		log.Default().Println("Container started")
+// buildKey identifies the inputs of a build.
+func buildKey(customerName, botName string, tmpl cradle.Template, ref string, bundle []byte) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%x", customerName, botName, tmpl.Name, ref, sha256.Sum256(bundle))
+}
 
-		// Update the bot ID in the core
-		if err := bot.UpdateID(cfg, customerName, botName, bc.ID); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// runBuild deploys the bundle for the job. Identical builds that arrive while one is running share its result.
+// The result carries the job ID if there is one, also when the build failed.
+func (s *server) runBuild(job *jobs.Job, tmpl cradle.Template, bundle []byte) (*buildResult, error) {
+	job.Bundle = fmt.Sprintf("%x", sha256.Sum256(bundle))
+	res, err, shared := s.builds.Do(buildKey(job.Customer, job.Bot, tmpl, job.Ref, bundle), func() (any, error) {
+		// The build is shared by concurrent requests, so it isn't canceled with any one of them
+		ctx := context.Background()
+		limits := s.limits(ctx, job.Customer)
+		release, err := s.admitBuild(ctx, quota.Build{Customer: job.Customer, Bot: job.Bot, Fleet: job.Fleet}, limits)
+		if err != nil {
+			return nil, err
 		}
-
-		// Return the container ID
-		if _, err := fmt.Fprintf(w, bc.ID); err != nil {
-			log.Default().Println(fmt.Sprintf("Error: %+v", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		defer release()
+		if job.Priority == "" {
+			job.Priority = limits.Priority
 		}
+		return s.deploy(ctx, job, limits, tmpl, bundle)
+	})
+	if shared {
+		log.Default().Printf("Build of %s/%s was shared with a concurrent identical request", job.Customer, job.Bot)
 	}
+	result, _ := res.(*buildResult)
+	return result, err
 }
 
-func extractBotSourceCode(cradlePath, tempFile string) error {
-	var errb bytes.Buffer
-	// Create a directory for the bot
-	botPath := cradlePath + "/bot"
-	if _, err := os.Stat(botPath); os.IsNotExist(err) {
-		if err := os.Mkdir(botPath, 0755); err != nil {
-			return err
-		}
+// writeBuildResult returns the container ID along with the cradle commit it was built from.
+func writeBuildResult(w http.ResponseWriter, r *http.Request, result *buildResult) {
+	w.Header().Set("X-Job-ID", result.JobID)
+	w.Header().Set("X-Cradle-Commit", result.CradleCommit)
+	if result.CacheHit {
+		w.Header().Set("X-Build-Cache", "hit")
 	} else {
-		if err := os.RemoveAll(botPath); err != nil {
-			return err
-		}
-		if err := os.Mkdir(botPath, 0755); err != nil {
-			return err
-		}
+		w.Header().Set("X-Build-Cache", "miss")
 	}
+	if result.RegistrationPending {
+		w.Header().Set("X-Core-Registration", "pending")
+	} else {
+		w.Header().Set("X-Core-Registration", "done")
+	}
+	if result.Stopped {
+		w.Header().Set("X-Container-State", "stopped")
+	} else {
+		w.Header().Set("X-Container-State", "running")
+	}
+	if _, err := fmt.Fprint(w, result.ContainerID); err != nil {
+		writeError(w, r, err)
+	}
+}
 
-	// Extract the tar.gz file
-	extractCmd := exec.Command("tar", "-xvzf", tempFile, "-C", botPath)
-	extractCmd.Stderr = &errb
-	if _, err := extractCmd.Output(); err != nil {
-		fmt.Println(errb.String())
-		return fmt.Errorf("failed to extract the tar.gz file: %s", errb.String())
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		writeError(w, r, err)
 	}
-	return nil
 }
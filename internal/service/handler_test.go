@@ -0,0 +1,124 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addBot adds the customer's bot to the daemon, with its image and a container in the given state.
+// It returns the container ID.
+func addBot(t *testing.T, d *dockertest.Daemon, customerName, botName, state string) string {
+	name := docker.ContainerName(customerName, botName)
+	if d.ImageID(name+":latest") == "" {
+		d.AddImage(container.Config{Cmd: []string{"node", "index.js"}}, name+":latest")
+	}
+	id, err := d.AddContainer(name, container.Config{
+		Image: name + ":latest",
+		Env:   []string{docker.EnvCustomerName + "=" + customerName, docker.EnvBotName + "=" + botName},
+		Labels: map[string]string{
+			docker.LabelManaged:  "true",
+			docker.LabelCustomer: customerName,
+			docker.LabelBot:      botName,
+		},
+	}, container.HostConfig{}, state)
+	require.NoError(t, err)
+	return id
+}
+
+func lifecycleMux(s *server) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{containerId}/start", s.startBot())
+	mux.HandleFunc("/{containerId}/stop", s.stopBot())
+	mux.HandleFunc("/{containerId}/remove", s.removeBot())
+	return mux
+}
+
+func callLifecycle(t *testing.T, mux *http.ServeMux, path string) (int, lifecycleResponse) {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	var response lifecycleResponse
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	}
+	return rec.Code, response
+}
+
+func TestStartBot_AlreadyRunning(t *testing.T) {
+	d := dockertest.New(t)
+	s := newTestServer(t, newFakeCore())
+	id := addBot(t, d, "acme", "mybot", "running")
+
+	status, response := callLifecycle(t, lifecycleMux(s), "/"+id+"/start")
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, lifecycleResponse{ContainerID: id, PreviousState: "running", State: "running"}, response)
+	assert.Empty(t, d.Calls(), "a running bot isn't started again")
+}
+
+func TestStartBot_Stopped(t *testing.T) {
+	d := dockertest.New(t)
+	s := newTestServer(t, newFakeCore())
+	id := addBot(t, d, "acme", "mybot", "exited")
+
+	status, response := callLifecycle(t, lifecycleMux(s), "/"+id+"/start")
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, lifecycleResponse{ContainerID: id, PreviousState: "exited", State: "running"}, response)
+	assert.Equal(t, []string{"start acme_mybot"}, d.Calls())
+}
+
+func TestStopBot_AlreadyStopped(t *testing.T) {
+	d := dockertest.New(t)
+	s := newTestServer(t, newFakeCore())
+	mux := lifecycleMux(s)
+
+	for _, state := range []string{"created", "exited"} {
+		d.ResetCalls()
+		id := addBot(t, d, "acme", "bot-"+state, state)
+
+		status, response := callLifecycle(t, mux, "/"+id+"/stop")
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, lifecycleResponse{ContainerID: id, PreviousState: state, State: state}, response)
+		assert.Empty(t, d.Calls(), "a %s bot isn't stopped again", state)
+	}
+}
+
+func TestStopBot_Running(t *testing.T) {
+	d := dockertest.New(t)
+	s := newTestServer(t, newFakeCore())
+	id := addBot(t, d, "acme", "mybot", "running")
+
+	status, response := callLifecycle(t, lifecycleMux(s), "/"+id+"/stop")
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, lifecycleResponse{ContainerID: id, PreviousState: "running", State: "exited"}, response)
+	assert.Equal(t, []string{"stop acme_mybot"}, d.Calls())
+}
+
+func TestRemoveBot_AlreadyRemoved(t *testing.T) {
+	dockertest.New(t)
+	s := newTestServer(t, newFakeCore())
+
+	status, response := callLifecycle(t, lifecycleMux(s), "/4f2a9c01/remove")
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, lifecycleResponse{ContainerID: "4f2a9c01", PreviousState: stateRemoved, State: stateRemoved}, response)
+}
+
+func TestStartBot_Unknown(t *testing.T) {
+	dockertest.New(t)
+	s := newTestServer(t, newFakeCore())
+
+	status, _ := callLifecycle(t, lifecycleMux(s), "/4f2a9c01/start")
+
+	assert.Equal(t, http.StatusNotFound, status)
+}
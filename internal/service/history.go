@@ -0,0 +1,108 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+)
+
+// defaultHistoryLimit is how many builds and deployments the history endpoint returns by default.
+const defaultHistoryLimit = 50
+
+// recordJob adds a finished job to the bot's history: the build, and the deployment if it succeeded.
+func (s *server) recordJob(job *jobs.Job) {
+	var finishedAt time.Time
+	if job.FinishedAt != nil {
+		finishedAt = *job.FinishedAt
+	}
+	// Time spent in the queue isn't build time. A job that failed while queued never started.
+	startedAt := job.CreatedAt
+	if job.StartedAt != nil {
+		startedAt = *job.StartedAt
+	}
+	build := history.Build{
+		JobID:        job.ID,
+		Customer:     job.Customer,
+		Bot:          job.Bot,
+		Template:     job.Template,
+		Ref:          job.Ref,
+		Source:       job.Bundle,
+		CradleCommit: job.CradleCommit,
+		ImageID:      job.ImageID,
+		CacheHit:     job.CacheHit,
+		Logs:         "/jobs/" + job.ID + "/log",
+		RequestID:    job.RequestID,
+		RequestedBy:  job.RequestedBy,
+		Status:       job.Status,
+		Error:        job.Error,
+		StartedAt:    startedAt,
+		FinishedAt:   finishedAt,
+		Duration:     finishedAt.Sub(startedAt).Seconds(),
+	}
+	if err := s.history.RecordBuild(build); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: recording build %s: %+v", job.ID, err))
+	}
+	if job.Status != jobs.StatusSucceeded {
+		return
+	}
+
+	deployment := history.Deployment{
+		Kind:     history.DeployBuild,
+		Customer: job.Customer,
+		Bot:      job.Bot,
+		Time:     finishedAt,
+		Version:  history.Version{JobID: job.ID, ContainerID: job.ContainerID, ImageID: job.ImageID, EnvsHash: job.EnvsHash},
+	}
+	// The first recorded deployment of a bot can still tell which container it replaced
+	if job.StashID != "" {
+		deployment.Previous = &history.Version{ContainerID: job.StashID}
+	}
+	if err := s.history.RecordDeployment(deployment); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: recording deployment of job %s: %+v", job.ID, err))
+	}
+}
+
+// recordDeployment adds a deployment of the bot's container other than by a build to its history.
+func (s *server) recordDeployment(kind, customer, bot string, bc *docker.BotContainer) {
+	imageID, err := bc.ContainerImageID()
+	if err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+	if err := s.history.RecordDeployment(history.Deployment{
+		Kind:     kind,
+		Customer: customer,
+		Bot:      bot,
+		Time:     time.Now().UTC(),
+		Version:  history.Version{ContainerID: bc.ID, ImageID: imageID, EnvsHash: history.HashEnvs(bc.Envs)},
+	}); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: recording %s of %s: %+v", kind, bc.Name, err))
+	}
+}
+
+// botHistory returns the latest builds and deployments of a bot, newest first. ?limit= caps both lists.
+func (s *server) botHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultHistoryLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				writeError(w, r, errs.Validation("limit must be a positive integer, got %q", value))
+				return
+			}
+		}
+
+		h, err := s.history.History(r.PathValue("customer"), r.PathValue("bot"), limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, h)
+	}
+}
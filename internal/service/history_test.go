@@ -0,0 +1,78 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBotHistory(t *testing.T) {
+	s := newJobServer(t)
+	failed := &jobs.Job{Customer: "acme", Bot: "mybot", Bundle: "b1", RequestedBy: "alice", Step: jobs.StepBuild}
+	require.NoError(t, s.jobs.Create(failed))
+	s.finishJob(failed, nil, errors.New("build image: exit status 1"))
+	succeeded := &jobs.Job{Customer: "acme", Bot: "mybot", Bundle: "b2", Step: jobs.StepRegister, ImageID: "sha256:a", EnvsHash: "e1", StashID: "c0"}
+	require.NoError(t, s.jobs.Create(succeeded))
+	s.finishJob(succeeded, &buildResult{ContainerID: "c1", CradleCommit: "3f9c2e1"}, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bots/{customer}/{bot}/history", s.botHistory())
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bots/acme/mybot/history", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response history.History
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	require.Len(t, response.Builds, 2)
+	assert.Equal(t, succeeded.ID, response.Builds[0].JobID)
+	assert.Equal(t, "succeeded", response.Builds[0].Status)
+	assert.Equal(t, "3f9c2e1", response.Builds[0].CradleCommit)
+	assert.Equal(t, "b2", response.Builds[0].Source)
+	assert.Equal(t, "failed", response.Builds[1].Status)
+	assert.Equal(t, "alice", response.Builds[1].RequestedBy)
+	require.Len(t, response.Deployments, 1, "failed builds aren't deployments")
+	assert.Equal(t, history.Version{JobID: succeeded.ID, ContainerID: "c1", ImageID: "sha256:a", EnvsHash: "e1"}, response.Deployments[0].Version)
+	assert.Equal(t, "c0", response.Deployments[0].Previous.ContainerID)
+}
+
+func TestRecordJob_QueueTime(t *testing.T) {
+	s := newJobServer(t)
+	queued := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusQueued}
+	require.NoError(t, s.jobs.Create(queued))
+	startedAt := queued.CreatedAt.Add(time.Minute)
+	finishedAt := startedAt.Add(10 * time.Second)
+	queued.Status, queued.StartedAt, queued.FinishedAt = jobs.StatusSucceeded, &startedAt, &finishedAt
+	s.recordJob(queued)
+
+	// Failed before it left the queue
+	canceled := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusQueued}
+	require.NoError(t, s.jobs.Create(canceled))
+	canceledAt := canceled.CreatedAt.Add(5 * time.Second)
+	canceled.Status, canceled.FinishedAt = jobs.StatusFailed, &canceledAt
+	s.recordJob(canceled)
+
+	h, err := s.history.History("acme", "mybot", 10)
+	require.NoError(t, err)
+	require.Len(t, h.Builds, 2)
+	assert.True(t, startedAt.Equal(h.Builds[1].StartedAt), "the build started when it left the queue")
+	assert.Equal(t, 10.0, h.Builds[1].Duration)
+	assert.True(t, canceled.CreatedAt.Equal(h.Builds[0].StartedAt))
+	assert.Equal(t, 5.0, h.Builds[0].Duration)
+}
+
+func TestBotHistory_InvalidLimit(t *testing.T) {
+	s := newJobServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bots/{customer}/{bot}/history", s.botHistory())
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bots/acme/mybot/history?limit=0", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/errs"
+)
+
+// idempotencyCache remembers the results of completed builds by their Idempotency-Key,
+// so a retried request gets the original result instead of triggering another deploy.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	result      *buildResult
+	expiresAt   time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]idempotencyEntry)}
+}
+
+// Get returns the result stored for key. Reusing a key for a different request is a validation error.
+func (c *idempotencyCache) Get(key, fingerprint string) (*buildResult, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false, nil
+	}
+	if entry.fingerprint != fingerprint {
+		return nil, false, errs.Validation("Idempotency-Key %q was already used for a different request", key)
+	}
+	return entry.result, true, nil
+}
+
+func (c *idempotencyCache) Put(key, fingerprint string, result *buildResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = idempotencyEntry{fingerprint: fingerprint, result: result, expiresAt: now.Add(c.ttl)}
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyCache_Replay(t *testing.T) {
+	cache := newIdempotencyCache(time.Hour)
+	cache.Put("key-1", "acme/mybot/abc", &buildResult{ContainerID: "container123"})
+
+	result, ok, err := cache.Get("key-1", "acme/mybot/abc")
+
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "container123", result.ContainerID)
+}
+
+func TestIdempotencyCache_Miss(t *testing.T) {
+	cache := newIdempotencyCache(time.Hour)
+
+	_, ok, err := cache.Get("key-1", "acme/mybot/abc")
+
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestIdempotencyCache_KeyReusedForDifferentRequest(t *testing.T) {
+	cache := newIdempotencyCache(time.Hour)
+	cache.Put("key-1", "acme/mybot/abc", &buildResult{ContainerID: "container123"})
+
+	_, ok, err := cache.Get("key-1", "acme/mybot/def")
+
+	assert.True(t, errs.IsValidation(err))
+	assert.False(t, ok)
+}
+
+func TestIdempotencyCache_Expired(t *testing.T) {
+	cache := newIdempotencyCache(-time.Second)
+	cache.Put("key-1", "acme/mybot/abc", &buildResult{ContainerID: "container123"})
+
+	_, ok, err := cache.Get("key-1", "acme/mybot/abc")
+
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
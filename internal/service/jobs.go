@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/customers"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/lifecycle"
+	"github.com/sensority-labs/builder/internal/scheduler"
+)
+
+// errInterrupted is the outcome of builds that a restart of the builder interrupted.
+var errInterrupted = errors.New("interrupted by a restart of the builder")
+
+func (s *server) workspacesDir() string {
+	return filepath.Join(s.cfg.DataDir, "workspaces")
+}
+
+// workspace returns the directory the job's bot is built in.
+func (s *server) workspace(jobID string) string {
+	return filepath.Join(s.workspacesDir(), jobID)
+}
+
+func (s *server) removeWorkspace(jobID string) {
+	for _, p := range []string{s.workspace(jobID), s.workspace(jobID) + ".tar.gz"} {
+		if err := os.RemoveAll(p); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}
+}
+
+// updateJob records the progress of a job, if there is one. A failure to record it doesn't stop the build.
+func (s *server) updateJob(job *jobs.Job, fn func(*jobs.Job)) {
+	if job == nil {
+		return
+	}
+	if err := s.jobs.Update(job, fn); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: updating job %s: %+v", job.ID, err))
+	}
+}
+
+// finishJob records the outcome of a job, removes its workspace and publishes the outcome.
+func (s *server) finishJob(job *jobs.Job, res *buildResult, err error) {
+	s.updateJob(job, func(j *jobs.Job) {
+		if err != nil {
+			j.Status = jobs.StatusFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = jobs.StatusSucceeded
+		j.Step = jobs.StepDone
+		if res != nil {
+			j.ContainerID = res.ContainerID
+			j.CradleCommit = res.CradleCommit
+			j.CacheHit = res.CacheHit
+			j.RegistrationPending = res.RegistrationPending
+		}
+	})
+	s.removeWorkspace(job.ID)
+	s.recordJob(job)
+	log.Default().Printf("Build job %s of %s/%s %s", job.ID, job.Customer, job.Bot, job.Status)
+
+	if len(s.events) == 0 {
+		return
+	}
+	event := lifecycle.FromJob(job)
+	if err := s.events.Publish(context.Background(), event); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: publishing %s of job %s: %+v", event.Type, job.ID, err))
+	}
+}
+
+// recoverJobs runs on startup, before any build is accepted. It rediscovers the managed containers
+// and gives every build interrupted by a restart a definitive outcome: deploys that got as far as
+// a created container are finished, the others are undone and failed.
+func (s *server) recoverJobs(ctx context.Context) error {
+	bots, err := docker.ListBots(ctx)
+	if err != nil {
+		return err
+	}
+	s.bots.Replace(bots)
+	log.Default().Printf("Found %d managed containers", len(bots))
+
+	unfinished, err := s.jobs.Unfinished()
+	if err != nil {
+		return err
+	}
+	for _, job := range unfinished {
+		log.Default().Printf("Recovering build job %s of %s/%s interrupted at step %s", job.ID, job.Customer, job.Bot, job.Step)
+		res, err := s.recoverJob(ctx, job)
+		if err != nil {
+			s.appendLog(job.ID, "Build failed after a restart of the builder: %v", err)
+		} else {
+			s.appendLog(job.ID, "Build resumed after a restart of the builder, container %s", res.ContainerID)
+		}
+		s.finishJob(job, res, err)
+	}
+
+	// Anything left in the workspaces belongs to builds that no longer run
+	return os.RemoveAll(s.workspacesDir())
+}
+
+func (s *server) recoverJob(ctx context.Context, job *jobs.Job) (*buildResult, error) {
+	if job.Status == jobs.StatusQueued {
+		// The build never left the queue, there is nothing to undo
+		return nil, errInterrupted
+	}
+
+	bc, err := docker.NewBotContainer(s.cfg, job.Bot, job.Customer)
+	if err != nil {
+		return nil, err
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	stash, err := recordedStash(bc, job)
+	if err != nil {
+		return nil, err
+	}
+
+	// The container ID is recorded once the container is created
+	if job.Reached(jobs.StepCreate) && job.ContainerID != "" {
+		res, err := s.resumeDeploy(ctx, bc, job)
+		if err == nil {
+			commitDeploy(bc, stash, job.KeptImage)
+			return res, nil
+		}
+		log.Default().Println(fmt.Sprintf("Error: resuming build job %s: %+v", job.ID, err))
+	}
+
+	if stash != nil && stash.WasRunning {
+		if err := s.checkActive(job.Customer); errdefs.IsForbidden(err) {
+			s.keepSuspended(job, stash)
+		}
+	}
+	if err := undoDeploy(bc, job, stash); err != nil {
+		return nil, fmt.Errorf("%w (rollback failed: %v)", errInterrupted, err)
+	}
+	return nil, errInterrupted
+}
+
+// resumeDeploy starts the job's new container and registers it in core. The container of a bot
+// that was stopped before the deploy isn't started.
+func (s *server) resumeDeploy(ctx context.Context, bc *docker.BotContainer, job *jobs.Job) (*buildResult, error) {
+	// The customer may have been suspended or purged while the deploy waited for the bot
+	if err := s.checkActive(job.Customer); err != nil {
+		return nil, err
+	}
+	bc.ID = job.ContainerID
+	stopped := job.StashID != "" && !job.StashWasRunning
+	if !stopped {
+		if err := bc.Start(); err != nil {
+			return nil, err
+		}
+	}
+	pending, err := s.registerContainer(ctx, job.Customer, job.Bot, job.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	return &buildResult{
+		ContainerID:         job.ContainerID,
+		CradleCommit:        job.CradleCommit,
+		CacheHit:            job.CacheHit,
+		RegistrationPending: pending,
+		Stopped:             stopped,
+	}, nil
+}
+
+// keepSuspended leaves the restored container of a customer that isn't active stopped. The bot
+// is remembered as running, so resuming the customer starts it.
+func (s *server) keepSuspended(job *jobs.Job, stash *docker.Stash) {
+	stash.WasRunning = false
+	if _, err := s.customers.Update(job.Customer, func(c *customers.Customer) {
+		if c.Status == customers.StatusSuspended && !slices.Contains(c.Running, job.Bot) {
+			c.Running = append(c.Running, job.Bot)
+		}
+	}); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+}
+
+// undoDeploy restores the bot as it was before the job's deploy started.
+func undoDeploy(bc *docker.BotContainer, job *jobs.Job, stash *docker.Stash) error {
+	var errList []error
+	if job.Reached(jobs.StepCreate) {
+		// The container may have been created before its ID was recorded. The bot's name
+		// is free of the previous container at this point, it was stashed.
+		bc.ID = job.ContainerID
+		if bc.ID == "" {
+			bc.ID = bc.Name
+		}
+		if err := bc.Remove(); err != nil && !errdefs.IsNotFound(err) {
+			errList = append(errList, err)
+		}
+	}
+	if stash != nil {
+		if err := bc.RestoreContainer(stash); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if job.Reached(jobs.StepBuild) {
+		if err := bc.RestoreImage(job.KeptImage); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// recordedStash returns the container the job's deploy stashed. A stash the deploy didn't get
+// to record is looked up by name.
+func recordedStash(bc *docker.BotContainer, job *jobs.Job) (*docker.Stash, error) {
+	if job.StashID != "" {
+		return &docker.Stash{ID: job.StashID, Name: bc.Name, WasRunning: job.StashWasRunning}, nil
+	}
+	if !job.Reached(jobs.StepStash) {
+		return nil, nil
+	}
+	return bc.FindStash()
+}
+
+// appendLog adds a line to the log of a job that is no longer built.
+func (s *server) appendLog(jobID, format string, args ...any) {
+	buildLog, err := s.logs.Create(jobID)
+	if err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		return
+	}
+	buildLog.Printf(format, args...)
+	if err := buildLog.Close(); err != nil {
+		log.Default().Println(fmt.Sprintf("Error: %+v", err))
+	}
+}
+
+// jobLog returns the log of a build job as plain text. Range requests are supported.
+func (s *server) jobLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := s.logs.Open(r.PathValue("jobId"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer func(f *os.File) {
+			if err := f.Close(); err != nil {
+				log.Default().Println(fmt.Sprintf("Error: %+v", err))
+			}
+		}(f)
+
+		info, err := f.Stat()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	}
+}
+
+// jobStatus returns a build job, including the outcome of builds interrupted by a restart.
+func (s *server) jobStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := s.jobs.Get(r.PathValue("jobId"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		status := jobStatus{Job: job}
+		if job.Status == jobs.StatusQueued {
+			status.QueuePosition, _ = s.scheduler.Position(job.ID)
+		}
+		writeJSON(w, r, status)
+	}
+}
+
+// jobStatus is a job with its position in the build queue while it is queued.
+type jobStatus struct {
+	*jobs.Job
+	QueuePosition int `json:"queuePosition,omitempty"`
+}
+
+type queueReport struct {
+	Workers int               `json:"workers"`
+	Running int               `json:"running"`
+	Queued  []scheduler.Entry `json:"queued"`
+}
+
+// buildQueue returns the queued builds in the order they will run. The customer query parameter
+// selects the builds of one customer, their positions stay the ones in the whole queue.
+func (s *server) buildQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerName := r.URL.Query().Get("customer")
+		report := queueReport{Queued: []scheduler.Entry{}}
+		report.Workers, report.Running = s.scheduler.Stats()
+		for _, entry := range s.scheduler.Queue() {
+			if customerName == "" || entry.Customer == customerName {
+				report.Queued = append(report.Queued, entry)
+			}
+		}
+		writeJSON(w, r, report)
+	}
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/buildlog"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/customers"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/outbox"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/scheduler"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newJobServer(t *testing.T) *server {
+	store, err := jobs.Open(filepath.Join(t.TempDir(), "builder.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	historyStore, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { historyStore.Close() })
+	logs, err := buildlog.New(t.TempDir(), 1<<20, 0)
+	require.NoError(t, err)
+	customerStore, err := customers.Open(filepath.Join(t.TempDir(), "customers.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { customerStore.Close() })
+	return &server{cfg: &config.Config{DataDir: t.TempDir()}, jobs: store, history: historyStore, logs: logs, customers: customerStore, scheduler: scheduler.New(1), locks: newBotLocks()}
+}
+
+func TestFinishJob(t *testing.T) {
+	s := newJobServer(t)
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Step: jobs.StepCheckout}
+	require.NoError(t, s.jobs.Create(job))
+	require.NoError(t, os.MkdirAll(s.workspace(job.ID), 0755))
+	require.NoError(t, os.WriteFile(s.workspace(job.ID)+".tar.gz", []byte("bundle"), 0644))
+
+	s.finishJob(job, &buildResult{ContainerID: "4f2a9c01", RegistrationPending: true}, nil)
+
+	stored, err := s.jobs.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StatusSucceeded, stored.Status)
+	assert.Equal(t, "4f2a9c01", stored.ContainerID)
+	assert.True(t, stored.RegistrationPending)
+	assert.NoDirExists(t, s.workspace(job.ID))
+	assert.NoFileExists(t, s.workspace(job.ID)+".tar.gz")
+}
+
+func TestJobStatus(t *testing.T) {
+	s := newJobServer(t)
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Step: jobs.StepStash}
+	require.NoError(t, s.jobs.Create(job))
+	s.finishJob(job, nil, errInterrupted)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{jobId}/status", s.jobStatus())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response jobs.Job
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, jobs.StatusFailed, response.Status)
+	assert.Equal(t, errInterrupted.Error(), response.Error)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/unknown/status", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestFinishJob_Failed(t *testing.T) {
+	s := newJobServer(t)
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Step: jobs.StepBuild}
+	require.NoError(t, s.jobs.Create(job))
+
+	s.finishJob(job, nil, errors.New("build image: exit status 1"))
+
+	assert.Equal(t, jobs.StatusFailed, job.Status)
+	assert.Equal(t, jobs.StepBuild, job.Step, "the step a job failed at is kept")
+	assert.Equal(t, "build image: exit status 1", job.Error)
+}
+
+func TestJobLog(t *testing.T) {
+	s := newJobServer(t)
+	s.appendLog("c81e", "Build failed: %v", errInterrupted)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{jobId}/log", s.jobLog())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/c81e/log", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "Build failed: interrupted by a restart of the builder")
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/unknown/log", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestDeploy_QueuedJob(t *testing.T) {
+	s := newJobServer(t)
+	s.locks = newBotLocks()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{jobId}/status", s.jobStatus())
+	mux.HandleFunc("GET /queue", s.buildQueue())
+
+	release, err := s.scheduler.Wait(context.Background(), scheduler.Entry{JobID: "running", Customer: "globex"})
+	require.NoError(t, err)
+	type outcome struct {
+		res *buildResult
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := s.deploy(context.Background(), &jobs.Job{Customer: "acme", Bot: "mybot", Priority: scheduler.PriorityHigh}, quota.Limits{}, cradle.Template{}, []byte("bundle"))
+		done <- outcome{res, err}
+	}()
+	require.Eventually(t, func() bool { return len(s.scheduler.Queue()) == 1 }, time.Second, time.Millisecond)
+	jobID := s.scheduler.Queue()[0].JobID
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobID+"/status", nil))
+	var status jobStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.Equal(t, jobs.StatusQueued, status.Status)
+	assert.Equal(t, scheduler.PriorityHigh, status.Priority)
+	assert.Equal(t, 1, status.QueuePosition)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/queue?customer=globex", nil))
+	var report queueReport
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, queueReport{Workers: 1, Running: 1, Queued: []scheduler.Entry{}}, report)
+
+	// Suspended while queued, the build doesn't start
+	suspend(t, s, "acme")
+	release()
+	res := <-done
+	assert.True(t, errdefs.IsForbidden(res.err), "%v", res.err)
+	require.NotNil(t, res.res)
+	job, err := s.jobs.Get(res.res.JobID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StatusFailed, job.Status)
+	assert.Nil(t, job.StartedAt)
+}
+
+// interruptedDeploy sets up the daemon as a deploy of acme/mybot leaves it: the previous image is kept,
+// the new one is tagged latest and the previous container, which was running, is stashed.
+func interruptedDeploy(t *testing.T, d *dockertest.Daemon) (oldImage, newImage, stashID string) {
+	oldImage = d.AddImage(container.Config{Cmd: []string{"node", "old.js"}}, "acme_mybot:previous")
+	stashID, err := d.AddContainer("acme_mybot-previous", container.Config{
+		Image:  "acme_mybot:previous",
+		Env:    []string{docker.EnvCustomerName + "=acme", docker.EnvBotName + "=mybot"},
+		Labels: map[string]string{docker.LabelManaged: "true", docker.LabelCustomer: "acme", docker.LabelBot: "mybot"},
+	}, container.HostConfig{}, "exited")
+	require.NoError(t, err)
+	newImage = d.AddImage(container.Config{Cmd: []string{"node", "new.js"}}, "acme_mybot:latest")
+	return oldImage, newImage, stashID
+}
+
+func newRecoveryServer(t *testing.T, core *fakeCore) *server {
+	s := newJobServer(t)
+	box, err := outbox.New(t.TempDir(), time.Minute)
+	require.NoError(t, err)
+	s.core, s.outbox = core, box
+	return s
+}
+
+// assertRolledBack asserts the bot runs its previous container and image again.
+func assertRolledBack(t *testing.T, d *dockertest.Daemon, oldImage, stashID string) {
+	restored, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, stashID, restored.ID)
+	assert.Equal(t, "running", restored.State)
+	assert.Equal(t, oldImage, d.ImageID("acme_mybot:latest"))
+	assert.Empty(t, d.ImageID("acme_mybot:previous"))
+}
+
+func TestRecoverJob_Queued(t *testing.T) {
+	d := dockertest.New(t)
+	s := newRecoveryServer(t, newFakeCore())
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusQueued, Step: jobs.StepCheckout}
+
+	_, err := s.recoverJob(context.Background(), job)
+
+	assert.ErrorIs(t, err, errInterrupted)
+	assert.Empty(t, d.Calls())
+}
+
+func TestRecoverJob_Build(t *testing.T) {
+	d := dockertest.New(t)
+	oldImage := d.AddImage(container.Config{}, "acme_mybot:previous")
+	d.AddImage(container.Config{}, "acme_mybot:latest")
+	s := newRecoveryServer(t, newFakeCore())
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepBuild, KeptImage: true}
+
+	_, err := s.recoverJob(context.Background(), job)
+
+	assert.ErrorIs(t, err, errInterrupted)
+	assert.Equal(t, oldImage, d.ImageID("acme_mybot:latest"), "the tag points back to the previous image")
+	assert.Empty(t, d.ImageID("acme_mybot:previous"))
+}
+
+func TestRecoverJob_Stash(t *testing.T) {
+	d := dockertest.New(t)
+	oldImage, _, stashID := interruptedDeploy(t, d)
+	s := newRecoveryServer(t, newFakeCore())
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepStash, KeptImage: true,
+		StashID: stashID, StashWasRunning: true}
+
+	_, err := s.recoverJob(context.Background(), job)
+
+	assert.ErrorIs(t, err, errInterrupted)
+	assertRolledBack(t, d, oldImage, stashID)
+}
+
+func TestRecoverJob_CreateNotRecorded(t *testing.T) {
+	d := dockertest.New(t)
+	oldImage, _, stashID := interruptedDeploy(t, d)
+	// Created, but the builder stopped before it recorded the container ID
+	addBot(t, d, "acme", "mybot", "created")
+	s := newRecoveryServer(t, newFakeCore())
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepCreate, KeptImage: true,
+		StashID: stashID, StashWasRunning: true}
+
+	_, err := s.recoverJob(context.Background(), job)
+
+	assert.ErrorIs(t, err, errInterrupted)
+	assertRolledBack(t, d, oldImage, stashID)
+	assert.Len(t, d.Containers(), 1, "the new container is removed")
+}
+
+func TestRecoverJob_Created(t *testing.T) {
+	d := dockertest.New(t)
+	_, newImage, stashID := interruptedDeploy(t, d)
+	id := addBot(t, d, "acme", "mybot", "created")
+	core := newFakeCore()
+	s := newRecoveryServer(t, core)
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepCreate, KeptImage: true,
+		StashID: stashID, StashWasRunning: true, ContainerID: id}
+
+	res, err := s.recoverJob(context.Background(), job)
+
+	require.NoError(t, err)
+	assert.Equal(t, id, res.ContainerID)
+	resumed, ok := d.Container("acme_mybot")
+	require.True(t, ok)
+	assert.Equal(t, id, resumed.ID)
+	assert.Equal(t, "running", resumed.State)
+	assert.Equal(t, id, core.containers["acme/mybot"])
+	assert.Len(t, d.Containers(), 1, "the stash is dropped")
+	assert.Equal(t, newImage, d.ImageID("acme_mybot:latest"))
+	assert.Empty(t, d.ImageID("acme_mybot:previous"))
+}
+
+func TestRecoverJob_StartFails(t *testing.T) {
+	d := dockertest.New(t)
+	oldImage, _, stashID := interruptedDeploy(t, d)
+	id := addBot(t, d, "acme", "mybot", "created")
+	d.FailNext("start", errors.New("port is already allocated"))
+	s := newRecoveryServer(t, newFakeCore())
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepStart, KeptImage: true,
+		StashID: stashID, StashWasRunning: true, ContainerID: id}
+
+	_, err := s.recoverJob(context.Background(), job)
+
+	assert.ErrorIs(t, err, errInterrupted)
+	assertRolledBack(t, d, oldImage, stashID)
+	_, ok := d.Container(id)
+	assert.False(t, ok, "the new container is removed")
+}
+
+func TestRecoverJob_RegisterPending(t *testing.T) {
+	d := dockertest.New(t)
+	_, _, stashID := interruptedDeploy(t, d)
+	id := addBot(t, d, "acme", "mybot", "running")
+	core := newFakeCore()
+	core.err = &bot.StatusError{StatusCode: http.StatusServiceUnavailable}
+	s := newRecoveryServer(t, core)
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepRegister, KeptImage: true,
+		StashID: stashID, StashWasRunning: true, ContainerID: id}
+
+	res, err := s.recoverJob(context.Background(), job)
+
+	require.NoError(t, err)
+	assert.True(t, res.RegistrationPending, "the registration is retried from the outbox")
+	assert.Len(t, d.Containers(), 1)
+}
+
+func TestRecoverJobs_FinishesEveryJob(t *testing.T) {
+	d := dockertest.New(t)
+	interruptedDeploy(t, d)
+	s := newRecoveryServer(t, newFakeCore())
+	s.bots = state.NewStore()
+	queued := &jobs.Job{Customer: "acme", Bot: "otherbot", Status: jobs.StatusQueued, Step: jobs.StepCheckout}
+	require.NoError(t, s.jobs.Create(queued))
+	running := &jobs.Job{Customer: "acme", Bot: "mybot", Step: jobs.StepBuild}
+	require.NoError(t, s.jobs.Create(running))
+	require.NoError(t, os.MkdirAll(s.workspace(running.ID), 0755))
+
+	require.NoError(t, s.recoverJobs(context.Background()))
+
+	unfinished, err := s.jobs.Unfinished()
+	require.NoError(t, err)
+	assert.Empty(t, unfinished)
+	stored, err := s.jobs.Get(running.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StatusFailed, stored.Status)
+	assert.Equal(t, errInterrupted.Error(), stored.Error)
+	assert.NoDirExists(t, s.workspacesDir())
+	assert.Len(t, s.bots.List(), 1, "the containers are rediscovered")
+}
+
+func TestRecoverJob_CreatedStopped(t *testing.T) {
+	d := dockertest.New(t)
+	_, _, stashID := interruptedDeploy(t, d)
+	id := addBot(t, d, "acme", "mybot", "created")
+	s := newRecoveryServer(t, newFakeCore())
+	job := &jobs.Job{Customer: "acme", Bot: "mybot", Status: jobs.StatusRunning, Step: jobs.StepCreate, KeptImage: true,
+		StashID: stashID, StashWasRunning: false, ContainerID: id}
+
+	res, err := s.recoverJob(context.Background(), job)
+
+	require.NoError(t, err)
+	assert.True(t, res.Stopped)
+	resumed, ok := d.Container(id)
+	require.True(t, ok)
+	assert.Equal(t, "created", resumed.State, "the bot was stopped before the deploy")
+}
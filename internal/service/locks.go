@@ -0,0 +1,65 @@
+package service
+
+import "sync"
+
+// botLocks serializes operations on the same bot. Locks are keyed by the bot's
+// container name and are dropped once nobody holds or waits for them.
+type botLocks struct {
+	mu    sync.Mutex
+	locks map[string]*botLock
+}
+
+type botLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newBotLocks() *botLocks {
+	return &botLocks{locks: make(map[string]*botLock)}
+}
+
+// Lock blocks until the bot's lock is acquired and returns the function releasing it.
+func (l *botLocks) Lock(key string) func() {
+	lock := l.acquire(key)
+	lock.mu.Lock()
+	return l.unlock(key, lock)
+}
+
+// TryLock acquires the bot's lock only if nobody holds it. ok reports whether it was acquired.
+func (l *botLocks) TryLock(key string) (unlock func(), ok bool) {
+	lock := l.acquire(key)
+	if !lock.mu.TryLock() {
+		l.release(key, lock)
+		return nil, false
+	}
+	return l.unlock(key, lock), true
+}
+
+// acquire returns the bot's lock, counting the caller as waiting for it.
+func (l *botLocks) acquire(key string) *botLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &botLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *botLocks) unlock(key string, lock *botLock) func() {
+	return func() {
+		lock.mu.Unlock()
+		l.release(key, lock)
+	}
+}
+
+func (l *botLocks) release(key string, lock *botLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, key)
+	}
+}
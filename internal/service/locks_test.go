@@ -0,0 +1,70 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotLocks_SerializesSameBot(t *testing.T) {
+	locks := newBotLocks()
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.Lock("acme_mybot")
+			defer unlock()
+
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, maxRunning)
+	assert.Empty(t, locks.locks)
+}
+
+func TestBotLocks_DifferentBotsDontBlock(t *testing.T) {
+	locks := newBotLocks()
+	unlock := locks.Lock("acme_mybot")
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		locks.Lock("acme_otherbot")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of another bot was blocked")
+	}
+}
+
+func TestBotLocks_TryLock(t *testing.T) {
+	locks := newBotLocks()
+	unlock := locks.Lock("acme_mybot")
+
+	_, ok := locks.TryLock("acme_mybot")
+	assert.False(t, ok, "a held lock isn't acquired")
+	unlock()
+
+	unlock, ok = locks.TryLock("acme_mybot")
+	assert.True(t, ok)
+	unlock()
+	assert.Empty(t, locks.locks)
+}
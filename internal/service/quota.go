@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// limits returns the customer's quotas: the defaults from the config with the overrides from core.
+// If core can't be reached, the defaults apply.
+func (s *server) limits(ctx context.Context, customerName string) quota.Limits {
+	limits := quota.Defaults(s.cfg.Quota)
+	q, err := s.core.GetQuota(ctx, customerName)
+	if err != nil {
+		log.Default().Println(fmt.Sprintf("Error: quota of %s, using the defaults: %+v", customerName, err))
+		return limits
+	}
+	return limits.Override(q)
+}
+
+// admitBuild checks the build against the customer's limits and counts it as running until release
+// is called. The customer's usage is checked by the tracker, so concurrent builds are checked one
+// after the other.
+func (s *server) admitBuild(ctx context.Context, build quota.Build, limits quota.Limits) (release func(), err error) {
+	var usage quota.UsageFunc
+	if limits.MaxBots > 0 || limits.MaxMemory > 0 || limits.MaxCPUs > 0 {
+		usage = func(building []string) (quota.Usage, error) {
+			bots, err := s.customerBots(ctx, build.Customer, false)
+			if err != nil {
+				return quota.Usage{}, err
+			}
+			return buildUsage(bots, building, build.Bot, s.cfg.Bot.Memory, int64(s.cfg.Bot.CPUs*1e9)), nil
+		}
+	}
+	return s.quotas.Admit(build, limits, usage)
+}
+
+// buildUsage returns what the customer's bots would take up once botName is built with the given
+// resource limits. Bots being built count as well, with the same limits as the bot if they have no
+// container yet.
+func buildUsage(bots []state.Bot, building []string, botName string, memory, nanoCPUs int64) quota.Usage {
+	var usage quota.Usage
+	usage.Add(memory, nanoCPUs)
+	seen := map[string]bool{botName: true}
+	for _, b := range bots {
+		if seen[b.Bot] {
+			continue
+		}
+		seen[b.Bot] = true
+		usage.Add(b.Memory, b.NanoCPUs)
+	}
+	for _, name := range building {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		usage.Add(memory, nanoCPUs)
+	}
+	return usage
+}
+
+// validateQuota rejects default memory and CPU quotas without the matching limit of bot containers,
+// every bot would exceed them.
+func validateQuota(cfg *config.Config) error {
+	if cfg.Quota.MaxMemory > 0 && cfg.Bot.Memory == 0 {
+		return errors.New("QUOTA_MAX_MEMORY needs BOT_MEMORY, bots without a memory limit exceed any memory quota")
+	}
+	if cfg.Quota.MaxCPUs > 0 && cfg.Bot.CPUs == 0 {
+		return errors.New("QUOTA_MAX_CPUS needs BOT_CPUS, bots without a CPU limit exceed any CPU quota")
+	}
+	return nil
+}
+
+type quotaReport struct {
+	Customer       string       `json:"customer"`
+	Limits         quota.Limits `json:"limits"`
+	Usage          quota.Usage  `json:"usage"`
+	Building       []string     `json:"building"`
+	BuildsLastHour int          `json:"buildsLastHour"`
+}
+
+// customerQuota returns the customer's quotas and what the customer's bots take up.
+func (s *server) customerQuota() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerName := r.PathValue("customer")
+		bots, err := s.customerBots(r.Context(), customerName, false)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		report := quotaReport{
+			Customer:       customerName,
+			Limits:         s.limits(r.Context(), customerName),
+			Building:       s.quotas.Building(customerName),
+			BuildsLastHour: s.quotas.BuildsLastHour(customerName),
+		}
+		for _, b := range bots {
+			report.Usage.Add(b.Memory, b.NanoCPUs)
+		}
+		if report.Building == nil {
+			report.Building = []string{}
+		}
+		writeJSON(w, r, report)
+	}
+}
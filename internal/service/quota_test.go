@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/scheduler"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildUsage(t *testing.T) {
+	bots := []state.Bot{
+		{Customer: "acme", Bot: "a", Memory: 100, NanoCPUs: 1e9},
+		{Customer: "acme", Bot: "b", Memory: 200},
+	}
+
+	usage := buildUsage(bots, []string{"c"}, "d", 50, 5e8)
+	assert.Equal(t, quota.Usage{Bots: 4, Memory: 400, NanoCPUs: 2e9, UnlimitedCPUs: 1}, usage)
+
+	usage = buildUsage(bots, []string{"a"}, "a", 50, 5e8)
+	assert.Equal(t, quota.Usage{Bots: 2, Memory: 250, NanoCPUs: 5e8, UnlimitedCPUs: 1}, usage, "a rebuilt bot counts with its new limits")
+
+	usage = buildUsage(nil, nil, "a", 0, 0)
+	assert.Equal(t, quota.Usage{Bots: 1, UnlimitedMemory: 1, UnlimitedCPUs: 1}, usage, "bots without limits are counted as such")
+}
+
+func TestLimits_CoreOverrides(t *testing.T) {
+	core := newFakeCore()
+	s := &server{cfg: &config.Config{Quota: config.QuotaConfig{MaxBots: 5, BuildsPerHour: 10}}, core: core}
+	maxBots, priority := 20, "high"
+	core.quota = &bot.Quota{MaxBots: &maxBots, Priority: &priority}
+	assert.Equal(t, quota.Limits{MaxBots: 20, BuildsPerHour: 10, Priority: "high"}, s.limits(context.Background(), "acme"))
+
+	core.err = errors.New("core is down")
+	assert.Equal(t, quota.Limits{MaxBots: 5, BuildsPerHour: 10}, s.limits(context.Background(), "acme"), "defaults apply without core")
+}
+
+func TestDeploy_ConcurrentBuildsWait(t *testing.T) {
+	s := newJobServer(t)
+	s.scheduler = scheduler.New(2)
+	limits := quota.Limits{MaxConcurrentBuilds: 1}
+	release, err := s.scheduler.Wait(context.Background(), scheduler.Entry{JobID: "running", Customer: "acme", Bot: "a", MaxRunning: 1})
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.deploy(ctx, &jobs.Job{Customer: "acme", Bot: "b"}, limits, cradle.Template{}, []byte("bundle"))
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return len(s.scheduler.Queue()) == 1 }, time.Second, time.Millisecond)
+	_, running := s.scheduler.Stats()
+	assert.Equal(t, 1, running, "a build beyond the concurrent builds waits with a worker free")
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestAdmitBuild_UnlimitedContainers(t *testing.T) {
+	s := &server{cfg: &config.Config{Bot: config.BotConfig{Memory: 1 << 30}}, quotas: quota.NewTracker(), bots: syncedStore(
+		state.Bot{ContainerID: "c1", Name: "acme_a", Customer: "acme", Bot: "a"},
+	)}
+
+	_, err := s.admitBuild(context.Background(), quota.Build{Customer: "acme", Bot: "b"}, quota.Limits{MaxMemory: 4 << 30})
+
+	quotaErr, ok := errs.AsQuota(err)
+	require.True(t, ok, "a container without a memory limit exceeds the quota: %v", err)
+	assert.Equal(t, quota.LimitMaxMemory, quotaErr.Limit)
+}
+
+func TestValidateQuota(t *testing.T) {
+	assert.NoError(t, validateQuota(&config.Config{}))
+	assert.NoError(t, validateQuota(&config.Config{Quota: config.QuotaConfig{MaxMemory: 4 << 30}, Bot: config.BotConfig{Memory: 1 << 30}}))
+	assert.Error(t, validateQuota(&config.Config{Quota: config.QuotaConfig{MaxMemory: 4 << 30}}))
+	assert.Error(t, validateQuota(&config.Config{Quota: config.QuotaConfig{MaxCPUs: 2}, Bot: config.BotConfig{Memory: 1 << 30}}))
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/errs"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+)
+
+var sourceHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// bundleKey returns the blob key of the bundle with the given SHA-256.
+func bundleKey(source string) string {
+	return "bundles/" + source + ".tar.gz"
+}
+
+// archiveBundle keeps the uploaded bundle, so the bot can be rebuilt from it later. It is locked
+// against a purge removing the same bundle.
+func (s *server) archiveBundle(ctx context.Context, source string, bundle []byte) error {
+	unlock := s.locks.Lock(bundleKey(source))
+	defer unlock()
+
+	exists, err := s.bundles.Exists(ctx, bundleKey(source))
+	if err != nil || exists {
+		return err
+	}
+	return s.bundles.Put(ctx, bundleKey(source), bundle)
+}
+
+// rebuildBot builds the bot again from an archived bundle, by default the one of its last successful build.
+// The source form value selects another version by its hash.
+func (s *server) rebuildBot() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerName := r.PathValue("customer")
+		botName := r.PathValue("bot")
+		source := r.FormValue("source")
+		if source != "" && !sourceHash.MatchString(source) {
+			writeError(w, r, errs.Validation("source must be the SHA-256 of a bundle, got %q", source))
+			return
+		}
+
+		tmpl, bundle, err := s.archivedVersion(r.Context(), customerName, botName, source, r.FormValue("template"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		log.Default().Printf("Rebuilding %s/%s from an archived bundle", customerName, botName)
+		s.build(w, r, customerName, botName, tmpl, r.FormValue("ref"), bundle)
+	}
+}
+
+// archivedVersion returns the bundle of a version of the bot and the template to rebuild it with.
+// The version is the one built from source, or the last successful build if source is empty.
+// It must have been built for this bot, so customers can't rebuild each other's bundles.
+// The template defaults to the one the version was built with.
+func (s *server) archivedVersion(ctx context.Context, customerName, botName, source, template string) (cradle.Template, []byte, error) {
+	version, err := s.history.FindBuild(customerName, botName, func(b history.Build) bool {
+		if source != "" {
+			return b.Source == source
+		}
+		return b.Status == jobs.StatusSucceeded
+	})
+	if err != nil {
+		return cradle.Template{}, nil, err
+	}
+	if version == nil {
+		if source != "" {
+			return cradle.Template{}, nil, errdefs.NotFound(fmt.Errorf("bot %s/%s was never built from source %s", customerName, botName, source))
+		}
+		return cradle.Template{}, nil, errdefs.NotFound(fmt.Errorf("bot %s/%s has no successful build to rebuild", customerName, botName))
+	}
+
+	if template == "" {
+		template = version.Template
+	}
+	tmpl, err := s.cradles.Get(template)
+	if err != nil {
+		return cradle.Template{}, nil, err
+	}
+	bundle, err := s.bundles.Get(ctx, bundleKey(version.Source))
+	if err != nil {
+		return cradle.Template{}, nil, err
+	}
+	return tmpl, bundle, nil
+}
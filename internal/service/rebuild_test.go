@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sensority-labs/builder/internal/blob"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSource = "5d41402abc4b2a76b9719d911017c5925d41402abc4b2a76b9719d911017c592"
+
+func newRebuildServer(t *testing.T) (*server, *http.ServeMux) {
+	s := newJobServer(t)
+	bundles, err := blob.NewFS(t.TempDir())
+	require.NoError(t, err)
+	s.bundles = bundles
+	s.cradles, err = cradle.NewRegistry(&config.Config{Cradle: config.CradleConfig{Default: "ts"}})
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /bots/{customer}/{bot}/rebuild", s.rebuildBot())
+	return s, mux
+}
+
+func rebuild(mux *http.ServeMux, path, form string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRebuildBot_InvalidSource(t *testing.T) {
+	_, mux := newRebuildServer(t)
+	rec := rebuild(mux, "/bots/acme/mybot/rebuild", "source=../../etc/passwd")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestRebuildBot_NoBuilds(t *testing.T) {
+	_, mux := newRebuildServer(t)
+	rec := rebuild(mux, "/bots/acme/mybot/rebuild", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRebuildBot_SourceOfAnotherBot(t *testing.T) {
+	s, mux := newRebuildServer(t)
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "globex", Bot: "mybot", Source: testSource, Status: "succeeded"}))
+	require.NoError(t, s.archiveBundle(context.Background(), testSource, []byte("bundle")))
+
+	rec := rebuild(mux, "/bots/acme/mybot/rebuild", "source="+testSource)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "bundles of other customers can't be rebuilt")
+}
+
+func TestRebuildBot_BundleNotArchived(t *testing.T) {
+	s, mux := newRebuildServer(t)
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "mybot", Source: testSource, Status: "succeeded"}))
+
+	rec := rebuild(mux, "/bots/acme/mybot/rebuild", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestArchiveBundle(t *testing.T) {
+	s, _ := newRebuildServer(t)
+	require.NoError(t, s.archiveBundle(context.Background(), testSource, []byte("bundle")))
+	require.NoError(t, s.archiveBundle(context.Background(), testSource, []byte("bundle")))
+
+	data, err := s.bundles.Get(context.Background(), bundleKey(testSource))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bundle"), data)
+}
+
+func TestRebuildBot_PriorityOnlyFromCore(t *testing.T) {
+	s, mux := newRebuildServer(t)
+	s.cfg.ApiAccessToken = "secret"
+	require.NoError(t, s.history.RecordBuild(history.Build{Customer: "acme", Bot: "mybot", Template: "ts", Source: testSource, Status: "succeeded"}))
+	require.NoError(t, s.archiveBundle(context.Background(), testSource, []byte("bundle")))
+
+	rec := rebuild(mux, "/bots/acme/mybot/rebuild", "priority=urgent")
+	assert.Equal(t, http.StatusForbidden, rec.Code, "anyone else can't jump the queue")
+	rec = rebuild(mux, "/bots/acme/mybot/rebuild", "priority=soon")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestFromCore(t *testing.T) {
+	s := &server{cfg: &config.Config{ApiAccessToken: "secret"}}
+	req := httptest.NewRequest(http.MethodPost, "/bots/acme/mybot/rebuild", nil)
+	assert.False(t, s.fromCore(req))
+	req.Header.Set("X-Token", "guess")
+	assert.False(t, s.fromCore(req))
+	req.Header.Set("X-Token", "secret")
+	assert.True(t, s.fromCore(req))
+
+	s.cfg.ApiAccessToken = ""
+	req.Header.Set("X-Token", "")
+	assert.False(t, s.fromCore(req), "an empty token isn't core's")
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/reconcile"
+	"github.com/sensority-labs/builder/internal/state"
+)
+
+// Reconciler modes.
+const (
+	reconcileOff    = "off"
+	reconcileReport = "report"
+	reconcileApply  = "apply"
+)
+
+// reconciler keeps the outcome of the last reconciliation and makes sure only one runs at a time.
+type reconciler struct {
+	run sync.Mutex
+
+	mu   sync.Mutex
+	last *reconcile.Report
+}
+
+func (r *reconciler) lastReport() *reconcile.Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+func validateReconcileMode(mode string) error {
+	switch mode {
+	case reconcileOff, reconcileReport, reconcileApply:
+		return nil
+	default:
+		return fmt.Errorf("unknown reconcile mode %q, expected off, report or apply", mode)
+	}
+}
+
+// runReconciler reconciles every interval until ctx is done. In report mode the drift is only logged.
+func (s *server) runReconciler(ctx context.Context) {
+	if s.cfg.Reconcile.Mode == reconcileOff {
+		return
+	}
+	log.Default().Printf("Reconciling bots with core every %s (%s mode)", s.cfg.Reconcile.Interval, s.cfg.Reconcile.Mode)
+
+	ticker := time.NewTicker(s.cfg.Reconcile.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.reconcile(ctx, s.cfg.Reconcile.Mode != reconcileApply); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: reconciling bots: %+v", err))
+		}
+	}
+}
+
+// reconcile compares core's desired bots with the containers on the host and, unless dryRun
+// is set, converges them. Every action takes the bot's lock, so it doesn't race with deploys.
+func (s *server) reconcile(ctx context.Context, dryRun bool) (*reconcile.Report, error) {
+	s.reconciler.run.Lock()
+	defer s.reconciler.run.Unlock()
+
+	report := &reconcile.Report{StartedAt: time.Now().UTC(), DryRun: dryRun}
+	defer func() {
+		report.FinishedAt = time.Now().UTC()
+		s.reconciler.mu.Lock()
+		s.reconciler.last = report
+		s.reconciler.mu.Unlock()
+	}()
+
+	desired, err := s.core.ListBots(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+	actual, err := s.actualBots(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+
+	report.Actions, err = s.activeActions(reconcile.Plan(desired, actual, reconcile.Options{
+		RemoveOrphans:    s.cfg.Reconcile.RemoveOrphans,
+		MaxRemovePercent: s.cfg.Reconcile.MaxRemovePercent,
+	}))
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+	for i := range report.Actions {
+		action := &report.Actions[i]
+		if action.Skipped != "" {
+			log.Default().Printf("Skipping %s %s/%s: %s", action.Kind, action.Customer, action.Bot, action.Skipped)
+			continue
+		}
+		if dryRun {
+			log.Default().Printf("Drift: %s %s/%s: %s", action.Kind, action.Customer, action.Bot, action.Reason)
+			continue
+		}
+
+		log.Default().Printf("Reconciling: %s %s/%s: %s", action.Kind, action.Customer, action.Bot, action.Reason)
+		var stale staleActionError
+		if err := s.applyAction(ctx, action); errors.As(err, &stale) {
+			log.Default().Printf("Skipping %s %s/%s: %s", action.Kind, action.Customer, action.Bot, stale.reason)
+			action.Skipped = stale.reason
+			continue
+		} else if err != nil {
+			log.Default().Println(fmt.Sprintf("Error: reconciling %s %s/%s: %+v", action.Kind, action.Customer, action.Bot, err))
+			action.Error = err.Error()
+			continue
+		}
+		action.Applied = true
+	}
+	return report, nil
+}
+
+// actualBots returns the bot containers on the host, from the state store when it's in sync.
+func (s *server) actualBots(ctx context.Context) ([]state.Bot, error) {
+	if s.bots.Synced() {
+		return s.bots.List(), nil
+	}
+	return docker.ListBots(ctx)
+}
+
+// staleActionError is returned when the container changed since the action was planned.
+type staleActionError struct {
+	reason string
+}
+
+func (e staleActionError) Error() string {
+	return e.reason
+}
+
+// applyAction executes the action under the bot's lock. The plan is a snapshot, a deploy or a user
+// may have changed the container since, so the container is inspected again first.
+func (s *server) applyAction(ctx context.Context, action *reconcile.Action) error {
+	name := docker.ContainerName(action.Customer, action.Bot)
+	unlock := s.locks.Lock(name)
+	defer unlock()
+
+	if action.Kind == reconcile.ActionCreate {
+		_, err := docker.InspectBot(ctx, name)
+		if err == nil {
+			return staleActionError{"bot has a container now"}
+		}
+		if !errdefs.IsNotFound(err) {
+			return err
+		}
+		return s.createBot(ctx, action)
+	}
+
+	current, err := docker.InspectBot(ctx, action.ContainerID)
+	if errdefs.IsNotFound(err) {
+		return staleActionError{"container is gone"}
+	}
+	if err != nil {
+		return err
+	}
+	if current.Name != name {
+		// Stashed or replaced by a deploy
+		return staleActionError{"container was renamed to " + current.Name}
+	}
+	running := current.State == "running" || current.State == "restarting"
+
+	switch action.Kind {
+	case reconcile.ActionRegister:
+		pending, err := s.registerContainer(ctx, action.Customer, action.Bot, action.ContainerID)
+		if err == nil && pending {
+			log.Default().Printf("Registration of %s/%s is pending in the outbox", action.Customer, action.Bot)
+		}
+		return err
+	case reconcile.ActionStart:
+		if running {
+			return staleActionError{"container is " + current.State}
+		}
+	case reconcile.ActionStop:
+		if !running {
+			return staleActionError{"container is " + current.State}
+		}
+	case reconcile.ActionRemove:
+	default:
+		return fmt.Errorf("unknown reconcile action %q", action.Kind)
+	}
+
+	bc, err := docker.GetBotContainer(action.ContainerID)
+	if err != nil {
+		return err
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	switch action.Kind {
+	case reconcile.ActionStart:
+		if current.State == "paused" {
+			return bc.Unpause()
+		}
+		return bc.Start()
+	case reconcile.ActionStop:
+		return bc.Stop()
+	default:
+		return bc.Remove()
+	}
+}
+
+// createBot creates and starts a container for a bot from its existing image.
+// Bots that were never built can't be created, they need a build.
+func (s *server) createBot(ctx context.Context, action *reconcile.Action) error {
+	bc, err := docker.NewBotContainer(s.cfg, action.Bot, action.Customer)
+	if err != nil {
+		return err
+	}
+	defer func(bc *docker.BotContainer) {
+		if err := bc.Close(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: %+v", err))
+		}
+	}(bc)
+
+	hasImage, err := bc.HasImage()
+	if err != nil {
+		return err
+	}
+	if !hasImage {
+		return errors.New("bot has no image, it needs a build")
+	}
+	if err := bc.UpdateEnvs(ctx, s.cfg, s.core); err != nil {
+		return err
+	}
+	if err := bc.Create(); err != nil {
+		return err
+	}
+	action.ContainerID = bc.ID
+	if err := bc.Start(); err != nil {
+		return err
+	}
+	s.recordDeployment(history.DeployReconcile, action.Customer, action.Bot, bc)
+	_, err = s.registerContainer(ctx, action.Customer, action.Bot, bc.ID)
+	return err
+}
+
+// reconcileBots runs a reconciliation, a dry run with ?dryRun=true or unless the reconciler is in apply mode.
+func (s *server) reconcileBots() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun := r.URL.Query().Get("dryRun") == "true" || s.cfg.Reconcile.Mode != reconcileApply
+		s.writeReconcile(w, r, dryRun)
+	}
+}
+
+// previewReconcile runs a dry run and returns the actions a reconciliation would take.
+func (s *server) previewReconcile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeReconcile(w, r, true)
+	}
+}
+
+func (s *server) writeReconcile(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	report, err := s.reconcile(r.Context(), dryRun)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, report)
+}
+
+// lastReconcile returns the report of the last reconciliation.
+func (s *server) lastReconcile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := s.reconciler.lastReport()
+		if report == nil {
+			writeError(w, r, errdefs.NotFound(errors.New("no reconciliation has run yet")))
+			return
+		}
+		writeJSON(w, r, report)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/config"
+	"github.com/sensority-labs/builder/internal/docker/dockertest"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/reconcile"
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileBots_ReportMode(t *testing.T) {
+	core := newFakeCore()
+	core.bots = []bot.DesiredBot{{UserName: "acme", BotName: "mybot", ContainerID: "c1", DesiredState: bot.DesiredRunning}}
+	s := newTestServer(t, core)
+	s.cfg = &config.Config{Reconcile: config.ReconcileConfig{Mode: reconcileReport, RemoveOrphans: true}}
+	s.bots = syncedStore(state.Bot{ContainerID: "c1", Name: "acme_mybot", Customer: "acme", Bot: "mybot", State: "exited"})
+
+	rec := httptest.NewRecorder()
+	s.reconcileBots()(rec, httptest.NewRequest(http.MethodPost, "/reconcile", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	report := s.reconciler.lastReport()
+	require.NotNil(t, report)
+	assert.True(t, report.DryRun, "report mode never applies actions")
+	require.Len(t, report.Actions, 1)
+	assert.Equal(t, reconcile.ActionStart, report.Actions[0].Kind)
+	assert.False(t, report.Actions[0].Applied)
+
+	rec = httptest.NewRecorder()
+	s.lastReconcile()(rec, httptest.NewRequest(http.MethodGet, "/reconcile/last", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"kind":"start"`)
+}
+
+func TestReconcileBots_CoreUnavailable(t *testing.T) {
+	core := newFakeCore()
+	core.err = &bot.StatusError{StatusCode: http.StatusServiceUnavailable}
+	s := newTestServer(t, core)
+	s.cfg = &config.Config{Reconcile: config.ReconcileConfig{Mode: reconcileApply}}
+	s.bots = syncedStore()
+
+	rec := httptest.NewRecorder()
+	s.reconcileBots()(rec, httptest.NewRequest(http.MethodPost, "/reconcile", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotEmpty(t, s.reconciler.lastReport().Error)
+}
+
+func newReconcileServer(t *testing.T, core *fakeCore, reconcileConfig config.ReconcileConfig) *server {
+	s := newTestServer(t, core)
+	historyStore, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { historyStore.Close() })
+	s.history = historyStore
+	s.cfg = &config.Config{NetworkName: "sensority-labs", Reconcile: reconcileConfig}
+	s.bots = state.NewStore()
+	return s
+}
+
+func TestReconcile_Apply(t *testing.T) {
+	d := dockertest.New(t)
+	d.AddNetwork("sensority-labs", nil)
+	crashed := addBot(t, d, "acme", "crashed", "exited")
+	disabled := addBot(t, d, "acme", "disabled", "running")
+	healthy := addBot(t, d, "acme", "healthy", "running")
+	addBot(t, d, "globex", "orphan", "running")
+	d.AddImage(container.Config{Cmd: []string{"node", "index.js"}}, "acme_missing:latest")
+	core := newFakeCore()
+	core.bots = []bot.DesiredBot{
+		{UserName: "acme", BotName: "crashed", ContainerID: crashed, DesiredState: bot.DesiredRunning},
+		{UserName: "acme", BotName: "disabled", ContainerID: disabled, DesiredState: bot.DesiredStopped},
+		{UserName: "acme", BotName: "healthy", ContainerID: healthy, DesiredState: bot.DesiredRunning},
+		{UserName: "acme", BotName: "missing", DesiredState: bot.DesiredRunning},
+	}
+	s := newReconcileServer(t, core, config.ReconcileConfig{Mode: reconcileApply, RemoveOrphans: true, MaxRemovePercent: 50})
+	d.ResetCalls()
+
+	report, err := s.reconcile(context.Background(), false)
+
+	require.NoError(t, err)
+	require.Len(t, report.Actions, 4)
+	for _, action := range report.Actions {
+		assert.True(t, action.Applied, "%s %s/%s: %s", action.Kind, action.Customer, action.Bot, action.Error)
+	}
+	assert.ElementsMatch(t, []string{
+		"start acme_crashed",
+		"stop acme_disabled",
+		"create acme_missing",
+		"start acme_missing",
+		"remove globex_orphan",
+	}, d.Calls())
+	missing, ok := d.Container("acme_missing")
+	require.True(t, ok)
+	assert.Equal(t, missing.ID, core.containers["acme/missing"], "the created container is registered in core")
+}
+
+func TestReconcile_SkipsStaleActions(t *testing.T) {
+	d := dockertest.New(t)
+	running := addBot(t, d, "acme", "restarted", "running")
+	addBot(t, d, "acme", "deployed", "running")
+	core := newFakeCore()
+	core.bots = []bot.DesiredBot{
+		{UserName: "acme", BotName: "restarted", ContainerID: running, DesiredState: bot.DesiredRunning},
+		{UserName: "acme", BotName: "replaced", ContainerID: "c2", DesiredState: bot.DesiredStopped},
+		{UserName: "acme", BotName: "deployed", DesiredState: bot.DesiredRunning},
+	}
+	s := newReconcileServer(t, core, config.ReconcileConfig{Mode: reconcileApply})
+	// The snapshot the plan is made from is older than the daemon's state
+	s.bots = syncedStore(
+		state.Bot{ContainerID: running, Name: "acme_restarted", Customer: "acme", Bot: "restarted", State: "exited"},
+		state.Bot{ContainerID: "c2", Name: "acme_replaced", Customer: "acme", Bot: "replaced", State: "running"},
+	)
+	d.ResetCalls()
+
+	report, err := s.reconcile(context.Background(), false)
+
+	require.NoError(t, err)
+	skipped := make(map[string]string)
+	for _, action := range report.Actions {
+		assert.False(t, action.Applied)
+		skipped[action.Kind+" "+action.Bot] = action.Skipped
+	}
+	assert.Equal(t, map[string]string{
+		"start restarted": "container is running",
+		"stop replaced":   "container is gone",
+		"create deployed": "bot has a container now",
+	}, skipped)
+	assert.Empty(t, d.Calls())
+}
+
+func TestReconcile_RemovalLimit(t *testing.T) {
+	d := dockertest.New(t)
+	known := addBot(t, d, "acme", "mybot", "running")
+	for _, name := range []string{"a", "b", "c"} {
+		addBot(t, d, "globex", name, "running")
+	}
+	core := newFakeCore()
+	core.bots = []bot.DesiredBot{{UserName: "acme", BotName: "mybot", ContainerID: known, DesiredState: bot.DesiredRunning}}
+	s := newReconcileServer(t, core, config.ReconcileConfig{Mode: reconcileApply, RemoveOrphans: true, MaxRemovePercent: 10})
+	d.ResetCalls()
+
+	report, err := s.reconcile(context.Background(), false)
+
+	require.NoError(t, err)
+	require.Len(t, report.Actions, 3)
+	for _, action := range report.Actions {
+		assert.Equal(t, reconcile.ActionRemove, action.Kind)
+		assert.False(t, action.Applied)
+		assert.Equal(t, "3 of 4 containers would be removed, more than 10%", action.Skipped)
+	}
+	assert.Empty(t, d.Calls())
+}
+
+func TestPreviewReconcile(t *testing.T) {
+	d := dockertest.New(t)
+	addBot(t, d, "acme", "mybot", "exited")
+	core := newFakeCore()
+	core.bots = []bot.DesiredBot{{UserName: "acme", BotName: "mybot", DesiredState: bot.DesiredRunning}}
+	s := newReconcileServer(t, core, config.ReconcileConfig{Mode: reconcileApply})
+	d.ResetCalls()
+
+	rec := httptest.NewRecorder()
+	s.previewReconcile()(rec, httptest.NewRequest(http.MethodGet, "/reconcile", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"dryRun":true`)
+	assert.Contains(t, rec.Body.String(), `"kind":"start"`)
+	assert.Empty(t, d.Calls(), "a GET never changes containers")
+}
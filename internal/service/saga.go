@@ -0,0 +1,49 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// saga runs the steps of an operation and, when a step fails, undoes the completed ones in reverse order.
+type saga struct {
+	name          string
+	compensations []compensation
+}
+
+type compensation struct {
+	step string
+	undo func() error
+}
+
+func newSaga(name string) *saga {
+	return &saga{name: name}
+}
+
+// step runs do and, if it succeeds, registers undo to compensate it on rollback. undo may be nil.
+func (s *saga) step(name string, do, undo func() error) error {
+	if err := do(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if undo != nil {
+		s.compensations = append(s.compensations, compensation{step: name, undo: undo})
+	}
+	return nil
+}
+
+// rollback compensates the completed steps in reverse order. All compensations run
+// even if some of them fail, their errors are returned joined.
+func (s *saga) rollback() error {
+	var errList []error
+	for i := len(s.compensations) - 1; i >= 0; i-- {
+		c := s.compensations[i]
+		log.Default().Printf("Rolling back %s: %s", s.name, c.step)
+		if err := c.undo(); err != nil {
+			log.Default().Println(fmt.Sprintf("Error: rolling back %s: %s: %+v", s.name, c.step, err))
+			errList = append(errList, fmt.Errorf("%s: %w", c.step, err))
+		}
+	}
+	s.compensations = nil
+	return errors.Join(errList...)
+}
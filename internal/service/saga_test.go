@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaga_RollbackUndoesCompletedStepsInReverse(t *testing.T) {
+	tx := newSaga("deploy")
+	var undone []string
+	undo := func(name string) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return nil
+		}
+	}
+
+	require.NoError(t, tx.step("build", func() error { return nil }, undo("build")))
+	require.NoError(t, tx.step("envs", func() error { return nil }, nil))
+	require.NoError(t, tx.step("create", func() error { return nil }, undo("create")))
+	err := tx.step("register", func() error { return errors.New("core is down") }, undo("register"))
+	assert.EqualError(t, err, "register: core is down")
+
+	assert.NoError(t, tx.rollback())
+	assert.Equal(t, []string{"create", "build"}, undone)
+}
+
+func TestSaga_RollbackRunsAllCompensations(t *testing.T) {
+	tx := newSaga("deploy")
+	var undone []string
+
+	require.NoError(t, tx.step("build", func() error { return nil }, func() error {
+		undone = append(undone, "build")
+		return nil
+	}))
+	require.NoError(t, tx.step("create", func() error { return nil }, func() error {
+		return errors.New("container is gone")
+	}))
+
+	err := tx.rollback()
+	assert.EqualError(t, err, "create: container is gone")
+	assert.Equal(t, []string{"build"}, undone)
+}
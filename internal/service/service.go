@@ -1,52 +1,192 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
+	"path/filepath"
+	"time"
 
-	"github.com/go-git/go-git/v5"
+	"github.com/sensority-labs/builder/internal/blob"
+	"github.com/sensority-labs/builder/internal/bot"
+	"github.com/sensority-labs/builder/internal/buildlog"
 	"github.com/sensority-labs/builder/internal/config"
-
-	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/sensority-labs/builder/internal/cradle"
+	"github.com/sensority-labs/builder/internal/customers"
+	"github.com/sensority-labs/builder/internal/docker"
+	"github.com/sensority-labs/builder/internal/fleet"
+	"github.com/sensority-labs/builder/internal/history"
+	"github.com/sensority-labs/builder/internal/jobs"
+	"github.com/sensority-labs/builder/internal/lifecycle"
+	"github.com/sensority-labs/builder/internal/outbox"
+	"github.com/sensority-labs/builder/internal/quota"
+	"github.com/sensority-labs/builder/internal/scheduler"
+	"github.com/sensority-labs/builder/internal/state"
+	"golang.org/x/sync/singleflight"
 )
 
-const cradleRepoURL = "https://github.com/sensority-labs/cradle-ts.git"
+// server holds the state shared by the handlers.
+type server struct {
+	cfg     *config.Config
+	core    bot.Core
+	cradles *cradle.Registry
+	mirrors *cradle.Mirrors
+
+	// locks serializes operations on the same bot and builds coalesces identical concurrent builds
+	locks  *botLocks
+	builds singleflight.Group
+
+	idempotency *idempotencyCache
+
+	// bots is the state of bot containers kept up to date from Docker events
+	bots *state.Store
+
+	// jobs persists builds, so the ones interrupted by a restart are recovered on startup
+	jobs *jobs.Store
+
+	// logs keeps the output of every build job
+	logs *buildlog.Store
+
+	// bundles archives uploaded bundles, so bots can be rebuilt without an upload
+	bundles blob.Store
+
+	// customers keeps the customers that are suspended or purged, their bots aren't built or started
+	customers *customers.Store
+
+	// history records the builds and deployments of every bot
+	history *history.Store
+
+	// outbox retries callbacks to core that failed while core was unavailable
+	outbox *outbox.Outbox
+
+	reconciler reconciler
+
+	// scheduler queues builds fairly across customers and runs them on a fixed number of workers
+	scheduler *scheduler.Scheduler
+
+	// quotas counts the builds of every customer to enforce their build rate limits
+	quotas *quota.Tracker
+
+	// fleet runs rollouts to many bots, like rebuilds after a cradle update
+	fleet *fleet.Manager
 
-func getCradle(cradlePath, ghToken string) error {
-	clearCmd := exec.Command("rm", "-rf", cradlePath)
-	if err := clearCmd.Run(); err != nil {
+	// events publishes bot lifecycle events seen by the Docker events watcher
+	events lifecycle.Multi
+}
+
+func Run(cfg *config.Config) error {
+	cradles, err := cradle.NewRegistry(cfg)
+	if err != nil {
 		return err
 	}
-	log.Printf("Cloning cradle to the path: %s\n", cradlePath)
-	auth := &githttp.BasicAuth{
-		Username: "username", // Can be anything except an empty string
-		Password: ghToken,
+	log.Default().Printf("Cradle templates: %v", cradles.Names())
+	mirrors, err := cradle.NewMirrors(cfg)
+	if err != nil {
+		return err
 	}
 
-	_, err := git.PlainClone(cradlePath, false, &git.CloneOptions{
-		URL:      cradleRepoURL,
-		Progress: os.Stdout,
-		Auth:     auth,
-	})
+	box, err := outbox.New(filepath.Join(cfg.DataDir, "outbox"), cfg.OutboxInterval)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func Run(cfg *config.Config) error {
+	jobStore, err := jobs.Open(filepath.Join(cfg.DataDir, "builder.db"))
+	if err != nil {
+		return err
+	}
+
+	historyStore, err := history.Open(filepath.Join(cfg.DataDir, "history.db"))
+	if err != nil {
+		return err
+	}
+
+	logs, err := buildlog.New(filepath.Join(cfg.DataDir, "logs"), cfg.BuildLog.MaxSize, cfg.BuildLog.Retention)
+	if err != nil {
+		return err
+	}
+
+	customerStore, err := customers.Open(filepath.Join(cfg.DataDir, "customers.db"))
+	if err != nil {
+		return err
+	}
+
+	bundles, err := blob.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := validateReconcileMode(cfg.Reconcile.Mode); err != nil {
+		return err
+	}
+	if err := validateQuota(cfg); err != nil {
+		return err
+	}
+
+	s := &server{
+		cfg:     cfg,
+		core:    bot.NewClient(cfg),
+		cradles: cradles,
+		mirrors: mirrors,
+		locks:   newBotLocks(),
+
+		idempotency: newIdempotencyCache(cfg.IdempotencyTTL),
+		outbox:      box,
+		bots:        state.NewStore(),
+		jobs:        jobStore,
+		history:     historyStore,
+		logs:        logs,
+		bundles:     bundles,
+		customers:   customerStore,
+		scheduler:   scheduler.New(cfg.Scheduler.Workers),
+		quotas:      quota.NewTracker(),
+		fleet:       fleet.NewManager(),
+	}
+
+	if s.events, err = s.newLifecyclePublisher(); err != nil {
+		return err
+	}
+	if err := s.recoverJobs(context.Background()); err != nil {
+		return err
+	}
+	go docker.WatchBots(context.Background(), s.bots, s.publishLifecycle)
+
+	box.Handle(kindCoreRegistration, s.registerInCore)
+	go box.Run(context.Background(), cfg.OutboxInterval)
+	go logs.Run(context.Background(), time.Hour)
+	go jobStore.Run(context.Background(), time.Hour, cfg.JobRetention)
+	go s.runReconciler(context.Background())
+
 	// Setup server
-	http.HandleFunc("/build/{customerName}/{botName}", makeBot(cfg))
-	http.HandleFunc("/{containerId}/start", startBot())
-	http.HandleFunc("/{containerId}/stop", stopBot())
-	http.HandleFunc("/{containerId}/status", botStatus())
-	http.HandleFunc("/{containerId}/recreate", recreateBot(cfg))
-	http.HandleFunc("/{containerId}/remove", removeBot())
+	http.HandleFunc("/build/{customerName}/{botName}", s.makeBot())
+	http.HandleFunc("GET /bots", s.listBots())
+	http.HandleFunc("GET /bots/{customer}/{bot}/history", s.botHistory())
+	http.HandleFunc("POST /bots/{customer}/{bot}/rebuild", s.rebuildBot())
+	http.HandleFunc("GET /reconcile", s.previewReconcile())
+	http.HandleFunc("POST /reconcile", s.reconcileBots())
+	http.HandleFunc("GET /reconcile/last", s.lastReconcile())
+	http.HandleFunc("GET /customers/{customer}/status", s.customerStatus())
+	http.HandleFunc("GET /customers/{customer}/quota", s.customerQuota())
+	http.HandleFunc("POST /customers/{customer}/suspend", s.suspendCustomer())
+	http.HandleFunc("POST /customers/{customer}/resume", s.resumeCustomer())
+	http.HandleFunc("POST /customers/{customer}/purge", s.purgeCustomer())
+	http.HandleFunc("POST /fleet/rebuild", s.rebuildFleet())
+	http.HandleFunc("POST /fleet/refresh-envs", s.refreshFleetEnvs())
+	http.HandleFunc("GET /fleet/operations", s.fleetOperations())
+	http.HandleFunc("GET /fleet/operations/{operationId}", s.fleetOperation())
+	http.HandleFunc("POST /fleet/operations/{operationId}/resume", s.resumeFleetOperation())
+	http.HandleFunc("POST /fleet/operations/{operationId}/cancel", s.cancelFleetOperation())
+	http.HandleFunc("GET /queue", s.buildQueue())
+	http.HandleFunc("GET /jobs/{jobId}/status", s.jobStatus())
+	http.HandleFunc("GET /jobs/{jobId}/log", s.jobLog())
+	http.HandleFunc("/{containerId}/start", s.startBot())
+	http.HandleFunc("/{containerId}/stop", s.stopBot())
+	http.HandleFunc("/{containerId}/status", s.botStatus())
+	http.HandleFunc("/{containerId}/recreate", s.recreateBot())
+	http.HandleFunc("/{containerId}/plan", s.planBot())
+	http.HandleFunc("/{containerId}/remove", s.removeBot())
 
 	// Start the server
 	log.Default().Println("Server started at :" + cfg.Port)
-	return http.ListenAndServe(fmt.Sprintf(":%s", cfg.Port), nil)
+	return http.ListenAndServe(fmt.Sprintf(":%s", cfg.Port), withRequestID(http.DefaultServeMux))
 }
@@ -0,0 +1,124 @@
+package state
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot is the last known state of a bot container.
+type Bot struct {
+	ContainerID string `json:"containerId"`
+	Name        string `json:"name"`
+	Customer    string `json:"customer"`
+	Bot         string `json:"bot"`
+	Image       string `json:"image"`
+
+	State     string `json:"state"`
+	Health    string `json:"health,omitempty"`
+	ExitCode  int    `json:"exitCode"`
+	OOMKilled bool   `json:"oomKilled"`
+
+	RestartCount int `json:"restartCount"`
+
+	// Resource limits of the container, zero if unlimited
+	Memory   int64 `json:"memory,omitempty"`
+	NanoCPUs int64 `json:"nanoCpus,omitempty"`
+
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+
+	// LastEvent is the last Docker event seen for the container
+	LastEvent string    `json:"lastEvent,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Store keeps the state of bot containers in memory. It is fed by the Docker events watcher
+// and is only authoritative while Synced reports true.
+type Store struct {
+	mu     sync.RWMutex
+	bots   map[string]Bot
+	synced bool
+}
+
+func NewStore() *Store {
+	return &Store{bots: make(map[string]Bot)}
+}
+
+// Put adds or updates the state of a container.
+func (s *Store) Put(bot Bot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bots[bot.ContainerID] = bot
+}
+
+// Delete drops a container that was destroyed.
+func (s *Store) Delete(containerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bots, containerID)
+}
+
+// Replace swaps the whole store for a fresh listing and marks it synced.
+func (s *Store) Replace(bots []Bot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bots = make(map[string]Bot, len(bots))
+	for _, bot := range bots {
+		s.bots[bot.ContainerID] = bot
+	}
+	s.synced = true
+}
+
+// SetUnsynced marks the store as possibly outdated, e.g. while the events stream is disconnected.
+func (s *Store) SetUnsynced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.synced = false
+}
+
+// Synced reports whether the store reflects all bot containers.
+func (s *Store) Synced() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.synced
+}
+
+// Lookup finds a container by full ID, unique ID prefix or name, like the Docker CLI does.
+func (s *Store) Lookup(ref string) (Bot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if bot, ok := s.bots[ref]; ok {
+		return bot, true
+	}
+	name := strings.TrimPrefix(ref, "/")
+	var match Bot
+	matches := 0
+	for id, bot := range s.bots {
+		if bot.Name == name {
+			return bot, true
+		}
+		if strings.HasPrefix(id, ref) {
+			match = bot
+			matches++
+		}
+	}
+	return match, matches == 1
+}
+
+// List returns the state of all containers ordered by name.
+func (s *Store) List() []Bot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bots := make([]Bot, 0, len(s.bots))
+	for _, bot := range s.bots {
+		bots = append(bots, bot)
+	}
+	sort.Slice(bots, func(i, j int) bool {
+		return bots[i].Name < bots[j].Name
+	})
+	return bots
+}
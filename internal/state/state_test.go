@@ -0,0 +1,53 @@
+package state_test
+
+import (
+	"testing"
+
+	"github.com/sensority-labs/builder/internal/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Lookup(t *testing.T) {
+	store := state.NewStore()
+	store.Put(state.Bot{ContainerID: "4f2a9c01", Name: "acme_mybot", State: "running"})
+	store.Put(state.Bot{ContainerID: "4f7b1d02", Name: "acme_otherbot", State: "exited"})
+
+	bot, ok := store.Lookup("4f2a9c01")
+	assert.True(t, ok)
+	assert.Equal(t, "acme_mybot", bot.Name)
+
+	bot, ok = store.Lookup("4f7b")
+	assert.True(t, ok, "unique ID prefix")
+	assert.Equal(t, "acme_otherbot", bot.Name)
+
+	bot, ok = store.Lookup("/acme_mybot")
+	assert.True(t, ok, "container name")
+	assert.Equal(t, "4f2a9c01", bot.ContainerID)
+
+	_, ok = store.Lookup("4f")
+	assert.False(t, ok, "ambiguous ID prefix")
+
+	store.Delete("4f2a9c01")
+	_, ok = store.Lookup("acme_mybot")
+	assert.False(t, ok)
+}
+
+func TestStore_Replace(t *testing.T) {
+	store := state.NewStore()
+	assert.False(t, store.Synced())
+	store.Put(state.Bot{ContainerID: "gone", Name: "acme_gone"})
+
+	store.Replace([]state.Bot{
+		{ContainerID: "b", Name: "acme_zbot"},
+		{ContainerID: "a", Name: "acme_abot"},
+	})
+
+	assert.True(t, store.Synced())
+	bots := store.List()
+	assert.Len(t, bots, 2)
+	assert.Equal(t, "acme_abot", bots[0].Name)
+	assert.Equal(t, "acme_zbot", bots[1].Name)
+
+	store.SetUnsynced()
+	assert.False(t, store.Synced())
+}